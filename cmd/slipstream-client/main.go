@@ -2,75 +2,220 @@ package main
 
 import (
 	"context"
+	"crypto/x509"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 
+	dnspkg "github.com/getlantern/lantern/slipstream/pkg/dns"
 	"github.com/getlantern/lantern/slipstream/pkg/proxy"
 	"github.com/getlantern/lantern/slipstream/pkg/transport"
 )
 
 var (
-	listenAddr string
-	serverAddr string
-	domain     string
+	listenAddr    string
+	serverAddr    string
+	localAddrs    []string
+	domain        string
+	alpn          string
+	sni           string
+	target        string
+	udpListen     string
+	udpTarget     string
+	encoding      string
+	pin           string
+	caFile        string
+	insecure      bool
+	psk           string
+	recordType    string
+	randomCase    bool
+	compress      int
+	statsEvery    time.Duration
+	idleTimeout   time.Duration
+	logLevel      string
+	padSize       int
+	padBuckets    []int
+	pace          time.Duration
+	paceJitter    time.Duration
+	transportFlag string
+	dohURL        string
+	resolverAddr  string
+	socks         bool
+	ednsSize      int
+	connTimeout   time.Duration
+	keepAlive     time.Duration
+	healthEvery   time.Duration
+	poolSize      int
+	poolIdle      time.Duration
 )
 
 var rootCmd = &cobra.Command{
 	Use:   "slipstream-client",
 	Short: "Slipstream DNS tunnel client",
-	Long: `A high-performance covert channel over DNS, powered by QUIC multipath.
+	Long: `A high-performance covert channel over DNS, powered by QUIC and optionally
+spread over several network paths.
 The client listens for TCP connections and tunnels them through DNS queries to the server.`,
 	RunE: runClient,
 }
 
 func init() {
 	rootCmd.Flags().StringVarP(&listenAddr, "listen", "l", "127.0.0.1:8080", "Local TCP address to listen on")
+	rootCmd.Flags().BoolVar(&socks, "socks", false, "Serve SOCKS5 on --listen and tunnel each connection to the destination it asks for, instead of to --target")
 	rootCmd.Flags().StringVarP(&serverAddr, "server", "s", "", "Server address (host:port)")
+	rootCmd.Flags().StringVar(&transportFlag, "transport", "quic", "Transport to the server: quic over UDP, doh for DNS-over-HTTPS to --doh-url, or dns53 for plain DNS through --resolver")
+	rootCmd.Flags().StringVar(&dohURL, "doh-url", "", "DNS-over-HTTPS endpoint of the server, such as https://host/dns-query (with --transport=doh)")
+	rootCmd.Flags().StringVar(&resolverAddr, "resolver", "", "DNS resolver (host:port) to send queries through, or the server itself (with --transport=dns53)")
+	rootCmd.Flags().StringSliceVar(&localAddrs, "local-addr", nil, "Local address or interface name to send tunnel traffic from (repeatable; each extra one adds a path)")
 	rootCmd.Flags().StringVarP(&domain, "domain", "d", "tunnel.example.com", "Domain name for DNS tunneling")
+	rootCmd.Flags().StringVar(&alpn, "alpn", transport.ALPN, "ALPN protocol to negotiate (must match the server)")
+	rootCmd.Flags().StringVar(&sni, "sni", transport.SNI, "TLS server name to send (must match the server)")
+
+	rootCmd.Flags().StringVarP(&target, "target", "t", "", "Address (host:port) the server should connect streams to (default: the server's --target)")
+	rootCmd.Flags().StringVar(&udpListen, "udp-listen", "", "Local UDP address to forward datagrams from (disabled if empty)")
+	rootCmd.Flags().StringVar(&udpTarget, "udp-target", "", "UDP address (host:port) the server should forward datagrams to (default: the server's --target, which must be udp://)")
+	rootCmd.Flags().StringVar(&encoding, "encoding", "base32", "Query name encoding: base32, base62 or hex (must match the server)")
+	rootCmd.Flags().StringVar(&recordType, "record-type", "TXT", "Record type to query, and so to carry responses: TXT, A, AAAA or NULL")
+	rootCmd.Flags().BoolVar(&randomCase, "randomize-case", false, "Randomize the case of query names like resolvers using 0x20 encoding (not with base62)")
+	rootCmd.Flags().StringVar(&pin, "pin", "", "SHA-256 pin of the server's certificate key, as logged by the server")
+	rootCmd.Flags().StringVar(&caFile, "ca", "", "PEM file of CA certificates to verify the server against instead of the system roots")
+	rootCmd.Flags().BoolVar(&insecure, "insecure", false, "Don't verify the server's certificate (allows interception)")
+	rootCmd.Flags().StringVar(&psk, "psk", "", "Pre-shared key to authenticate with (must match the server)")
+	rootCmd.Flags().IntVar(&padSize, "pad-size", 0, "Pad query and response payloads to a multiple of this many bytes (must match the server; 0 disables)")
+	rootCmd.Flags().IntSliceVar(&padBuckets, "pad-buckets", nil, "Pad the data of query and response payloads up to the smallest of these sizes that fits, e.g. 32,64,96,128 (must match the server; overrides --pad-size)")
+	rootCmd.Flags().IntVar(&ednsSize, "edns-size", dnspkg.EDNSBufferSize, "EDNS UDP payload size to advertise, 512 to 65535, bounding the server's responses (larger sizes need fewer queries if the path carries them)")
+	rootCmd.Flags().DurationVar(&pace, "pace", 0, "Minimum delay between queries, to avoid bursts of queries (0 disables)")
+	rootCmd.Flags().DurationVar(&paceJitter, "pace-jitter", 0, "Random extra delay of up to this much between queries")
+	rootCmd.Flags().DurationVar(&connTimeout, "connect-timeout", transport.DefaultConnectTimeout, "Give up on each attempt to connect to the server after this long (0 leaves only the QUIC handshake timeout)")
+	rootCmd.Flags().DurationVar(&keepAlive, "keepalive", transport.DefaultKeepAlivePeriod, "Send a keep-alive on the idle connection to the server at this interval (0 disables)")
+	rootCmd.Flags().DurationVar(&healthEvery, "health-interval", 0, "Ping the server through the tunnel at this interval and warn when it stops answering (0 disables)")
+	rootCmd.Flags().IntVar(&poolSize, "stream-pool", 0, "Keep up to this many finished streams open for reuse by later connections to the same target (0 disables)")
+	rootCmd.Flags().DurationVar(&poolIdle, "stream-pool-idle", transport.DefaultStreamPoolIdleTimeout, "Close pooled streams left unused for this long")
+	rootCmd.Flags().DurationVar(&idleTimeout, "idle-timeout", proxy.DefaultIdleTimeout, "Close proxied connections after this long without traffic in either direction (0 disables)")
+	rootCmd.Flags().StringVar(&logLevel, "log-level", "info", "Minimum level of log messages: debug, info, warn or error")
+	rootCmd.Flags().DurationVar(&statsEvery, "stats-interval", 0, "Log traffic statistics at this interval (0 disables)")
+	rootCmd.Flags().IntVar(&compress, "compression", 0, "Compression level for stream data, 1 (fastest) to 9 (smallest), if the server allows it (0 disables)")
 
-	rootCmd.MarkFlagRequired("server")
 }
 
 func runClient(cmd *cobra.Command, args []string) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	logger, err := newLogger(logLevel)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+
 	// Setup signal handling
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
-	// Create QUIC client
-	client := transport.NewClient(serverAddr, domain)
+	if err := transport.ValidateTarget(target); err != nil {
+		return err
+	}
+	if socks && target != "" {
+		return fmt.Errorf("--target can't be used with --socks, whose clients choose their destinations")
+	}
+	if err := transport.ValidateTarget(udpTarget); err != nil {
+		return err
+	}
+	if err := dnspkg.ValidateEDNSBufferSize(ednsSize); err != nil {
+		return fmt.Errorf("invalid --edns-size: %w", err)
+	}
+	if err := dnspkg.ValidatePadBuckets(padBuckets); err != nil {
+		return fmt.Errorf("invalid --pad-buckets: %w", err)
+	}
+	rrtype, err := dnspkg.ParseRecordType(recordType)
+	if err != nil {
+		return err
+	}
 
-	// Connect to server
-	log.Printf("Connecting to server at %s...", serverAddr)
-	if err := client.Connect(ctx); err != nil {
-		return fmt.Errorf("failed to connect to server: %w", err)
+	encoder, err := dnspkg.ParseEncoder(encoding)
+	if err != nil {
+		return err
 	}
-	defer client.Close()
 
-	log.Printf("Connected to server")
+	dnsConfig := dnspkg.DefaultConfig()
+	dnsConfig.Encoder = encoder
+	dnsConfig.RecordType = rrtype
+	dnsConfig.RandomizeCase = randomCase
+	dnsConfig.PadSize = padSize
+	dnsConfig.PadBuckets = padBuckets
+	dnsConfig.EDNSBufferSize = uint16(ednsSize)
+
+	var client tunnelClient
+	switch transportFlag {
+	case "quic":
+		quicClient, err := connectQUIC(ctx, dnsConfig)
+		if err != nil {
+			return err
+		}
+		defer quicClient.Close()
+		client = quicClient
+		if healthEvery > 0 {
+			go checkHealth(ctx, quicClient)
+		}
+	case "doh":
+		dohClient, err := newDoHClient(dnsConfig)
+		if err != nil {
+			return err
+		}
+		client = dohClient
+	case "dns53":
+		dnsClient, err := newDNSClient(dnsConfig)
+		if err != nil {
+			return err
+		}
+		client = dnsClient
+	default:
+		return fmt.Errorf("unknown transport %q", transportFlag)
+	}
 
-	// Create TCP proxy
-	tcpProxy := proxy.NewTCPProxy(listenAddr, client)
+	// Create the local proxy: a TCP proxy to one target, or SOCKS5
+	var localProxy listenerProxy
+	if socks {
+		socksProxy := proxy.NewSOCKS5Proxy(listenAddr, client)
+		socksProxy.SetIdleTimeout(idleTimeout)
+		localProxy = socksProxy
+	} else {
+		tcpProxy := proxy.NewTCPProxy(listenAddr, client)
+		tcpProxy.SetTarget(target)
+		tcpProxy.SetIdleTimeout(idleTimeout)
+		localProxy = tcpProxy
+	}
 
-	// Start proxy in goroutine
-	errChan := make(chan error, 1)
+	// Start proxies in goroutines
+	errChan := make(chan error, 2)
 	go func() {
-		errChan <- tcpProxy.Listen(ctx)
+		errChan <- localProxy.Listen(ctx)
 	}()
 
+	var udpProxy *proxy.UDPProxy
+	if udpListen != "" {
+		udpProxy = proxy.NewUDPProxy(udpListen, client)
+		udpProxy.SetTarget(udpTarget)
+		defer udpProxy.Close()
+		go func() {
+			errChan <- udpProxy.Listen(ctx)
+		}()
+	}
+
+	if statsEvery > 0 {
+		go logStats(ctx, client, localProxy, udpProxy)
+	}
+
 	// Wait for signal or error
 	select {
 	case sig := <-sigChan:
-		log.Printf("Received signal %v, shutting down...", sig)
+		slog.Info("Shutting down", "signal", sig)
 		cancel()
-		tcpProxy.Close()
+		localProxy.Close()
 		return nil
 	case err := <-errChan:
 		if err != nil && err != context.Canceled {
@@ -80,6 +225,214 @@ func runClient(cmd *cobra.Command, args []string) error {
 	}
 }
 
+// listenerProxy is implemented by the proxies serving --listen
+type listenerProxy interface {
+	Listen(ctx context.Context) error
+	Close() error
+	Stats() proxy.Stats
+}
+
+// tunnelClient is implemented by the clients of every transport
+type tunnelClient interface {
+	proxy.StreamOpener
+	proxy.TargetStreamOpener
+	Stats() transport.Stats
+}
+
+// connectQUIC creates the QUIC client and connects it to --server
+func connectQUIC(ctx context.Context, dnsConfig dnspkg.Config) (*transport.Client, error) {
+	if serverAddr == "" {
+		return nil, fmt.Errorf("--server is required with --transport=quic")
+	}
+
+	client := transport.NewClientWithConfig(serverAddr, domain, transport.Config{
+		ALPN: alpn,
+		SNI:  sni,
+
+		KeepAlivePeriod: keepAlivePeriod(),
+	})
+	if len(localAddrs) > 0 {
+		client.SetLocalAddr(localAddrs[0])
+		for _, addr := range localAddrs[1:] {
+			client.AddLocalAddr(addr)
+		}
+	}
+	if psk != "" {
+		client.SetPSK([]byte(psk))
+	}
+	if err := client.SetCompression(compress); err != nil {
+		return nil, err
+	}
+	client.SetDNSConfig(dnsConfig)
+	client.SetPacing(pace, paceJitter)
+	client.SetConnectTimeout(connTimeout)
+	client.SetStreamPool(poolSize, poolIdle)
+	if err := configureVerification(client); err != nil {
+		return nil, err
+	}
+
+	slog.Info("Connecting to server", "server", serverAddr)
+	if err := client.Connect(ctx); err != nil {
+		return nil, fmt.Errorf("failed to connect to server: %w", err)
+	}
+	return client, nil
+}
+
+// newDoHClient creates the DNS-over-HTTPS client for --doh-url. Sessions
+// can't carry the QUIC-only features, so their flags are refused.
+func newDoHClient(dnsConfig dnspkg.Config) (*transport.DoHClient, error) {
+	if dohURL == "" {
+		return nil, fmt.Errorf("--doh-url is required with --transport=doh")
+	}
+	if err := checkSessionFlags(); err != nil {
+		return nil, err
+	}
+
+	client := transport.NewDoHClient(dohURL, domain)
+	client.SetDNSConfig(dnsConfig)
+	if err := configureVerification(client); err != nil {
+		return nil, err
+	}
+	slog.Info("Tunneling through DNS-over-HTTPS", "url", dohURL)
+	return client, nil
+}
+
+// newDNSClient creates the plain DNS client for --resolver
+func newDNSClient(dnsConfig dnspkg.Config) (*transport.DNSClient, error) {
+	if resolverAddr == "" {
+		return nil, fmt.Errorf("--resolver is required with --transport=dns53")
+	}
+	if err := checkSessionFlags(); err != nil {
+		return nil, err
+	}
+	if pin != "" || caFile != "" || insecure {
+		return nil, fmt.Errorf("--pin, --ca and --insecure are not supported with --transport=dns53, which has no TLS")
+	}
+
+	client := transport.NewDNSClient(resolverAddr, domain)
+	client.SetDNSConfig(dnsConfig)
+	slog.Warn("Tunneling through plain DNS, which doesn't encrypt the tunneled data", "resolver", resolverAddr)
+	return client, nil
+}
+
+// checkSessionFlags refuses the flags of features sessions can't carry
+func checkSessionFlags() error {
+	if psk != "" || compress != 0 || len(localAddrs) > 0 || pace != 0 || paceJitter != 0 || healthEvery != 0 || poolSize != 0 {
+		return fmt.Errorf("--psk, --compression, --local-addr, --pace, --health-interval and --stream-pool are not supported with --transport=%s", transportFlag)
+	}
+	return nil
+}
+
+// verifier is implemented by clients that verify the server's certificate
+type verifier interface {
+	SetServerCertPin(pin string) error
+	SetRootCAs(pool *x509.CertPool)
+	SetInsecureSkipVerify(skip bool)
+}
+
+// configureVerification sets how the client verifies the server's
+// certificate from the --pin, --ca and --insecure flags
+func configureVerification(client verifier) error {
+	if pin != "" {
+		if err := client.SetServerCertPin(pin); err != nil {
+			return err
+		}
+	}
+
+	if caFile != "" {
+		caPEM, err := os.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return fmt.Errorf("no certificates found in %s", caFile)
+		}
+		client.SetRootCAs(pool)
+	}
+
+	if insecure {
+		slog.Warn("Server certificate verification is disabled")
+		client.SetInsecureSkipVerify(true)
+	}
+	return nil
+}
+
+// keepAlivePeriod returns the keep-alive period for --keepalive, on which
+// zero disables keep-alives
+func keepAlivePeriod() time.Duration {
+	if keepAlive == 0 {
+		return -1
+	}
+	return keepAlive
+}
+
+// checkHealth pings the server every --health-interval until ctx is done,
+// warning when the tunnel stops answering and when it recovers
+func checkHealth(ctx context.Context, client *transport.Client) {
+	ticker := time.NewTicker(healthEvery)
+	defer ticker.Stop()
+
+	healthy := true
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		latency, err := client.Ping(ctx)
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			if healthy {
+				slog.Warn("Tunnel is unhealthy", "error", err)
+			}
+			healthy = false
+		case !healthy:
+			slog.Info("Tunnel is healthy again", "latency", latency)
+			healthy = true
+		default:
+			slog.Debug("Tunnel ping", "latency", latency)
+		}
+	}
+}
+
+// logStats logs the traffic of the tunnel and the proxies every
+// --stats-interval until ctx is done
+func logStats(ctx context.Context, client tunnelClient, localProxy listenerProxy, udpProxy *proxy.UDPProxy) {
+	ticker := time.NewTicker(statsEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		slog.Info("Tunnel stats", "stats", client.Stats())
+		if socks {
+			slog.Info("SOCKS5 proxy stats", "stats", localProxy.Stats())
+		} else {
+			slog.Info("TCP proxy stats", "stats", localProxy.Stats())
+		}
+		if udpProxy != nil {
+			slog.Info("UDP proxy stats", "stats", udpProxy.Stats())
+		}
+	}
+}
+
+// newLogger returns a logger writing text records at or above level to
+// stderr
+func newLogger(level string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: l})), nil
+}
+
 func main() {
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -3,89 +3,340 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 
+	dnspkg "github.com/getlantern/lantern/slipstream/pkg/dns"
 	"github.com/getlantern/lantern/slipstream/pkg/proxy"
 	"github.com/getlantern/lantern/slipstream/pkg/transport"
 )
 
 var (
-	listenAddr string
-	targetAddr string
-	domain     string
-	certFile   string
-	keyFile    string
+	listenAddr    string
+	targetAddrs   []string
+	targetPolicy  string
+	domains       []string
+	certFile      string
+	keyFile       string
+	alpn          string
+	sni           string
+	keyType       string
+	dialTimeout   time.Duration
+	dialRetries   int
+	proxyProto    bool
+	encoding      string
+	psk           string
+	recordType    string
+	compress      int
+	statsEvery    time.Duration
+	idleTimeout   time.Duration
+	maxConns      int
+	maxStreams    int
+	logLevel      string
+	gracePeriod   time.Duration
+	padSize       int
+	padBuckets    []int
+	transportFlag string
+	streamRate    float64
+	streamBurst   int
+	bandwidth     int
+	ednsSize      int
+	ttl           uint32
+	maxTTL        uint32
+	keepAlive     time.Duration
+	allowRules    []string
+	denyRules     []string
+	allowLocal    bool
 )
 
 var rootCmd = &cobra.Command{
 	Use:   "slipstream-server",
 	Short: "Slipstream DNS tunnel server",
-	Long: `A high-performance covert channel over DNS, powered by QUIC multipath.
+	Long: `A high-performance covert channel over DNS, powered by QUIC and optionally
+spread over several network paths.
 The server receives DNS queries over QUIC and forwards connections to the target.`,
 	RunE: runServer,
 }
 
 func init() {
 	rootCmd.Flags().StringVarP(&listenAddr, "listen", "l", "0.0.0.0:4443", "Server address to listen on")
-	rootCmd.Flags().StringVarP(&targetAddr, "target", "t", "", "Target address to proxy connections to (host:port)")
-	rootCmd.Flags().StringVarP(&domain, "domain", "d", "tunnel.example.com", "Domain name for DNS tunneling")
+	rootCmd.Flags().StringVar(&transportFlag, "transport", "quic", "Transport to accept: quic over UDP, doh for DNS-over-HTTPS over TCP at "+transport.DoHPath+", or dns53 for plain DNS over UDP and TCP as an authoritative server")
+	rootCmd.Flags().StringSliceVarP(&targetAddrs, "target", "t", nil, "Default target for streams whose client names none (host:port, tcp://host:port, udp://host:port or unix:///path); repeat for fallbacks tried in turn")
+	rootCmd.Flags().StringVar(&targetPolicy, "target-policy", "failover", "Order several --target values are tried in: failover (first to last) or round-robin")
+	rootCmd.Flags().StringSliceVarP(&domains, "domain", "d", []string{"tunnel.example.com"}, "Domain names for DNS tunneling (repeatable, wildcards like *.example.com allowed)")
 	rootCmd.Flags().StringVarP(&certFile, "cert", "c", "", "TLS certificate file (optional, generates self-signed if not provided)")
 	rootCmd.Flags().StringVarP(&keyFile, "key", "k", "", "TLS key file (optional)")
+	rootCmd.Flags().StringVar(&alpn, "alpn", transport.ALPN, "ALPN protocol to negotiate (must match the client)")
+	rootCmd.Flags().StringVar(&sni, "sni", transport.SNI, "TLS server name clients must send")
+	rootCmd.Flags().StringVar(&keyType, "key-type", "rsa", "Key type for the self-signed certificate (rsa, ecdsa, ed25519)")
+
+	rootCmd.Flags().StringSliceVar(&allowRules, "allow", nil, "Only let clients reach targets matching these rules: host[:port] with hostname globs, IPs or CIDR ranges, and port globs (repeatable)")
+	rootCmd.Flags().StringSliceVar(&denyRules, "deny", nil, "Never connect to targets matching these rules, in the --allow format (repeatable; checked first)")
+	rootCmd.Flags().BoolVar(&allowLocal, "allow-local", false, "Let clients name loopback, link-local and unspecified addresses as targets")
+	rootCmd.Flags().DurationVar(&dialTimeout, "dial-timeout", proxy.DefaultDialTimeout, "Timeout for each connection attempt to the target")
+	rootCmd.Flags().IntVar(&dialRetries, "dial-retries", 0, "Number of times to retry a failed connection to the target")
+
+	rootCmd.Flags().StringVar(&encoding, "encoding", "base32", "Query name encoding: base32, base62 or hex (must match the client)")
+	rootCmd.Flags().StringVar(&recordType, "record-type", "TXT", "Record type for responses sent before a stream's first query: TXT, A, AAAA or NULL (later responses use the query's type)")
+	rootCmd.Flags().StringVar(&psk, "psk", "", "Pre-shared key clients must authenticate with (disabled if empty)")
+	rootCmd.Flags().IntVar(&compress, "compression", 0, "Compression level for stream data of clients that ask for it, 1 (fastest) to 9 (smallest) (0 refuses compression)")
+	rootCmd.Flags().DurationVar(&keepAlive, "keepalive", transport.DefaultKeepAlivePeriod, "Send a keep-alive on idle client connections at this interval (0 disables)")
+	rootCmd.Flags().DurationVar(&idleTimeout, "idle-timeout", proxy.DefaultIdleTimeout, "Close proxied streams after this long without traffic in either direction (0 disables)")
+	rootCmd.Flags().IntVar(&maxConns, "max-conns", 0, "Maximum number of client connections handled at once (0 means no limit)")
+	rootCmd.Flags().IntVar(&maxStreams, "max-streams", 0, "Maximum number of streams handled at once per connection (0 means no limit)")
+	rootCmd.Flags().Float64Var(&streamRate, "stream-rate", 0, "Maximum new streams per second per client IP; faster streams are delayed or rejected (0 means no limit)")
+	rootCmd.Flags().IntVar(&streamBurst, "stream-burst", 10, "Number of streams a client IP may open at once before --stream-rate applies")
+	rootCmd.Flags().IntVar(&bandwidth, "bandwidth", 0, "Maximum stream data per second per client IP in each direction, in bytes (0 means no limit)")
+	rootCmd.Flags().IntVar(&padSize, "pad-size", 0, "Pad query and response payloads to a multiple of this many bytes (must match the client; 0 disables)")
+	rootCmd.Flags().IntSliceVar(&padBuckets, "pad-buckets", nil, "Pad the data of query and response payloads up to the smallest of these sizes that fits, e.g. 32,64,96,128 (must match the client; overrides --pad-size)")
+	rootCmd.Flags().IntVar(&ednsSize, "edns-size", dnspkg.EDNSBufferSize, "Largest response to send in bytes, 512 to 65535; smaller sizes advertised by clients' queries apply first")
+	rootCmd.Flags().Uint32Var(&ttl, "ttl", dnspkg.DefaultTTL, "TTL of answer records in seconds (use 0 behind a recursive resolver)")
+	rootCmd.Flags().Uint32Var(&maxTTL, "max-ttl", 0, "If greater than --ttl, give each response a random TTL between --ttl and this")
+	rootCmd.Flags().DurationVar(&gracePeriod, "shutdown-timeout", 30*time.Second, "How long to let active streams finish on SIGINT or SIGTERM before closing them")
+	rootCmd.Flags().StringVar(&logLevel, "log-level", "info", "Minimum level of log messages: debug, info, warn or error")
+	rootCmd.Flags().DurationVar(&statsEvery, "stats-interval", 0, "Log traffic statistics at this interval (0 disables)")
+	rootCmd.Flags().BoolVar(&proxyProto, "proxy-protocol", false, "Send a PROXY protocol v2 header with the client's address to the target")
 
-	rootCmd.MarkFlagRequired("target")
 }
 
 func runServer(cmd *cobra.Command, args []string) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	logger, err := newLogger(logLevel)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+
 	// Setup signal handling
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
+	if len(domains) == 0 {
+		return fmt.Errorf("at least one domain is required")
+	}
+	if transportFlag != "quic" && transportFlag != "doh" && transportFlag != "dns53" {
+		return fmt.Errorf("unknown transport %q", transportFlag)
+	}
+	if transportFlag != "quic" && psk != "" {
+		return fmt.Errorf("--psk is not supported with --transport=%s", transportFlag)
+	}
+
+	if err := dnspkg.ValidateEDNSBufferSize(ednsSize); err != nil {
+		return fmt.Errorf("invalid --edns-size: %w", err)
+	}
+	if err := dnspkg.ValidatePadBuckets(padBuckets); err != nil {
+		return fmt.Errorf("invalid --pad-buckets: %w", err)
+	}
+	if ttl > math.MaxInt32 || maxTTL > math.MaxInt32 {
+		return fmt.Errorf("TTLs can't exceed %d seconds", math.MaxInt32)
+	}
+
+	for _, target := range targetAddrs {
+		if _, _, err := proxy.ParseTarget(target); err != nil {
+			return err
+		}
+	}
+	policy, err := proxy.ParseTargetPolicy(targetPolicy)
+	if err != nil {
+		return err
+	}
+
+	certKeyType, err := transport.ParseKeyType(keyType)
+	if err != nil {
+		return err
+	}
+
+	rrtype, err := dnspkg.ParseRecordType(recordType)
+	if err != nil {
+		return err
+	}
+
+	encoder, err := dnspkg.ParseEncoder(encoding)
+	if err != nil {
+		return err
+	}
+
 	// Create server proxy handler
-	handler := proxy.NewServerProxy(targetAddr)
+	handler := proxy.NewServerProxy(targetAddrs...)
+	handler.SetTargetPolicy(policy)
+	handler.SetDialTimeout(dialTimeout)
+	handler.SetDialRetries(dialRetries)
+	handler.SetProxyProtocol(proxyProto)
+	handler.SetIdleTimeout(idleTimeout)
+	acl, err := newTargetACL()
+	if err != nil {
+		return err
+	}
+	handler.SetACL(acl)
 
 	// Create QUIC server
-	server, err := transport.NewServer(listenAddr, domain, handler)
+	server, err := transport.NewServerWithConfig(listenAddr, domains[0], handler, transport.Config{
+		ALPN: alpn,
+		SNI:  sni,
+		Cert: transport.CertConfig{KeyType: certKeyType},
+
+		KeepAlivePeriod: keepAlivePeriod(),
+	})
 	if err != nil {
 		return fmt.Errorf("failed to create server: %w", err)
 	}
 
+	server.SetDomains(domains)
+	if psk != "" {
+		server.SetPSK([]byte(psk))
+	}
+	server.SetMaxConnections(maxConns)
+	server.SetMaxStreams(maxStreams)
+	if streamRate > 0 {
+		server.SetStreamRateLimit(streamRate, streamBurst)
+	}
+	if bandwidth > 0 {
+		server.SetBandwidthLimit(bandwidth)
+	}
+	if err := server.SetCompression(compress); err != nil {
+		return err
+	}
+
+	dnsConfig := dnspkg.DefaultConfig()
+	dnsConfig.Encoder = encoder
+	dnsConfig.RecordType = rrtype
+	dnsConfig.PadSize = padSize
+	dnsConfig.PadBuckets = padBuckets
+	dnsConfig.EDNSBufferSize = uint16(ednsSize)
+	dnsConfig.TTL = ttl
+	dnsConfig.MaxTTL = maxTTL
+	server.SetDNSConfig(dnsConfig)
+
 	// Load custom TLS certificates if provided
 	if certFile != "" && keyFile != "" {
-		log.Printf("Loading TLS certificates from %s and %s", certFile, keyFile)
+		slog.Info("Loading TLS certificates", "cert", certFile, "key", keyFile)
 		if err := server.SetTLSConfig(certFile, keyFile); err != nil {
 			return fmt.Errorf("failed to load TLS config: %w", err)
 		}
 	} else {
-		log.Printf("Using self-signed TLS certificate")
+		slog.Info("Using self-signed TLS certificate")
 	}
+	logCertificatePin(server)
 
 	// Start server in goroutine
 	errChan := make(chan error, 1)
 	go func() {
-		log.Printf("Starting server on %s, proxying to %s", listenAddr, targetAddr)
+		if len(targetAddrs) == 0 {
+			slog.Info("Starting server, proxying to client-requested targets", "listen", listenAddr)
+		} else {
+			slog.Info("Starting server", "listen", listenAddr, "targets", targetAddrs)
+		}
+		switch transportFlag {
+		case "doh":
+			errChan <- server.ListenDoH(ctx)
+			return
+		case "dns53":
+			errChan <- server.ListenDNS(ctx)
+			return
+		}
 		errChan <- server.Listen(ctx)
 	}()
 
+	if statsEvery > 0 {
+		go logStats(ctx, server, handler)
+	}
+
+	// Reload certificates on SIGHUP so renewed certificates are picked up
+	// without dropping existing tunnels
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+
 	// Wait for signal or error
-	select {
-	case sig := <-sigChan:
-		log.Printf("Received signal %v, shutting down...", sig)
-		cancel()
-		return nil
-	case err := <-errChan:
-		if err != nil && err != context.Canceled {
-			return fmt.Errorf("server error: %w", err)
+	for {
+		select {
+		case <-hupChan:
+			if certFile == "" || keyFile == "" {
+				slog.Warn("Received SIGHUP but no certificate files are configured")
+				continue
+			}
+			if err := server.ReloadCert(certFile, keyFile); err != nil {
+				slog.Error("Failed to reload TLS certificates", "error", err)
+				continue
+			}
+			slog.Info("Reloaded TLS certificates", "cert", certFile, "key", keyFile)
+			logCertificatePin(server)
+		case sig := <-sigChan:
+			slog.Info("Shutting down, waiting for active streams", "signal", sig, "timeout", gracePeriod)
+			shutdown(server, sigChan)
+			<-errChan
+			return nil
+		case err := <-errChan:
+			if err != nil && err != context.Canceled {
+				return fmt.Errorf("server error: %w", err)
+			}
+			return nil
+		}
+	}
+}
+
+// shutdown stops the server gracefully, giving active streams until
+// --shutdown-timeout, or until another signal arrives, to finish
+func shutdown(server *transport.Server, sigChan <-chan os.Signal) {
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-sigChan:
+			cancel()
+		case <-ctx.Done():
 		}
-		return nil
+	}()
+
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("Closed streams that did not finish in time", "error", err)
+	}
+}
+
+// logCertificatePin logs the pin clients pass to --pin to trust the server's
+// current certificate
+func logCertificatePin(server *transport.Server) {
+	pin, err := server.CertificatePin()
+	if err != nil {
+		slog.Error("Failed to compute certificate pin", "error", err)
+		return
 	}
+	slog.Info("Certificate pin", "pin", pin)
+}
+
+// logStats logs the traffic of the server and the streams it proxies every
+// --stats-interval until ctx is done
+func logStats(ctx context.Context, server *transport.Server, handler *proxy.ServerProxy) {
+	ticker := time.NewTicker(statsEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		slog.Info("Tunnel stats", "stats", server.Stats())
+		slog.Info("Proxy stats", "stats", handler.Stats())
+	}
+}
+
+// newLogger returns a logger writing text records at or above level to
+// stderr
+func newLogger(level string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: l})), nil
 }
 
 func main() {
@@ -94,3 +345,29 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// newTargetACL builds the target ACL from --allow, --deny and --allow-local
+func newTargetACL() (*proxy.TargetACL, error) {
+	acl := proxy.NewTargetACL()
+	for _, rule := range allowRules {
+		if err := acl.Allow(rule); err != nil {
+			return nil, err
+		}
+	}
+	for _, rule := range denyRules {
+		if err := acl.Deny(rule); err != nil {
+			return nil, err
+		}
+	}
+	acl.SetAllowLocal(allowLocal)
+	return acl, nil
+}
+
+// keepAlivePeriod returns the keep-alive period for --keepalive, on which
+// zero disables keep-alives
+func keepAlivePeriod() time.Duration {
+	if keepAlive == 0 {
+		return -1
+	}
+	return keepAlive
+}
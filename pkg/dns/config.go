@@ -0,0 +1,150 @@
+package dns
+
+import (
+	"math/rand"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Config controls how tunneled data is carried in DNS messages. Both ends of
+// a tunnel must use compatible configurations.
+type Config struct {
+	// RecordType is the query type the client sends, and therefore the type
+	// of the answer records carrying data back (dns.TypeTXT, dns.TypeA,
+	// dns.TypeAAAA or dns.TypeNULL). The server answers with whatever type
+	// each query asks for. A and AAAA records pack data into addresses, which
+	// draws less attention than large TXT answers but carries less per
+	// response. NULL records carry raw binary and suit links where the client
+	// talks to the authoritative server directly.
+	RecordType uint16
+	// EDNSBufferSize is the UDP payload size advertised in queries, which
+	// bounds the size of the responses the server sends back. The server
+	// also keeps its responses within its own EDNSBufferSize, whatever
+	// larger size a query advertises. Zero means EDNSBufferSize; values
+	// below MinEDNSBufferSize are raised to it.
+	EDNSBufferSize uint16
+	// TTL is the TTL of the answer records the server sends. Use 0 when a
+	// recursive resolver sits between client and server, so responses are
+	// never cached and replayed to later queries.
+	TTL uint32
+	// MaxTTL, if greater than TTL, makes each response use a random TTL
+	// between TTL and MaxTTL, so a constant TTL doesn't mark tunnel traffic
+	MaxTTL uint32
+	// NonceLength is the number of random characters in the nonce label
+	// prefixed to every query name, which makes each query unique so
+	// resolver caches never answer it. Zero disables the nonce. The server
+	// strips nonces whatever its own setting when the base32 encoder is
+	// used. With other encoders a nonce label can't be told apart from data,
+	// so client and server must agree on whether nonces are sent.
+	NonceLength int
+	// Encoder encodes data in query names. Client and server must use the
+	// same encoder. Nil means Base32Encoder.
+	Encoder Encoder
+	// RandomizeCase randomizes the case of every letter in each query name,
+	// like resolvers using 0x20 encoding do, so names aren't conspicuously
+	// lowercase. The decoded data is unchanged. It requires a
+	// case-insensitive encoder, so it can't be used with Base62Encoder.
+	RandomizeCase bool
+	// PadSize, if positive, pads every query and response payload with
+	// random bytes up to the next multiple of PadSize bytes, within the
+	// message's limits, so message sizes don't reveal exactly how much data
+	// each one carries. The true length travels in a 2-byte prefix. Client
+	// and server must use the same PadSize.
+	PadSize int
+	// PadBuckets, if set, pads every payload's data up to the smallest of
+	// these sizes that holds it, or to a multiple of the largest, within
+	// the message's limits, so message sizes collapse onto a few values. It
+	// takes precedence over PadSize, and client and server must use the
+	// same buckets.
+	PadBuckets []int
+}
+
+// DefaultConfig returns the default DNS layer configuration
+func DefaultConfig() Config {
+	return Config{
+		RecordType:     dns.TypeTXT,
+		EDNSBufferSize: EDNSBufferSize,
+		TTL:            DefaultTTL,
+		NonceLength:    DefaultNonceLength,
+	}
+}
+
+func (c Config) encoder() Encoder {
+	if c.Encoder == nil {
+		return Base32Encoder
+	}
+	return c.Encoder
+}
+
+// MaxPayloadSize returns the largest payload a query under a domain of
+// domainLen bytes can carry with this configuration's encoder, leaving room
+// for the nonce label and the padding length prefix
+func (c Config) MaxPayloadSize(domainLen int) int {
+	if c.padding() {
+		return c.maxEncodedSize(domainLen) - padLengthSize
+	}
+	return c.maxEncodedSize(domainLen)
+}
+
+// maxEncodedSize returns the largest number of bytes a query name under a
+// domain of domainLen bytes can encode
+func (c Config) maxEncodedSize(domainLen int) int {
+	if c.NonceLength > 0 {
+		// The marker, the random characters and the dot after them
+		domainLen += min(1+c.NonceLength, MaxLabelLength) + 1
+	}
+	return CalculateMaxPayloadSizeWith(c.encoder(), domainLen)
+}
+
+// stripNonce removes the nonce label from the front of subdomain. Base32
+// data never contains the nonce marker, so nonces are recognized by it;
+// with other encoders the first label is the nonce if nonces are enabled.
+func (c Config) stripNonce(subdomain string) string {
+	if c.encoder() == Base32Encoder {
+		return StripNonce(subdomain)
+	}
+	if c.NonceLength <= 0 {
+		return subdomain
+	}
+	if i := strings.IndexByte(subdomain, '.'); i >= 0 {
+		return subdomain[i+1:]
+	}
+	return ""
+}
+
+func (c Config) recordType() uint16 {
+	if c.RecordType == 0 {
+		return dns.TypeTXT
+	}
+	return c.RecordType
+}
+
+// MaxResponseSize returns the largest response the server may send to a
+// client using this configuration: the effective EDNS buffer size
+func (c Config) MaxResponseSize() int {
+	return int(c.ednsBufferSize())
+}
+
+// ResponseSizeLimit returns the largest response the server may send to
+// query: the size the query advertises, within MaxResponseSize
+func (c Config) ResponseSizeLimit(query *dns.Msg) int {
+	return min(ResponseSizeLimit(query), c.MaxResponseSize())
+}
+
+func (c Config) ednsBufferSize() uint16 {
+	switch {
+	case c.EDNSBufferSize == 0:
+		return EDNSBufferSize
+	case c.EDNSBufferSize < MinEDNSBufferSize:
+		return MinEDNSBufferSize
+	}
+	return c.EDNSBufferSize
+}
+
+func (c Config) ttl() uint32 {
+	if c.MaxTTL <= c.TTL {
+		return c.TTL
+	}
+	return c.TTL + uint32(rand.Int63n(int64(c.MaxTTL-c.TTL)+1))
+}
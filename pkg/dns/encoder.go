@@ -0,0 +1,215 @@
+package dns
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// Encoder converts payload bytes into the characters carried in query names
+// and back. Client and server must use the same encoder.
+type Encoder interface {
+	// Encode returns the encoding of data, before it is split into labels
+	Encode(data []byte) string
+	// Decode returns the data encoded in s, with the label separators
+	// already removed
+	Decode(s string) ([]byte, error)
+	// EncodedLen returns the length of the encoding of n bytes
+	EncodedLen(n int) int
+}
+
+// alphabetEncoder is implemented by encoders that can tell whether a
+// character belongs to their alphabet. The standard library decoders skip
+// some characters, such as newlines, that must not appear in query names.
+type alphabetEncoder interface {
+	inAlphabet(c byte) bool
+}
+
+// caseSensitiveEncoder is implemented by encoders whose output changes
+// meaning if the case of its letters changes
+type caseSensitiveEncoder interface {
+	caseSensitive()
+}
+
+var (
+	// Base32Encoder is the default encoder. It carries 5 bits per character,
+	// is case-insensitive and only produces letters and digits.
+	Base32Encoder Encoder = base32Encoder{}
+	// Base62Encoder carries 8 bytes in every 11 characters, almost as
+	// dense as base64, using only letters and digits so every label is a
+	// valid hostname label. It is case-sensitive, so it only works through
+	// resolvers that preserve the case of query names.
+	Base62Encoder Encoder = base62Encoder{}
+	// HexEncoder carries 4 bits per character. It is the least dense but
+	// looks like the hashes many legitimate services put in names.
+	HexEncoder Encoder = hexEncoder{}
+)
+
+// ParseEncoder returns the encoder with the given name: base32, base62 or hex
+func ParseEncoder(name string) (Encoder, error) {
+	switch strings.ToLower(name) {
+	case "", "base32":
+		return Base32Encoder, nil
+	case "base62":
+		return Base62Encoder, nil
+	case "hex":
+		return HexEncoder, nil
+	default:
+		return nil, fmt.Errorf("unknown encoding %q", name)
+	}
+}
+
+type base32Encoder struct{}
+
+func (base32Encoder) Encode(data []byte) string {
+	// Lowercase for DNS compatibility
+	return strings.ToLower(Base32Encoding.EncodeToString(data))
+}
+
+func (base32Encoder) Decode(s string) ([]byte, error) {
+	// Unpadded base32 never ends with 1, 3 or 6 characters of a block,
+	// which the standard library would accept as a partial byte
+	switch len(s) % 8 {
+	case 1, 3, 6:
+		return nil, fmt.Errorf("invalid base32 length %d", len(s))
+	}
+
+	decoded, err := Base32Encoding.DecodeString(strings.ToUpper(s))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode base32: %w", err)
+	}
+	return decoded, nil
+}
+
+func (base32Encoder) EncodedLen(n int) int {
+	return Base32Encoding.EncodedLen(n)
+}
+
+// inAlphabet accepts both cases, since resolvers may change the case of
+// query names
+func (base32Encoder) inAlphabet(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '2' && c <= '7'
+}
+
+const base62Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// base62Block is the number of bytes encoded together as one big-endian
+// number
+const base62Block = 8
+
+// base62Chars is the number of characters encoding n bytes, for n up to
+// base62Block: the fewest whose 62^chars values cover 256^n
+var base62Chars = [base62Block + 1]int{0, 2, 3, 5, 6, 7, 9, 10, 11}
+
+type base62Encoder struct{}
+
+func (base62Encoder) Encode(data []byte) string {
+	out := make([]byte, 0, base62Encoder{}.EncodedLen(len(data)))
+	for len(data) > 0 {
+		n := min(len(data), base62Block)
+		var block [base62Block]byte
+		copy(block[base62Block-n:], data[:n])
+		v := binary.BigEndian.Uint64(block[:])
+
+		chars := make([]byte, base62Chars[n])
+		for i := len(chars) - 1; i >= 0; i-- {
+			chars[i] = base62Alphabet[v%62]
+			v /= 62
+		}
+		out = append(out, chars...)
+		data = data[n:]
+	}
+	return string(out)
+}
+
+func (base62Encoder) Decode(s string) ([]byte, error) {
+	out := make([]byte, 0, len(s)/base62Chars[base62Block]*base62Block+base62Block)
+	for len(s) > 0 {
+		chars := min(len(s), base62Chars[base62Block])
+		n := 0
+		for n <= base62Block && base62Chars[n] != chars {
+			n++
+		}
+		if n > base62Block {
+			return nil, fmt.Errorf("invalid base62 length %d", len(s))
+		}
+
+		// Reject values that overflow the block's n bytes, so every
+		// value has a single encoding
+		var v uint64
+		for i := 0; i < chars; i++ {
+			d := strings.IndexByte(base62Alphabet, s[i])
+			if d < 0 {
+				return nil, fmt.Errorf("invalid base62 character %q", s[i])
+			}
+			hi, lo := bits.Mul64(v, 62)
+			lo, carry := bits.Add64(lo, uint64(d), 0)
+			if hi != 0 || carry != 0 || n < base62Block && lo>>(8*n) != 0 {
+				return nil, fmt.Errorf("base62 block %q overflows %d bytes", s[:chars], n)
+			}
+			v = lo
+		}
+
+		var block [base62Block]byte
+		binary.BigEndian.PutUint64(block[:], v)
+		out = append(out, block[base62Block-n:]...)
+		s = s[chars:]
+	}
+	return out, nil
+}
+
+func (base62Encoder) EncodedLen(n int) int {
+	return n/base62Block*base62Chars[base62Block] + base62Chars[n%base62Block]
+}
+
+func (base62Encoder) caseSensitive() {}
+
+func (base62Encoder) inAlphabet(c byte) bool {
+	return strings.IndexByte(base62Alphabet, c) >= 0
+}
+
+type hexEncoder struct{}
+
+func (hexEncoder) Encode(data []byte) string {
+	return hex.EncodeToString(data)
+}
+
+func (hexEncoder) Decode(s string) ([]byte, error) {
+	decoded, err := hex.DecodeString(strings.ToLower(s))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode hex: %w", err)
+	}
+	return decoded, nil
+}
+
+func (hexEncoder) EncodedLen(n int) int {
+	return hex.EncodedLen(n)
+}
+
+func (hexEncoder) inAlphabet(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// checkAlphabet returns an error naming the first character of s outside
+// enc's alphabet, if enc knows its alphabet
+func checkAlphabet(enc Encoder, s string) error {
+	ae, ok := enc.(alphabetEncoder)
+	if !ok {
+		return nil
+	}
+	for i := 0; i < len(s); i++ {
+		if !ae.inAlphabet(s[i]) {
+			return fmt.Errorf("invalid character %q at offset %d", s[i], i)
+		}
+	}
+	return nil
+}
+
+// isCaseSensitive reports whether changing the case of enc's output would
+// corrupt it
+func isCaseSensitive(enc Encoder) bool {
+	_, ok := enc.(caseSensitiveEncoder)
+	return ok
+}
@@ -2,7 +2,10 @@ package dns
 
 import (
 	"encoding/base32"
+	"errors"
 	"fmt"
+	"math/rand"
+	"sort"
 	"strings"
 )
 
@@ -11,20 +14,40 @@ const (
 	MaxLabelLength = 63
 	// MaxDomainLength is the maximum length of a full DNS domain name (253 bytes)
 	MaxDomainLength = 253
+
+	// DefaultNonceLength is the default number of random characters in a
+	// query's nonce label
+	DefaultNonceLength = 6
+
+	// nonceMarker starts every nonce label. It is outside the base32
+	// alphabet, so a nonce is never mistaken for data.
+	nonceMarker = '0'
+	// nonceAlphabet is the set of characters a nonce is drawn from
+	nonceAlphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
 )
 
+// ErrInvalidSubdomain is returned for query names whose data labels can't be
+// decoded, such as those of corrupted or hostile queries. Servers answer
+// such queries with FORMERR.
+var ErrInvalidSubdomain = errors.New("invalid subdomain")
+
 // Base32Encoding is the base32 encoding scheme used for DNS subdomain encoding
 var Base32Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
 
 // EncodeSubdomain encodes binary data into a DNS-safe subdomain using base32 encoding
 // and splits it into DNS labels of appropriate length.
 func EncodeSubdomain(data []byte) string {
+	return EncodeSubdomainWith(Base32Encoder, data)
+}
+
+// EncodeSubdomainWith encodes binary data with enc and splits the result into
+// DNS labels of appropriate length
+func EncodeSubdomainWith(enc Encoder, data []byte) string {
 	if len(data) == 0 {
 		return ""
 	}
 
-	// Encode data as base32 (lowercase for DNS compatibility)
-	encoded := strings.ToLower(Base32Encoding.EncodeToString(data))
+	encoded := enc.Encode(data)
 
 	// Split into DNS labels (max 63 characters each)
 	var labels []string
@@ -42,16 +65,38 @@ func EncodeSubdomain(data []byte) string {
 
 // DecodeSubdomain decodes a DNS subdomain back to binary data
 func DecodeSubdomain(subdomain string) ([]byte, error) {
-	// Remove dots to get the full base32 string
-	encoded := strings.ReplaceAll(subdomain, ".", "")
+	return DecodeSubdomainWith(Base32Encoder, subdomain)
+}
 
-	// Decode from base32
-	decoded, err := Base32Encoding.DecodeString(strings.ToUpper(encoded))
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode base32: %w", err)
+// DecodeSubdomainWith decodes a DNS subdomain encoded with enc back to binary
+// data
+//
+// Query names come from the network, so every label is checked before
+// decoding: empty or overlong labels and characters outside the encoder's
+// alphabet, including the escapes of non-printable bytes, are rejected
+// rather than skipped. Every error wraps ErrInvalidSubdomain.
+func DecodeSubdomainWith(enc Encoder, subdomain string) ([]byte, error) {
+	if subdomain == "" {
+		return []byte{}, nil
 	}
 
-	return decoded, nil
+	labels := strings.Split(subdomain, ".")
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > MaxLabelLength {
+			return nil, fmt.Errorf("%w: label %q is not 1 to %d characters", ErrInvalidSubdomain, label, MaxLabelLength)
+		}
+	}
+
+	// Join the labels to get the full encoded string
+	encoded := strings.Join(labels, "")
+	if err := checkAlphabet(enc, encoded); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSubdomain, err)
+	}
+	data, err := enc.Decode(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSubdomain, err)
+	}
+	return data, nil
 }
 
 // CreateFQDN creates a fully qualified domain name from a subdomain and domain
@@ -62,37 +107,239 @@ func CreateFQDN(subdomain, domain string) string {
 	return subdomain + "." + domain + "."
 }
 
-// ExtractSubdomain extracts the subdomain portion from a FQDN
+// ExtractSubdomain extracts the subdomain portion from a FQDN. The domain may
+// be a wildcard such as "*.example.com"; see MatchDomain.
 func ExtractSubdomain(fqdn, domain string) (string, error) {
+	subdomain, _, err := MatchDomain(fqdn, domain)
+	return subdomain, err
+}
+
+// MatchDomain finds the base domain that fqdn belongs to and returns the
+// subdomain in front of it together with the matched base. A domain of the
+// form "*.example.com" matches any single label in place of the "*", so the
+// returned base is, e.g., "a.example.com". When several domains match, the
+// longest base wins. Names are compared case-insensitively, since resolvers
+// may randomize their case; the subdomain keeps the case it had in fqdn and
+// the base is lowercase.
+func MatchDomain(fqdn string, domains ...string) (subdomain, base string, err error) {
 	// Remove trailing dot if present
-	fqdn = strings.TrimSuffix(fqdn, ".")
-	domain = strings.TrimSuffix(domain, ".")
+	original := strings.TrimSuffix(fqdn, ".")
+	fqdn = strings.ToLower(original)
+
+	matched := false
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+		candidate := domain
+		if strings.HasPrefix(domain, "*.") {
+			// Replace the wildcard with the label preceding the parent domain
+			parent := domain[1:]
+			if !strings.HasSuffix(fqdn, parent) {
+				continue
+			}
+			rest := strings.TrimSuffix(fqdn, parent)
+			label := rest[strings.LastIndex(rest, ".")+1:]
+			if label == "" {
+				continue
+			}
+			candidate = label + parent
+		}
 
-	// Check if the FQDN ends with the domain
-	if !strings.HasSuffix(fqdn, "."+domain) && fqdn != domain {
-		return "", fmt.Errorf("FQDN %s does not match domain %s", fqdn, domain)
+		// Check if the FQDN ends with the domain
+		if !strings.HasSuffix(fqdn, "."+candidate) && fqdn != candidate {
+			continue
+		}
+		if matched && len(candidate) <= len(base) {
+			continue
+		}
+
+		matched, base = true, candidate
+		// Extract subdomain
+		subdomain = strings.TrimSuffix(original[:len(fqdn)-len(candidate)], ".")
+	}
+
+	if !matched {
+		return "", "", fmt.Errorf("FQDN %s does not match domain %s", fqdn, strings.Join(domains, ", "))
+	}
+	return subdomain, base, nil
+}
+
+// NonceLabel returns a random nonce label with n random characters after
+// the nonce marker
+func NonceLabel(n int) string {
+	if n > MaxLabelLength-1 {
+		n = MaxLabelLength - 1
+	}
+
+	label := make([]byte, 1+n)
+	label[0] = nonceMarker
+	for i := 1; i < len(label); i++ {
+		label[i] = nonceAlphabet[rand.Intn(len(nonceAlphabet))]
 	}
+	return string(label)
+}
 
-	// Extract subdomain
-	if fqdn == domain {
-		return "", nil
+// RandomizeCase returns name with the case of each letter chosen at random,
+// as in 0x20 encoding
+func RandomizeCase(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+			if rand.Intn(2) == 0 {
+				b[i] = c | 0x20
+			} else {
+				b[i] = c &^ 0x20
+			}
+		}
 	}
+	return string(b)
+}
 
-	subdomain := strings.TrimSuffix(fqdn, "."+domain)
-	return subdomain, nil
+// StripNonce removes any nonce labels from the front of subdomain
+func StripNonce(subdomain string) string {
+	for subdomain != "" && subdomain[0] == nonceMarker {
+		i := strings.IndexByte(subdomain, '.')
+		if i < 0 {
+			return ""
+		}
+		subdomain = subdomain[i+1:]
+	}
+	return subdomain
+}
+
+// ValidateLabel checks that label is a valid DNS label: 1 to 63 letters,
+// digits and hyphens, neither starting nor ending with a hyphen
+func ValidateLabel(label string) error {
+	if len(label) == 0 {
+		return fmt.Errorf("empty label")
+	}
+	if len(label) > MaxLabelLength {
+		return fmt.Errorf("label %q exceeds %d characters", label, MaxLabelLength)
+	}
+	if label[0] == '-' || label[len(label)-1] == '-' {
+		return fmt.Errorf("label %q starts or ends with a hyphen", label)
+	}
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return fmt.Errorf("label %q contains invalid character %q", label, c)
+		}
+	}
+	return nil
+}
+
+// ValidateFQDN checks that name, with or without its trailing dot, fits in
+// MaxDomainLength and consists of valid labels
+func ValidateFQDN(name string) error {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > MaxDomainLength {
+		return fmt.Errorf("name exceeds %d bytes", MaxDomainLength)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if err := ValidateLabel(label); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // CalculateMaxPayloadSize calculates the maximum payload size that can be encoded
 // in a DNS query given the domain name length
 func CalculateMaxPayloadSize(domainLen int) int {
-	// Reserve space for: subdomain + "." + domain + "."
-	// DNS name max length is 253, need at least 1 char for subdomain
-	availableLen := MaxDomainLength - domainLen - 2 // -2 for dots
+	return CalculateMaxPayloadSizeWith(Base32Encoder, domainLen)
+}
+
+// CalculateMaxPayloadSizeWith calculates the maximum payload size that can
+// be encoded with enc in a DNS query given the domain name length
+func CalculateMaxPayloadSizeWith(enc Encoder, domainLen int) int {
+	// The name, without its trailing dot, must fit in MaxDomainLength
+	availableLen := MaxDomainLength - domainLen
+	if availableLen <= 0 {
+		return 0
+	}
+
+	// Find the largest payload whose encoding fits; no encoder produces
+	// fewer characters than bytes
+	return sort.Search(availableLen+1, func(n int) bool {
+		return subdomainLen(enc.EncodedLen(n)) > availableLen
+	}) - 1
+}
+
+// subdomainLen returns the length of a subdomain holding chars encoded
+// characters, including the dots EncodeSubdomain puts between its labels and
+// the dot separating it from the domain
+func subdomainLen(chars int) int {
+	labels := (chars + MaxLabelLength - 1) / MaxLabelLength
+	return chars + labels
+}
+
+// SubdomainEncoder turns a byte stream into a sequence of query names under a
+// domain without buffering the whole stream. Each name carries up to
+// CalculateMaxPayloadSize bytes; a trailing partial chunk is emitted on Close.
+type SubdomainEncoder struct {
+	domain    string
+	chunkSize int
+	pending   []byte
+	ready     []string
+	closed    bool
+}
 
-	// Account for base32 encoding overhead (5 bytes -> 8 characters)
-	// Each base32 character represents 5 bits
-	maxBase32Chars := availableLen
-	maxPayloadBytes := (maxBase32Chars * 5) / 8
+// NewSubdomainEncoder creates an encoder producing names under domain
+func NewSubdomainEncoder(domain string) (*SubdomainEncoder, error) {
+	chunkSize := CalculateMaxPayloadSize(len(domain))
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("domain %q leaves no room for payload", domain)
+	}
+
+	return &SubdomainEncoder{
+		domain:    domain,
+		chunkSize: chunkSize,
+	}, nil
+}
+
+// Write adds p to the stream, making a name ready for every full chunk
+func (e *SubdomainEncoder) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, fmt.Errorf("write to closed subdomain encoder")
+	}
+
+	e.pending = append(e.pending, p...)
+	for len(e.pending) >= e.chunkSize {
+		e.emit(e.pending[:e.chunkSize])
+		e.pending = e.pending[e.chunkSize:]
+	}
+
+	// Drop the consumed prefix so the buffer doesn't grow without bound
+	e.pending = append([]byte(nil), e.pending...)
+	return len(p), nil
+}
+
+// Next returns the next ready name, or false if none is ready
+func (e *SubdomainEncoder) Next() (string, bool) {
+	if len(e.ready) == 0 {
+		return "", false
+	}
+
+	name := e.ready[0]
+	e.ready = e.ready[1:]
+	return name, true
+}
+
+// Close flushes any partial chunk as a final name. Names already made ready
+// can still be read with Next.
+func (e *SubdomainEncoder) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+
+	if len(e.pending) > 0 {
+		e.emit(e.pending)
+		e.pending = nil
+	}
+	return nil
+}
 
-	return maxPayloadBytes
+func (e *SubdomainEncoder) emit(chunk []byte) {
+	e.ready = append(e.ready, CreateFQDN(EncodeSubdomain(chunk), e.domain))
 }
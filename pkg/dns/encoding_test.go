@@ -0,0 +1,222 @@
+package dns
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// domainOfLength returns a valid domain name of exactly n bytes
+func domainOfLength(n int) string {
+	var labels []string
+	for n > 0 {
+		l := min(n, MaxLabelLength)
+		if n-l == 1 {
+			// Leave room for a label after the next dot
+			l--
+		}
+		labels = append(labels, strings.Repeat("d", l))
+		n -= l + 1
+	}
+	return strings.Join(labels, ".")
+}
+
+func TestEncodersRoundTrip(t *testing.T) {
+	for _, enc := range []Encoder{Base32Encoder, Base62Encoder, HexEncoder} {
+		for _, tc := range []struct {
+			name string
+			data []byte
+		}{
+			{"empty", []byte{}},
+			{"one byte", []byte{0}},
+			{"all ones", bytes.Repeat([]byte{0xff}, 17)},
+			{"one label", randomBytes(20)},
+			{"several labels", randomBytes(200)},
+		} {
+			subdomain := EncodeSubdomainWith(enc, tc.data)
+			if n := len(strings.ReplaceAll(subdomain, ".", "")); n != enc.EncodedLen(len(tc.data)) {
+				t.Fatalf("%T, %s: encoded to %d characters, EncodedLen says %d", enc, tc.name, n, enc.EncodedLen(len(tc.data)))
+			}
+			if subdomain != "" {
+				for _, label := range strings.Split(subdomain, ".") {
+					if err := ValidateLabel(label); err != nil {
+						t.Fatalf("%T, %s: %v", enc, tc.name, err)
+					}
+				}
+			}
+
+			got, err := DecodeSubdomainWith(enc, subdomain)
+			if err != nil {
+				t.Fatalf("%T, %s: %v", enc, tc.name, err)
+			}
+			if !bytes.Equal(got, tc.data) {
+				t.Fatalf("%T, %s: decoded %x, want %x", enc, tc.name, got, tc.data)
+			}
+		}
+	}
+}
+
+func TestBase62RejectsNonCanonical(t *testing.T) {
+	// "zz" is 3843, more than a byte, and no data encodes to 1, 4 or 8
+	// characters after the last full block
+	for _, s := range []string{"zz", "zzzzzzzzzzz", "0", "0000", "0000000000000000000"} {
+		if data, err := Base62Encoder.Decode(s); err == nil {
+			t.Errorf("Decode(%q) = %x, want an error", s, data)
+		}
+	}
+}
+
+func TestMaxPayloadSizeFitsName(t *testing.T) {
+	for _, domainLen := range []int{1, 10, len(testDomain), 50, 63, 64, 100, 127, 150, 200, 240, 250} {
+		domain := domainOfLength(domainLen)
+		if len(domain) != domainLen {
+			t.Fatalf("domainOfLength(%d) returned %d bytes", domainLen, len(domain))
+		}
+
+		for _, enc := range []Encoder{Base32Encoder, Base62Encoder, HexEncoder} {
+			max := CalculateMaxPayloadSizeWith(enc, domainLen)
+			if max <= 0 {
+				t.Fatalf("%d-byte domain, %T: no room for payload", domainLen, enc)
+			}
+
+			fqdn := CreateFQDN(EncodeSubdomainWith(enc, make([]byte, max)), domain)
+			if n := len(strings.TrimSuffix(fqdn, ".")); n > MaxDomainLength {
+				t.Fatalf("%d-byte domain, %T: %d-byte payload makes a %d-byte name", domainLen, enc, max, n)
+			}
+			if err := ValidateFQDN(fqdn); err != nil {
+				t.Fatalf("%d-byte domain, %T: %d-byte payload makes an invalid name: %v", domainLen, enc, max, err)
+			}
+
+			// The reported size is the largest that fits
+			fqdn = CreateFQDN(EncodeSubdomainWith(enc, make([]byte, max+1)), domain)
+			if n := len(strings.TrimSuffix(fqdn, ".")); n <= MaxDomainLength {
+				t.Fatalf("%d-byte domain, %T: %d-byte payload also fits, in %d bytes", domainLen, enc, max+1, n)
+			}
+		}
+
+		// Queries also carry a nonce label
+		c := DefaultConfig()
+		max := c.MaxPayloadSize(domainLen)
+		if max <= 0 {
+			continue
+		}
+		query, err := c.CreateQuery(make([]byte, max), domain)
+		if err != nil {
+			t.Fatalf("%d-byte domain: %v", domainLen, err)
+		}
+		if err := ValidateFQDN(query.Question[0].Name); err != nil {
+			t.Fatalf("%d-byte domain: %d-byte payload makes an invalid query name: %v", domainLen, max, err)
+		}
+	}
+}
+
+func TestRandomizeCaseVariesNamesNotData(t *testing.T) {
+	c := DefaultConfig()
+	c.NonceLength = 0
+	c.RandomizeCase = true
+	data := randomBytes(c.MaxPayloadSize(len(testDomain)))
+
+	names := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		query, err := c.CreateQuery(data, testDomain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := query.Question[0].Name
+		if name == strings.ToLower(name) || name == strings.ToUpper(name) {
+			t.Fatalf("query name %q has uniform case", name)
+		}
+		names[name] = true
+
+		query, err = repack(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.ParseQueryData(query, testDomain)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", name, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%q decoded to different data", name)
+		}
+	}
+
+	// Without a nonce, only the case tells the names apart
+	if len(names) < 90 {
+		t.Fatalf("100 queries had only %d distinct names", len(names))
+	}
+}
+
+// adversarialSubdomains are query name prefixes a hostile or corrupted
+// query might carry
+var adversarialSubdomains = []string{
+	".",
+	"..",
+	"mzxw6.",
+	".mzxw6",
+	"mzxw6..mzxw6",
+	strings.Repeat("a", MaxLabelLength+1),
+	"mzxw6!",
+	"mz xw6",
+	"mzxw6\n",
+	"mzxw6\x00",
+	"mz\\046xw6",
+	"mzxw6===",
+	"mzxw6-",
+	"_mzxw6",
+	"mzxw6ñ",
+	"18mzxw6",
+	"a",
+	"abc",
+	"abcdef",
+}
+
+func TestDecodeSubdomainRejectsAdversarial(t *testing.T) {
+	for _, subdomain := range adversarialSubdomains {
+		data, err := DecodeSubdomain(subdomain)
+		if !errors.Is(err, ErrInvalidSubdomain) {
+			t.Errorf("DecodeSubdomain(%q) = %x, %v; want ErrInvalidSubdomain", subdomain, data, err)
+		}
+	}
+}
+
+func TestDecodeSubdomainIgnoresCase(t *testing.T) {
+	for _, subdomain := range []string{"mzxw6", "MZXW6", "MzXw6", "mZxW6"} {
+		data, err := DecodeSubdomain(subdomain)
+		if err != nil || string(data) != "foo" {
+			t.Errorf("DecodeSubdomain(%q) = %q, %v; want \"foo\"", subdomain, data, err)
+		}
+	}
+}
+
+func FuzzDecodeSubdomain(f *testing.F) {
+	for _, subdomain := range adversarialSubdomains {
+		f.Add(subdomain)
+	}
+	f.Add(EncodeSubdomain(randomBytes(100)))
+	f.Fuzz(func(t *testing.T, subdomain string) {
+		for _, enc := range []Encoder{Base32Encoder, Base62Encoder, HexEncoder} {
+			data, err := DecodeSubdomainWith(enc, subdomain)
+			if err != nil {
+				if !errors.Is(err, ErrInvalidSubdomain) {
+					t.Fatalf("%T: decoding %q failed with %v, not ErrInvalidSubdomain", enc, subdomain, err)
+				}
+				continue
+			}
+
+			// Whatever decodes is made of valid labels of the alphabet
+			for _, label := range strings.Split(subdomain, ".") {
+				if subdomain == "" {
+					break
+				}
+				if len(label) == 0 || len(label) > MaxLabelLength {
+					t.Fatalf("%T: %q with label %q decoded to %x", enc, subdomain, label, data)
+				}
+				if err := checkAlphabet(enc, label); err != nil {
+					t.Fatalf("%T: %q decoded to %x: %v", enc, subdomain, data, err)
+				}
+			}
+		}
+	})
+}
@@ -1,7 +1,9 @@
 package dns
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/miekg/dns"
 )
@@ -9,14 +11,69 @@ import (
 const (
 	// DefaultTTL is the default TTL for DNS responses (60 seconds)
 	DefaultTTL = 60
-	// EDNSBufferSize is the EDNS UDP buffer size (1232 bytes)
+	// EDNSBufferSize is the default EDNS UDP buffer size (1232 bytes)
 	EDNSBufferSize = 1232
+	// MinEDNSBufferSize is the smallest UDP payload every DNS client accepts
+	MinEDNSBufferSize = 512
+	// MaxMessageSize is the largest DNS message that can be sent on the wire
+	MaxMessageSize = 65535
 )
 
+// ValidateEDNSBufferSize checks that size is a usable EDNS UDP payload size,
+// between MinEDNSBufferSize and MaxMessageSize
+func ValidateEDNSBufferSize(size int) error {
+	if size < MinEDNSBufferSize || size > MaxMessageSize {
+		return fmt.Errorf("EDNS buffer size %d is outside %d-%d", size, MinEDNSBufferSize, MaxMessageSize)
+	}
+	return nil
+}
+
+// ErrTruncated is returned for responses with the TC bit set. Their data is
+// incomplete, so the query should be retried with a smaller payload or over
+// a transport without the size limit.
+var ErrTruncated = errors.New("DNS response truncated")
+
+// ErrNXDomain is returned for NXDOMAIN responses. The tunnel server never
+// sends them, so one means the query reached a server that doesn't serve the
+// tunnel domain, typically through a misconfigured resolver or delegation.
+var ErrNXDomain = errors.New("DNS name does not exist")
+
+// ErrRcode is wrapped by the errors returned for error responses that
+// sending the query again won't fix, such as FORMERR or NOTIMP
+var ErrRcode = errors.New("DNS response error")
+
+// RetryableDNSError is returned for SERVFAIL and REFUSED responses, which
+// recursive resolvers send transiently when they are overloaded or can't
+// reach the server. The query may succeed if sent again.
+type RetryableDNSError struct {
+	Rcode int
+}
+
+func (e *RetryableDNSError) Error() string {
+	return fmt.Sprintf("DNS response error: %s (retryable)", dns.RcodeToString[e.Rcode])
+}
+
+// IsRetryable reports whether err is, or wraps, a RetryableDNSError
+func IsRetryable(err error) bool {
+	var retryable *RetryableDNSError
+	return errors.As(err, &retryable)
+}
+
 // CreateQuery creates a DNS TXT query for the given data encoded as a subdomain
 func CreateQuery(data []byte, domain string) (*dns.Msg, error) {
+	return DefaultConfig().CreateQuery(data, domain)
+}
+
+// CreateQuery creates a DNS query of the configured record type for the given
+// data encoded as a subdomain
+func (c Config) CreateQuery(data []byte, domain string) (*dns.Msg, error) {
+	name, err := c.queryName(data, domain)
+	if err != nil {
+		return nil, err
+	}
+
 	msg := new(dns.Msg)
-	msg.SetQuestion(CreateFQDN(EncodeSubdomain(data), domain), dns.TypeTXT)
+	msg.SetQuestion(name, c.recordType())
 	msg.RecursionDesired = true
 
 	// Add EDNS support for larger UDP payloads
@@ -26,108 +83,249 @@ func CreateQuery(data []byte, domain string) (*dns.Msg, error) {
 			Rrtype: dns.TypeOPT,
 		},
 	}
-	opt.SetUDPSize(EDNSBufferSize)
+	opt.SetUDPSize(c.ednsBufferSize())
 	msg.Extra = append(msg.Extra, opt)
 
 	return msg, nil
 }
 
-// ParseQueryData extracts the tunneled data from a DNS query
-func ParseQueryData(msg *dns.Msg, domain string) ([]byte, error) {
-	if len(msg.Question) != 1 {
-		return nil, fmt.Errorf("expected exactly 1 question, got %d", len(msg.Question))
-	}
+// CreateBatchQuery creates a DNS TXT query carrying several payload chunks
+func CreateBatchQuery(chunks [][]byte, domain string) (*dns.Msg, error) {
+	return DefaultConfig().CreateBatchQuery(chunks, domain)
+}
 
-	question := msg.Question[0]
-	if question.Qtype != dns.TypeTXT {
-		return nil, fmt.Errorf("expected TXT query, got type %d", question.Qtype)
+// CreateBatchQuery creates a DNS query carrying several payload chunks, one
+// question per chunk. Every name must fit in MaxDomainLength and the packed
+// message must fit in the EDNS buffer size.
+func (c Config) CreateBatchQuery(chunks [][]byte, domain string) (*dns.Msg, error) {
+	if len(chunks) == 0 {
+		return nil, fmt.Errorf("no chunks to send")
 	}
 
-	// Extract subdomain from FQDN
-	subdomain, err := ExtractSubdomain(question.Name, domain)
+	msg, err := c.CreateQuery(chunks[0], domain)
 	if err != nil {
-		return nil, fmt.Errorf("failed to extract subdomain: %w", err)
+		return nil, err
 	}
 
-	// Decode subdomain to get original data
-	if subdomain == "" {
-		return []byte{}, nil
+	for _, chunk := range chunks[1:] {
+		name, err := c.queryName(chunk, domain)
+		if err != nil {
+			return nil, err
+		}
+
+		msg.Question = append(msg.Question, dns.Question{
+			Name:   name,
+			Qtype:  c.recordType(),
+			Qclass: dns.ClassINET,
+		})
+	}
+	if limit := int(c.ednsBufferSize()); msg.Len() > limit {
+		return nil, fmt.Errorf("batched query of %d bytes exceeds %d bytes", msg.Len(), limit)
 	}
 
-	data, err := DecodeSubdomain(subdomain)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode subdomain: %w", err)
+	return msg, nil
+}
+
+// queryName encodes data as a query name under domain, behind a nonce label
+// if one is configured
+func (c Config) queryName(data []byte, domain string) (string, error) {
+	if c.padding() {
+		data = c.pad(data, c.maxEncodedSize(len(strings.TrimSuffix(domain, "."))))
 	}
 
-	return data, nil
+	enc := c.encoder()
+	subdomain := EncodeSubdomainWith(enc, data)
+	if c.NonceLength > 0 {
+		labels := []string{NonceLabel(c.NonceLength)}
+		if subdomain != "" {
+			labels = append(labels, subdomain)
+		}
+		subdomain = strings.Join(labels, ".")
+	}
+
+	name := CreateFQDN(subdomain, domain)
+	if err := ValidateFQDN(name); err != nil {
+		return "", fmt.Errorf("invalid query name: %w", err)
+	}
+
+	if c.RandomizeCase {
+		if isCaseSensitive(enc) {
+			return "", fmt.Errorf("case randomization requires a case-insensitive encoder")
+		}
+		name = RandomizeCase(name)
+	}
+	return name, nil
 }
 
-// CreateResponse creates a DNS TXT response containing the provided data
-func CreateResponse(query *dns.Msg, data []byte) *dns.Msg {
-	msg := new(dns.Msg)
-	msg.SetReply(query)
+// ParseQueryData extracts the tunneled data from a DNS query. Queries with
+// several questions carry one chunk per question, concatenated in order.
+// Each question may be under any of the given domains (see MatchDomain).
+func ParseQueryData(msg *dns.Msg, domains ...string) ([]byte, error) {
+	return DefaultConfig().ParseQueryData(msg, domains...)
+}
 
-	// If no data, return NXDOMAIN (name error)
-	if len(data) == 0 {
-		msg.Rcode = dns.RcodeNameError
-		return msg
+// ParseQueryData extracts the tunneled data from a DNS query encoded with
+// this configuration's encoder
+func (c Config) ParseQueryData(msg *dns.Msg, domains ...string) ([]byte, error) {
+	if len(msg.Question) == 0 {
+		return nil, fmt.Errorf("query has no questions")
 	}
 
-	// Create TXT record with the data
-	// Split data into 255-byte chunks as required by TXT record format
-	var txtStrings []string
-	for len(data) > 0 {
-		chunkSize := 255
-		if len(data) < chunkSize {
-			chunkSize = len(data)
+	var data []byte
+	for _, question := range msg.Question {
+		if !isSupportedRecordType(question.Qtype) {
+			return nil, fmt.Errorf("unsupported query type %d", question.Qtype)
+		}
+		if question.Qtype != msg.Question[0].Qtype {
+			return nil, fmt.Errorf("mixed query types in one message")
+		}
+
+		// Extract subdomain from FQDN
+		subdomain, _, err := MatchDomain(question.Name, domains...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract subdomain: %w", err)
+		}
+		subdomain = c.stripNonce(subdomain)
+
+		// Decode subdomain to get original data
+		if subdomain == "" {
+			continue
+		}
+
+		chunk, err := DecodeSubdomainWith(c.encoder(), subdomain)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode subdomain: %w", err)
 		}
-		txtStrings = append(txtStrings, string(data[:chunkSize]))
-		data = data[chunkSize:]
+		if c.padding() {
+			if chunk, err = unpad(chunk); err != nil {
+				return nil, err
+			}
+		}
+		data = append(data, chunk...)
 	}
 
-	txt := &dns.TXT{
-		Hdr: dns.RR_Header{
-			Name:   query.Question[0].Name,
-			Rrtype: dns.TypeTXT,
-			Class:  dns.ClassINET,
-			Ttl:    DefaultTTL,
-		},
-		Txt: txtStrings,
+	if data == nil {
+		return []byte{}, nil
 	}
+	return data, nil
+}
 
-	msg.Answer = append(msg.Answer, txt)
+// CreateResponse creates a DNS response containing the provided data, using
+// the record type of the query. The message is not size-limited; use
+// CreateResponseN to bound it.
+func CreateResponse(query *dns.Msg, data []byte) *dns.Msg {
+	return DefaultConfig().CreateResponse(query, data)
+}
+
+// CreateResponseN creates a DNS response containing as much of data as fits
+// in a packed message of at most maxSize bytes, and returns the number of
+// bytes of data it encoded. A negative maxSize disables the limit. The
+// answer records use the query's record type.
+func CreateResponseN(query *dns.Msg, data []byte, maxSize int) (*dns.Msg, int) {
+	return DefaultConfig().CreateResponseN(query, data, maxSize)
+}
+
+// CreateResponse creates a DNS response containing the provided data with
+// the configured TTL. Like the package-level CreateResponse it is not
+// size-limited; servers split data with CreateResponseN instead.
+func (c Config) CreateResponse(query *dns.Msg, data []byte) *dns.Msg {
+	msg, _ := c.CreateResponseN(query, data, -1)
+	return msg
+}
+
+// CreateResponseN creates a size-bounded DNS response with the configured
+// TTL and padding; see the package-level CreateResponseN
+func (c Config) CreateResponseN(query *dns.Msg, data []byte, maxSize int) (*dns.Msg, int) {
+	if c.padding() && len(data) > 0 {
+		return c.createPaddedResponse(query, data, maxSize)
+	}
+	return c.createResponseN(query, data, maxSize)
+}
+
+// createResponseN creates a response carrying data without padding
+func (c Config) createResponseN(query *dns.Msg, data []byte, maxSize int) (*dns.Msg, int) {
+	msg := new(dns.Msg)
+	msg.SetReply(query)
+
+	// Empty data is a NOERROR response with no answers, which keeps it
+	// distinct from a genuine NXDOMAIN
+	if len(data) == 0 {
+		return msg, 0
+	}
 
 	// Copy EDNS from query if present
 	if opt := query.IsEdns0(); opt != nil {
 		msg.Extra = append(msg.Extra, opt)
 	}
 
-	return msg
+	question := query.Question[0]
+	ttl := c.ttl()
+	switch question.Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		return msg, appendAddrs(msg, question.Name, question.Qtype, ttl, data, maxSize)
+	case dns.TypeNULL:
+		return msg, appendNULL(msg, question.Name, ttl, data, maxSize)
+	default:
+		return msg, appendTXT(msg, question.Name, ttl, data, maxSize)
+	}
+}
+
+// ResponseSizeLimit returns the largest response the sender of query accepts:
+// its advertised EDNS UDP payload size, or MinEDNSBufferSize without EDNS
+func ResponseSizeLimit(query *dns.Msg) int {
+	opt := query.IsEdns0()
+	if opt == nil || opt.UDPSize() < MinEDNSBufferSize {
+		return MinEDNSBufferSize
+	}
+	return int(opt.UDPSize())
 }
 
 // ParseResponseData extracts the tunneled data from a DNS response
 func ParseResponseData(msg *dns.Msg) ([]byte, error) {
+	return DefaultConfig().ParseResponseData(msg)
+}
+
+// ParseResponseData extracts the tunneled data from a DNS response, removing
+// the configured padding
+func (c Config) ParseResponseData(msg *dns.Msg) ([]byte, error) {
+	data, err := parseResponseData(msg)
+	if err != nil || !c.padding() || len(data) == 0 {
+		return data, err
+	}
+	return unpad(data)
+}
+
+func parseResponseData(msg *dns.Msg) ([]byte, error) {
+	if msg.Truncated {
+		return nil, ErrTruncated
+	}
+
 	// Check for error response codes
 	if msg.Rcode == dns.RcodeNameError {
-		// NXDOMAIN means no data to send
-		return []byte{}, nil
+		return nil, ErrNXDomain
 	}
 
-	if msg.Rcode != dns.RcodeSuccess {
-		return nil, fmt.Errorf("DNS response error: %s", dns.RcodeToString[msg.Rcode])
+	switch msg.Rcode {
+	case dns.RcodeSuccess:
+	case dns.RcodeServerFailure, dns.RcodeRefused:
+		return nil, &RetryableDNSError{Rcode: msg.Rcode}
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrRcode, dns.RcodeToString[msg.Rcode])
 	}
 
-	// Extract data from TXT records
-	var data []byte
-	for _, answer := range msg.Answer {
-		if txt, ok := answer.(*dns.TXT); ok {
-			for _, s := range txt.Txt {
-				data = append(data, []byte(s)...)
-			}
-		}
+	// No answers means the server had no data to send
+	if len(msg.Answer) == 0 {
+		return []byte{}, nil
 	}
 
-	return data, nil
+	switch msg.Answer[0].Header().Rrtype {
+	case dns.TypeA, dns.TypeAAAA:
+		return parseAddrs(msg.Answer)
+	case dns.TypeNULL:
+		return parseNULL(msg.Answer)
+	default:
+		return parseTXT(msg.Answer)
+	}
 }
 
 // CreateErrorResponse creates a DNS error response with the given rcode
@@ -0,0 +1,113 @@
+package dns
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testDomain = "tunnel.example.com"
+
+// randomBytes returns n pseudo-random bytes, the same for every run
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(b)
+	return b
+}
+
+// repackResponse packs msg, failing the test if it exceeds maxSize, and
+// returns the data the client would extract from it
+func repackResponse(t *testing.T, c Config, msg *dns.Msg, maxSize int) []byte {
+	t.Helper()
+	packed, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack response: %v", err)
+	}
+	if len(packed) > maxSize {
+		t.Fatalf("response is %d bytes, over the limit of %d", len(packed), maxSize)
+	}
+
+	out := new(dns.Msg)
+	if err := out.Unpack(packed); err != nil {
+		t.Fatalf("failed to unpack response: %v", err)
+	}
+	data, err := c.ParseResponseData(out)
+	if err != nil {
+		t.Fatalf("failed to parse response: %v", err)
+	}
+	return data
+}
+
+func TestCreateResponseNSplitsLargeData(t *testing.T) {
+	data := randomBytes(100 * 1024)
+
+	for _, rrtype := range []uint16{dns.TypeTXT, dns.TypeNULL, dns.TypeA, dns.TypeAAAA} {
+		for _, maxSize := range []int{EDNSBufferSize, MaxMessageSize} {
+			c := Config{RecordType: rrtype}
+			query, err := c.CreateQuery(nil, testDomain)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []byte
+			responses := 0
+			for len(got) < len(data) {
+				msg, n := c.CreateResponseN(query, data[len(got):], maxSize)
+				if n == 0 {
+					t.Fatalf("%s, %d bytes: response has no room for data", dns.TypeToString[rrtype], maxSize)
+				}
+				part := repackResponse(t, c, msg, maxSize)
+				if len(part) != n {
+					t.Fatalf("%s, %d bytes: response encoded %d bytes, carried %d", dns.TypeToString[rrtype], maxSize, n, len(part))
+				}
+				got = append(got, part...)
+				responses++
+			}
+
+			if !bytes.Equal(got, data) {
+				t.Fatalf("%s, %d bytes: reassembled data differs", dns.TypeToString[rrtype], maxSize)
+			}
+			if responses < 2 {
+				t.Fatalf("%s, %d bytes: 100KB fit in one response", dns.TypeToString[rrtype], maxSize)
+			}
+		}
+	}
+}
+
+func TestParseResponseDataRcodes(t *testing.T) {
+	query, err := CreateQuery([]byte("data"), testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		rcode     int
+		want      error
+		retryable bool
+	}{
+		{dns.RcodeServerFailure, nil, true},
+		{dns.RcodeRefused, nil, true},
+		{dns.RcodeNameError, ErrNXDomain, false},
+		{dns.RcodeFormatError, ErrRcode, false},
+		{dns.RcodeNotImplemented, ErrRcode, false},
+	} {
+		name := dns.RcodeToString[tc.rcode]
+		_, err := ParseResponseData(CreateErrorResponse(query, tc.rcode))
+		if err == nil {
+			t.Fatalf("%s: no error", name)
+		}
+		if IsRetryable(err) != tc.retryable {
+			t.Fatalf("%s: IsRetryable(%v) = %v, want %v", name, err, !tc.retryable, tc.retryable)
+		}
+		var retryable *RetryableDNSError
+		if tc.retryable && (!errors.As(err, &retryable) || retryable.Rcode != tc.rcode) {
+			t.Fatalf("%s: got %v, want a RetryableDNSError with its rcode", name, err)
+		}
+		if tc.want != nil && !errors.Is(err, tc.want) {
+			t.Fatalf("%s: got %v, want %v", name, err, tc.want)
+		}
+	}
+}
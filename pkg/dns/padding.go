@@ -0,0 +1,108 @@
+package dns
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// padLengthSize is the size of the length prefix of padded payloads
+const padLengthSize = 2
+
+// padding reports whether payloads are padded
+func (c Config) padding() bool {
+	return c.PadSize > 0 || len(c.PadBuckets) > 0
+}
+
+// ValidatePadBuckets checks that buckets can be used as Config.PadBuckets
+func ValidatePadBuckets(buckets []int) error {
+	for _, size := range buckets {
+		if size <= 0 || size > 0xFFFF {
+			return fmt.Errorf("pad bucket %d is outside 1-%d", size, 0xFFFF)
+		}
+	}
+	return nil
+}
+
+// pad prefixes data with its length and fills it with random bytes up to
+// its padded size, without growing it past limit bytes
+func (c Config) pad(data []byte, limit int) []byte {
+	size := max(min(c.paddedSize(len(data)), limit), padLengthSize+len(data))
+
+	payload := make([]byte, size)
+	binary.BigEndian.PutUint16(payload, uint16(len(data)))
+	copy(payload[padLengthSize:], data)
+	rand.Read(payload[padLengthSize+len(data):])
+	return payload
+}
+
+// paddedSize returns the size of the padded payload carrying n bytes of
+// data, before any limit
+func (c Config) paddedSize(n int) int {
+	if len(c.PadBuckets) > 0 {
+		return padLengthSize + bucketSize(c.PadBuckets, n)
+	}
+
+	size := padLengthSize + n
+	if rem := size % c.PadSize; rem != 0 {
+		size += c.PadSize - rem
+	}
+	return size
+}
+
+// bucketSize returns the smallest of buckets that holds n bytes, or the
+// next multiple of the largest if none does
+func bucketSize(buckets []int, n int) int {
+	best, largest := 0, 0
+	for _, size := range buckets {
+		if size >= n && (best == 0 || size < best) {
+			best = size
+		}
+		largest = max(largest, size)
+	}
+	switch {
+	case best > 0:
+		return best
+	case largest <= 0:
+		return n
+	}
+	return (n + largest - 1) / largest * largest
+}
+
+// unpad returns the data of a padded payload
+func unpad(payload []byte) ([]byte, error) {
+	if len(payload) < padLengthSize {
+		return nil, fmt.Errorf("padded payload too short for length prefix")
+	}
+	n := int(binary.BigEndian.Uint16(payload))
+	if n > len(payload)-padLengthSize {
+		return nil, fmt.Errorf("padded payload length %d exceeds %d received bytes", n, len(payload)-padLengthSize)
+	}
+	return payload[padLengthSize : padLengthSize+n], nil
+}
+
+// createPaddedResponse is CreateResponseN for padded payloads. It finds how
+// many payload bytes the response can hold, then pads as much of data as
+// fits.
+func (c Config) createPaddedResponse(query *dns.Msg, data []byte, maxSize int) (*dns.Msg, int) {
+	capacity := MaxMessageSize
+	if maxSize >= 0 {
+		_, capacity = c.createResponseN(query, make([]byte, maxSize), maxSize)
+	}
+
+	for capacity > padLengthSize {
+		n := min(len(data), capacity-padLengthSize, 0xFFFF)
+		payload := c.pad(data[:n], capacity)
+		msg, encoded := c.createResponseN(query, payload, maxSize)
+		if encoded == len(payload) {
+			return msg, n
+		}
+		// Records are packed less tightly than the estimate assumed
+		capacity = encoded
+	}
+
+	msg, _ := c.createResponseN(query, nil, maxSize)
+	return msg, 0
+}
@@ -0,0 +1,148 @@
+package dns
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+var testBuckets = []int{32, 64, 96, 128}
+
+// queryPayload returns the padded payload a query carries, as decoded before
+// the padding is stripped
+func queryPayload(t *testing.T, query *dns.Msg) []byte {
+	t.Helper()
+	subdomain, err := ExtractSubdomain(query.Question[0].Name, testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := DecodeSubdomain(StripNonce(subdomain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func TestPadBucketsQueries(t *testing.T) {
+	c := DefaultConfig()
+	c.PadBuckets = testBuckets
+	maxData := c.MaxPayloadSize(len(testDomain))
+
+	sizes := make(map[int]bool)
+	names := make(map[int]bool)
+	for n := 0; n <= maxData; n++ {
+		data := randomBytes(n)
+		query, err := c.CreateQuery(data, testDomain)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", n, err)
+		}
+
+		payload := queryPayload(t, query)
+		if len(payload) <= n {
+			t.Fatalf("%d bytes: payload of %d bytes isn't padded", n, len(payload))
+		}
+		// Only the largest payloads are cut short of their bucket
+		if !slices.Contains(testBuckets, len(payload)-padLengthSize) && len(payload) != c.maxEncodedSize(len(testDomain)) {
+			t.Fatalf("%d bytes: payload carries %d bytes, not a bucket", n, len(payload)-padLengthSize)
+		}
+		sizes[len(payload)] = true
+		names[len(query.Question[0].Name)] = true
+
+		got, err := c.ParseQueryData(query, testDomain)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", n, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%d bytes: decoded %x, want %x", n, got, data)
+		}
+	}
+
+	// Every payload fits in a bucket or the largest payload a name holds
+	if len(sizes) > len(testBuckets)+1 || len(names) > len(testBuckets)+1 {
+		t.Fatalf("%d payload sizes took %d payload and %d name lengths", maxData+1, len(sizes), len(names))
+	}
+}
+
+func TestPadBucketsPadRandomly(t *testing.T) {
+	c := DefaultConfig()
+	c.PadBuckets = testBuckets
+	data := []byte("short")
+
+	first, err := c.CreateQuery(data, testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := c.CreateQuery(data, testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := queryPayload(t, first), queryPayload(t, second)
+	if !bytes.Equal(a[:padLengthSize+len(data)], b[:padLengthSize+len(data)]) || bytes.Equal(a, b) {
+		t.Fatalf("payloads %x and %x should differ in their padding only", a, b)
+	}
+}
+
+func TestPadBucketsResponses(t *testing.T) {
+	for _, rrtype := range []uint16{dns.TypeTXT, dns.TypeNULL, dns.TypeA, dns.TypeAAAA} {
+		c := DefaultConfig()
+		c.RecordType = rrtype
+		c.PadBuckets = testBuckets
+		query, err := c.CreateQuery(nil, testDomain)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sizes := make(map[int]bool)
+		for n := 1; n <= 200; n++ {
+			data := randomBytes(n)
+			var got []byte
+			for len(got) < n {
+				msg, sent := c.CreateResponseN(query, data[len(got):], EDNSBufferSize)
+				if sent == 0 {
+					t.Fatalf("%s, %d bytes: response has no room for data", dns.TypeToString[rrtype], n)
+				}
+				packed, err := msg.Pack()
+				if err != nil {
+					t.Fatal(err)
+				}
+				sizes[len(packed)] = true
+
+				part := repackResponse(t, c, msg, EDNSBufferSize)
+				if len(part) != sent {
+					t.Fatalf("%s, %d bytes: response carried %d bytes, reported %d", dns.TypeToString[rrtype], n, len(part), sent)
+				}
+				got = append(got, part...)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("%s, %d bytes: reassembled data differs", dns.TypeToString[rrtype], n)
+			}
+		}
+
+		// 200 data sizes take the four buckets and multiples of the
+		// largest, at most one more
+		if len(sizes) > len(testBuckets)+1 {
+			t.Fatalf("%s: 200 data sizes took %d response sizes", dns.TypeToString[rrtype], len(sizes))
+		}
+	}
+}
+
+func TestPadSizeRoundsUp(t *testing.T) {
+	c := DefaultConfig()
+	c.PadSize = 16
+	for n := 0; n <= 40; n++ {
+		data := randomBytes(n)
+		query, err := c.CreateQuery(data, testDomain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := len(queryPayload(t, query)); size%c.PadSize != 0 || size < padLengthSize+n {
+			t.Fatalf("%d bytes took a %d-byte payload, want a multiple of %d", n, size, c.PadSize)
+		}
+		got, err := c.ParseQueryData(query, testDomain)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%d bytes: decoded %x, %v; want %x", n, got, err, data)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// TXTIndexSize is the size of the sequence index prefixed to each TXT chunk
+	TXTIndexSize = 2
+	// MaxTXTChunkSize is the number of payload bytes carried per TXT string
+	MaxTXTChunkSize = 255 - TXTIndexSize
+
+	// AChunkSize is the number of payload bytes carried per A record, after
+	// the one-byte sequence index
+	AChunkSize = net.IPv4len - 1
+	// AAAAChunkSize is the number of payload bytes carried per AAAA record,
+	// after the one-byte sequence index
+	AAAAChunkSize = net.IPv6len - 1
+	// maxAddrRecords is the number of distinct one-byte sequence indices
+	maxAddrRecords = 256
+	// addrLengthSize is the size of the length prefix in the first address
+	// record
+	addrLengthSize = 2
+
+	// MaxNULLDataSize is the largest payload a NULL record's RDATA can hold
+	MaxNULLDataSize = 0xFFFF
+)
+
+// isSupportedRecordType reports whether data can be tunneled in records of
+// the given type
+func isSupportedRecordType(rrtype uint16) bool {
+	switch rrtype {
+	case dns.TypeTXT, dns.TypeA, dns.TypeAAAA, dns.TypeNULL:
+		return true
+	default:
+		return false
+	}
+}
+
+// ParseRecordType returns the record type with the given name: TXT, A, AAAA
+// or NULL
+func ParseRecordType(name string) (uint16, error) {
+	rrtype, ok := dns.StringToType[strings.ToUpper(name)]
+	if !ok || !isSupportedRecordType(rrtype) {
+		return 0, fmt.Errorf("unsupported record type %q", name)
+	}
+	return rrtype, nil
+}
+
+// appendTXT adds TXT records carrying data to msg without growing it past
+// maxSize bytes, and returns the number of bytes of data encoded. Each
+// record holds one string: a sequence index followed by a chunk of data, so
+// the client can restore the order if answer records get shuffled in transit.
+func appendTXT(msg *dns.Msg, name string, ttl uint32, data []byte, maxSize int) int {
+	size := msg.Len()
+	encoded := 0
+	for index := 0; encoded < len(data); index++ {
+		chunkSize := MaxTXTChunkSize
+		if remaining := len(data) - encoded; remaining < chunkSize {
+			chunkSize = remaining
+		}
+
+		txt := &dns.TXT{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeTXT,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
+			},
+		}
+
+		// Wire size of the record without its payload. dns.Len counts TXT
+		// strings in their escaped form, so it is only used for the header.
+		overhead := dns.Len(txt) + 1 + TXTIndexSize
+
+		// Shrink the final chunk to whatever space is left in the message
+		if maxSize >= 0 {
+			if free := maxSize - size - overhead; free < chunkSize {
+				chunkSize = free
+			}
+			if chunkSize <= 0 {
+				break
+			}
+		}
+
+		chunk := make([]byte, TXTIndexSize, TXTIndexSize+chunkSize)
+		binary.BigEndian.PutUint16(chunk, uint16(index))
+		chunk = append(chunk, data[encoded:encoded+chunkSize]...)
+		txt.Txt = []string{escapeTXT(chunk)}
+
+		msg.Answer = append(msg.Answer, txt)
+		size += overhead + chunkSize
+		encoded += chunkSize
+	}
+
+	return encoded
+}
+
+// parseTXT reassembles data from indexed TXT records
+func parseTXT(answers []dns.RR) ([]byte, error) {
+	chunks := make(map[int][]byte)
+	for _, answer := range answers {
+		txt, ok := answer.(*dns.TXT)
+		if !ok {
+			continue
+		}
+
+		var raw []byte
+		for _, s := range txt.Txt {
+			raw = append(raw, unescapeTXT(s)...)
+		}
+		if len(raw) < TXTIndexSize {
+			return nil, fmt.Errorf("TXT chunk too short for sequence index")
+		}
+
+		// Duplicate indices come from caches repeating records; keep the first
+		index := int(binary.BigEndian.Uint16(raw))
+		if _, dup := chunks[index]; !dup {
+			chunks[index] = raw[TXTIndexSize:]
+		}
+	}
+
+	return reassembleChunks(chunks)
+}
+
+// appendAddrs adds A or AAAA records carrying data to msg without growing it
+// past maxSize bytes, and returns the number of bytes of data encoded. Each
+// address holds a one-byte sequence index followed by the rest of the
+// address in payload; the payload starts with a two-byte length so padding
+// in the last record can be discarded.
+func appendAddrs(msg *dns.Msg, name string, rrtype uint16, ttl uint32, data []byte, maxSize int) int {
+	hdr := dns.RR_Header{
+		Name:   name,
+		Rrtype: rrtype,
+		Class:  dns.ClassINET,
+		Ttl:    ttl,
+	}
+	addrLen := net.IPv6len
+	newRR := func(addr net.IP) dns.RR { return &dns.AAAA{Hdr: hdr, AAAA: addr} }
+	if rrtype == dns.TypeA {
+		addrLen = net.IPv4len
+		newRR = func(addr net.IP) dns.RR { return &dns.A{Hdr: hdr, A: addr} }
+	}
+	rrSize := dns.Len(newRR(make(net.IP, addrLen)))
+
+	records := maxAddrRecords
+	if maxSize >= 0 {
+		if fit := (maxSize - msg.Len()) / rrSize; fit < records {
+			records = fit
+		}
+	}
+
+	capacity := records*(addrLen-1) - addrLengthSize
+	if capacity > 0xFFFF {
+		capacity = 0xFFFF
+	}
+	if capacity <= 0 {
+		return 0
+	}
+
+	n := len(data)
+	if n > capacity {
+		n = capacity
+	}
+
+	payload := make([]byte, addrLengthSize, addrLengthSize+n)
+	binary.BigEndian.PutUint16(payload, uint16(n))
+	payload = append(payload, data[:n]...)
+
+	for index := 0; len(payload) > 0; index++ {
+		addr := make(net.IP, addrLen)
+		addr[0] = byte(index)
+		payload = payload[copy(addr[1:], payload):]
+
+		msg.Answer = append(msg.Answer, newRR(addr))
+	}
+
+	return n
+}
+
+// parseAddrs reassembles data from indexed A or AAAA records
+func parseAddrs(answers []dns.RR) ([]byte, error) {
+	chunks := make(map[int][]byte)
+	for _, answer := range answers {
+		var addr net.IP
+		switch rr := answer.(type) {
+		case *dns.A:
+			addr = rr.A.To4()
+		case *dns.AAAA:
+			addr = rr.AAAA.To16()
+		default:
+			continue
+		}
+		if addr == nil {
+			return nil, fmt.Errorf("invalid %s record", dns.TypeToString[answer.Header().Rrtype])
+		}
+
+		index := int(addr[0])
+		if _, dup := chunks[index]; !dup {
+			chunks[index] = addr[1:]
+		}
+	}
+
+	payload, err := reassembleChunks(chunks)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < addrLengthSize {
+		return nil, fmt.Errorf("address payload too short for length prefix")
+	}
+
+	n := int(binary.BigEndian.Uint16(payload))
+	if n > len(payload)-addrLengthSize {
+		return nil, fmt.Errorf("address payload length %d exceeds %d received bytes", n, len(payload)-addrLengthSize)
+	}
+
+	return payload[addrLengthSize : addrLengthSize+n], nil
+}
+
+// appendNULL adds a NULL record carrying data to msg without growing it past
+// maxSize bytes, and returns the number of bytes of data encoded. NULL RDATA
+// is arbitrary binary, so the data is carried raw in a single record with no
+// encoding or chunking.
+func appendNULL(msg *dns.Msg, name string, ttl uint32, data []byte, maxSize int) int {
+	null := &dns.NULL{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeNULL,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+	}
+
+	n := len(data)
+	if n > MaxNULLDataSize {
+		n = MaxNULLDataSize
+	}
+	if maxSize >= 0 {
+		if free := maxSize - msg.Len() - dns.Len(null); free < n {
+			n = free
+		}
+	}
+	if n <= 0 {
+		return 0
+	}
+
+	null.Data = string(data[:n])
+	msg.Answer = append(msg.Answer, null)
+	return n
+}
+
+// parseNULL concatenates the data of NULL records in answer order
+func parseNULL(answers []dns.RR) ([]byte, error) {
+	data := []byte{}
+	for _, answer := range answers {
+		if null, ok := answer.(*dns.NULL); ok {
+			data = append(data, null.Data...)
+		}
+	}
+	return data, nil
+}
+
+// reassembleChunks concatenates indexed chunks in order, requiring the
+// indices to form a contiguous sequence starting at zero
+func reassembleChunks(chunks map[int][]byte) ([]byte, error) {
+	indices := make([]int, 0, len(chunks))
+	for index := range chunks {
+		indices = append(indices, index)
+	}
+	sort.Ints(indices)
+
+	data := []byte{}
+	for i, index := range indices {
+		if index != i {
+			return nil, fmt.Errorf("missing chunk %d", i)
+		}
+		data = append(data, chunks[index]...)
+	}
+
+	return data, nil
+}
+
+// escapeTXT converts raw bytes into the presentation format the dns package
+// expects for TXT strings, so arbitrary binary data survives packing
+func escapeTXT(data []byte) string {
+	var sb strings.Builder
+	sb.Grow(len(data))
+	for _, b := range data {
+		switch {
+		case b == '"' || b == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(b)
+		case b < ' ' || b > '~':
+			fmt.Fprintf(&sb, "\\%03d", b)
+		default:
+			sb.WriteByte(b)
+		}
+	}
+	return sb.String()
+}
+
+// unescapeTXT reverses the escaping applied to TXT strings by the dns package
+// when unpacking, recovering the raw bytes
+func unescapeTXT(s string) []byte {
+	data := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			data = append(data, s[i])
+			continue
+		}
+		i++
+		if i+2 < len(s) && isDigit(s[i]) && isDigit(s[i+1]) && isDigit(s[i+2]) {
+			data = append(data, (s[i]-'0')*100+(s[i+1]-'0')*10+(s[i+2]-'0'))
+			i += 2
+		} else {
+			data = append(data, s[i])
+		}
+	}
+	return data
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
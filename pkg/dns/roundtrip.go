@@ -0,0 +1,73 @@
+package dns
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// The RoundTrip functions push data through an encode/decode pipeline and
+// return what comes out the other side. They exist so fuzzers and downstream
+// packages can check that the output always equals the input.
+
+// RoundTripSubdomain encodes data as a subdomain of domain, builds the FQDN,
+// and extracts and decodes it again
+func RoundTripSubdomain(data []byte, domain string) ([]byte, error) {
+	fqdn := CreateFQDN(EncodeSubdomain(data), domain)
+	if err := ValidateFQDN(fqdn); err != nil {
+		return nil, err
+	}
+
+	subdomain, err := ExtractSubdomain(fqdn, domain)
+	if err != nil {
+		return nil, err
+	}
+	if subdomain == "" {
+		return []byte{}, nil
+	}
+	return DecodeSubdomain(subdomain)
+}
+
+// RoundTripQuery builds a query carrying data, packs and unpacks it, and
+// extracts the data again
+func RoundTripQuery(data []byte, domain string) ([]byte, error) {
+	query, err := CreateQuery(data, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := repack(query)
+	if err != nil {
+		return nil, err
+	}
+	return ParseQueryData(msg, domain)
+}
+
+// RoundTripResponse builds a response carrying data to a query for domain,
+// packs and unpacks it, and extracts the data again
+func RoundTripResponse(data []byte, domain string) ([]byte, error) {
+	query, err := CreateQuery(nil, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := repack(CreateResponse(query, data))
+	if err != nil {
+		return nil, err
+	}
+	return ParseResponseData(msg)
+}
+
+// repack returns a copy of msg as it would be seen by the receiver
+func repack(msg *dns.Msg) (*dns.Msg, error) {
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack message: %w", err)
+	}
+
+	out := new(dns.Msg)
+	if err := out.Unpack(packed); err != nil {
+		return nil, fmt.Errorf("failed to unpack message: %w", err)
+	}
+	return out, nil
+}
@@ -0,0 +1,69 @@
+package dns
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// addRoundTripSeeds adds the edge cases of the encoding to f: no data, data
+// filling exactly one 63-character label, and the largest payload a query
+// can carry
+func addRoundTripSeeds(f *testing.F) {
+	f.Add([]byte{}, testDomain)
+	f.Add([]byte("hello"), testDomain)
+	f.Add(bytes.Repeat([]byte{0xff}, 35), testDomain) // 56 base32 characters
+	f.Add(bytes.Repeat([]byte{0x00}, 39), testDomain) // exactly one full label
+	f.Add(bytes.Repeat([]byte{'.'}, 80), testDomain)  // dots in the data
+	f.Add(randomBytes(CalculateMaxPayloadSize(len(testDomain))), testDomain)
+	f.Add([]byte("data"), "a.b")
+	f.Add([]byte("data"), strings.Repeat("x", 63)+".example")
+}
+
+func FuzzSubdomain(f *testing.F) {
+	addRoundTripSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte, domain string) {
+		if ValidateFQDN(CreateFQDN("", domain)) != nil || len(data) > CalculateMaxPayloadSize(len(domain)) {
+			t.Skip()
+		}
+		got, err := RoundTripSubdomain(data, domain)
+		if err != nil {
+			t.Fatalf("round trip of %d bytes under %q failed: %v", len(data), domain, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("round trip under %q changed %x to %x", domain, data, got)
+		}
+	})
+}
+
+func FuzzQuery(f *testing.F) {
+	addRoundTripSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte, domain string) {
+		if ValidateFQDN(CreateFQDN("", domain)) != nil || len(data) > DefaultConfig().MaxPayloadSize(len(domain)) {
+			t.Skip()
+		}
+		got, err := RoundTripQuery(data, domain)
+		if err != nil {
+			t.Fatalf("round trip of %d bytes under %q failed: %v", len(data), domain, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("round trip under %q changed %x to %x", domain, data, got)
+		}
+	})
+}
+
+func FuzzResponse(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte("hello"))
+	f.Add(bytes.Repeat([]byte{'\\'}, 300))
+	f.Add(randomBytes(1000))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		got, err := RoundTripResponse(data, testDomain)
+		if err != nil {
+			t.Fatalf("round trip of %d bytes failed: %v", len(data), err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("round trip changed %x to %x", data, got)
+		}
+	})
+}
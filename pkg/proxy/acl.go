@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+
+	"github.com/getlantern/lantern/slipstream/pkg/transport"
+)
+
+// ErrTargetDenied is returned when a target address is rejected by a
+// TargetACL. It is the transport's error, so the server resets rejected
+// streams with ErrorCodeTargetDenied.
+var ErrTargetDenied = transport.ErrTargetDenied
+
+// TargetACL restricts which upstream targets the server may connect to.
+//
+// Rules have the form "host[:port]". The host part may be a CIDR range
+// ("10.0.0.0/8", "[2001:db8::/32]"), an IP address, or a hostname glob
+// ("*.example.com"). The port part is a glob ("443", "80*") and defaults to
+// "*" when omitted. Deny rules are evaluated first; if any allow rules are
+// configured, a target must match at least one of them.
+//
+// Targets named by clients are checked again against the address they
+// resolve to when dialed, so a hostname can't lead to a range a deny rule
+// covers. Local addresses, loopback, link-local (which includes cloud
+// metadata services) and unspecified, are refused to clients unless
+// SetAllowLocal permits them or an allow rule names them explicitly, by IP,
+// CIDR range or hostname.
+type TargetACL struct {
+	allow      []aclRule
+	deny       []aclRule
+	allowLocal bool
+}
+
+type aclRule struct {
+	raw  string
+	cidr *net.IPNet
+	host string
+	port string
+}
+
+// NewTargetACL creates an empty ACL that permits every target except local
+// addresses named by clients
+func NewTargetACL() *TargetACL {
+	return &TargetACL{}
+}
+
+// SetAllowLocal permits clients to reach local addresses, such as services
+// listening on the server's loopback interface
+func (a *TargetACL) SetAllowLocal(allow bool) {
+	a.allowLocal = allow
+}
+
+// Allow adds a rule that permits matching targets
+func (a *TargetACL) Allow(rule string) error {
+	r, err := parseACLRule(rule)
+	if err != nil {
+		return err
+	}
+	a.allow = append(a.allow, r)
+	return nil
+}
+
+// Deny adds a rule that rejects matching targets
+func (a *TargetACL) Deny(rule string) error {
+	r, err := parseACLRule(rule)
+	if err != nil {
+		return err
+	}
+	a.deny = append(a.deny, r)
+	return nil
+}
+
+// Check returns nil if the target (host:port) is permitted, or an error
+// wrapping ErrTargetDenied otherwise
+func (a *TargetACL) Check(target string) error {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return fmt.Errorf("%w: invalid target %q: %v", ErrTargetDenied, target, err)
+	}
+
+	for _, r := range a.deny {
+		if r.matches(host, port) {
+			return fmt.Errorf("%w: %s matches deny rule %q", ErrTargetDenied, target, r.raw)
+		}
+	}
+
+	if len(a.allow) == 0 {
+		return nil
+	}
+	for _, r := range a.allow {
+		if r.matches(host, port) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s matches no allow rule", ErrTargetDenied, target)
+}
+
+// CheckDial returns nil if a client may connect to target, once resolved,
+// at ip, or an error wrapping ErrTargetDenied otherwise. Deny rules with
+// addresses or ranges apply to ip, and local addresses are refused unless
+// permitted.
+func (a *TargetACL) CheckDial(target string, ip net.IP) error {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return fmt.Errorf("%w: invalid target %q: %v", ErrTargetDenied, target, err)
+	}
+
+	for _, r := range a.deny {
+		if r.cidr != nil && r.matches(ip.String(), port) {
+			return fmt.Errorf("%w: %s resolves to %s, which matches deny rule %q", ErrTargetDenied, target, ip, r.raw)
+		}
+	}
+
+	if !isLocalIP(ip) || a.allowLocal {
+		return nil
+	}
+	for _, r := range a.allow {
+		if r.names(host, ip, port) {
+			return nil
+		}
+	}
+	if net.ParseIP(host) != nil {
+		return fmt.Errorf("%w: %s is a local address", ErrTargetDenied, target)
+	}
+	return fmt.Errorf("%w: %s resolves to local address %s", ErrTargetDenied, target, ip)
+}
+
+// isLocalIP reports whether ip belongs to the server itself or its link,
+// rather than to a remote host
+func isLocalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+func parseACLRule(rule string) (aclRule, error) {
+	rule = strings.TrimSpace(rule)
+	if rule == "" {
+		return aclRule{}, fmt.Errorf("empty ACL rule")
+	}
+
+	host, port, err := net.SplitHostPort(rule)
+	if err != nil {
+		// No port component (or an unbracketed IPv6 address/range)
+		host, port = strings.Trim(rule, "[]"), "*"
+	}
+	if port == "" {
+		port = "*"
+	}
+	if _, err := path.Match(port, ""); err != nil {
+		return aclRule{}, fmt.Errorf("invalid port pattern in ACL rule %q: %w", rule, err)
+	}
+
+	r := aclRule{raw: rule, port: port}
+	if strings.Contains(host, "/") {
+		_, cidr, err := net.ParseCIDR(host)
+		if err != nil {
+			return aclRule{}, fmt.Errorf("invalid CIDR in ACL rule %q: %w", rule, err)
+		}
+		r.cidr = cidr
+		return r, nil
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		r.cidr = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		return r, nil
+	}
+
+	r.host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if _, err := path.Match(r.host, ""); err != nil {
+		return aclRule{}, fmt.Errorf("invalid host pattern in ACL rule %q: %w", rule, err)
+	}
+	return r, nil
+}
+
+func (r aclRule) matches(host, port string) bool {
+	if ok, _ := path.Match(r.port, port); !ok {
+		return false
+	}
+
+	if r.cidr != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && r.cidr.Contains(ip)
+	}
+
+	// Hostname globs only match IP literals when they match everything
+	if net.ParseIP(host) != nil {
+		return r.host == "*"
+	}
+	ok, _ := path.Match(r.host, strings.ToLower(strings.TrimSuffix(host, ".")))
+	return ok
+}
+
+// names reports whether the rule names the target host at ip specifically,
+// rather than through a wildcard host or an all-covering range
+func (r aclRule) names(host string, ip net.IP, port string) bool {
+	if ok, _ := path.Match(r.port, port); !ok {
+		return false
+	}
+
+	if r.cidr != nil {
+		ones, _ := r.cidr.Mask.Size()
+		return ones > 0 && r.cidr.Contains(ip)
+	}
+	return r.host != "*" && r.matches(host, port)
+}
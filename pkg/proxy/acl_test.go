@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newACL returns an ACL with the given allow and deny rules
+func newACL(t *testing.T, allow, deny []string) *TargetACL {
+	t.Helper()
+	acl := NewTargetACL()
+	for _, rule := range allow {
+		if err := acl.Allow(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, rule := range deny {
+		if err := acl.Deny(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return acl
+}
+
+func TestTargetACLCheck(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		allow   []string
+		deny    []string
+		target  string
+		allowed bool
+	}{
+		{"no rules", nil, nil, "example.com:80", true},
+		{"invalid target", nil, nil, "example.com", false},
+		{"v4 CIDR", []string{"10.0.0.0/8"}, nil, "10.1.2.3:80", true},
+		{"outside v4 CIDR", []string{"10.0.0.0/8"}, nil, "11.0.0.1:80", false},
+		{"v4 address", []string{"192.0.2.1"}, nil, "192.0.2.1:22", true},
+		{"bracketed v6 CIDR", []string{"[2001:db8::/32]"}, nil, "[2001:db8::1]:443", true},
+		{"outside v6 CIDR", []string{"[2001:db8::/32]"}, nil, "[2001:db9::1]:443", false},
+		{"unbracketed v6 CIDR", []string{"2001:db8::/32"}, nil, "[2001:db8::1]:443", true},
+		{"bracketed v6 address and port", []string{"[2001:db8::1]:443"}, nil, "[2001:db8::1]:443", true},
+		{"bracketed v6 address, other port", []string{"[2001:db8::1]:443"}, nil, "[2001:db8::1]:80", false},
+		{"v4 CIDR, v6 target", []string{"10.0.0.0/8"}, nil, "[::ffff:a00:1]:80", true},
+		{"host glob", []string{"*.example.com"}, nil, "www.example.com:443", true},
+		{"host glob, case and trailing dot", []string{"*.example.com"}, nil, "WWW.Example.COM.:443", true},
+		{"host glob, bare domain", []string{"*.example.com"}, nil, "example.com:443", false},
+		{"host glob, IP target", []string{"*.example.com"}, nil, "192.0.2.1:443", false},
+		{"wildcard host, IP target", []string{"*:443"}, nil, "192.0.2.1:443", true},
+		{"port glob", []string{"*:80*"}, nil, "example.com:8080", true},
+		{"port glob, other port", []string{"*:80*"}, nil, "example.com:443", false},
+		{"host and port", []string{"example.com:443"}, nil, "example.com:443", true},
+		{"host, other port", []string{"example.com:443"}, nil, "example.com:22", false},
+		{"deny rule", nil, []string{"10.0.0.0/8"}, "10.0.0.1:22", false},
+		{"outside deny rule", nil, []string{"10.0.0.0/8"}, "192.0.2.1:22", true},
+		{"deny over allow", []string{"*.example.com"}, []string{"secret.example.com"}, "secret.example.com:443", false},
+		{"allow beside deny", []string{"*.example.com"}, []string{"secret.example.com"}, "www.example.com:443", true},
+		{"deny port over allow", []string{"*"}, []string{"*:25"}, "mail.example.com:25", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := newACL(t, tc.allow, tc.deny).Check(tc.target)
+			if tc.allowed && err != nil {
+				t.Fatalf("Check(%q) = %v, want nil", tc.target, err)
+			}
+			if !tc.allowed && !errors.Is(err, ErrTargetDenied) {
+				t.Fatalf("Check(%q) = %v, want ErrTargetDenied", tc.target, err)
+			}
+		})
+	}
+}
+
+func TestTargetACLCheckDial(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		allow      []string
+		deny       []string
+		allowLocal bool
+		target     string
+		ip         string
+		allowed    bool
+	}{
+		{"remote address", nil, nil, false, "example.com:80", "192.0.2.1", true},
+		{"hostname resolving to loopback", nil, nil, false, "localhost:80", "127.0.0.1", false},
+		{"v6 loopback", nil, nil, false, "[::1]:80", "::1", false},
+		{"link-local metadata service", nil, nil, false, "metadata:80", "169.254.169.254", false},
+		{"unspecified address", nil, nil, false, "0.0.0.0:80", "0.0.0.0", false},
+		{"allow local", nil, nil, true, "localhost:80", "127.0.0.1", true},
+		{"allow local, v6", nil, nil, true, "[::1]:80", "::1", true},
+		{"allow rule naming the host", []string{"localhost"}, nil, false, "localhost:80", "127.0.0.1", true},
+		{"allow rule naming the range", []string{"127.0.0.0/8"}, nil, false, "127.0.0.1:80", "127.0.0.1", true},
+		{"allow rule naming another port", []string{"localhost:443"}, nil, false, "localhost:80", "127.0.0.1", false},
+		{"wildcard allow rule", []string{"*"}, nil, false, "localhost:80", "127.0.0.1", false},
+		{"all-covering allow rule", []string{"0.0.0.0/0"}, nil, false, "localhost:80", "127.0.0.1", false},
+		{"deny range of resolved address", nil, []string{"10.0.0.0/8"}, false, "intranet.example.com:80", "10.1.1.1", false},
+		{"deny v6 range and port", nil, []string{"[2001:db8::/32]:443"}, false, "v6.example.com:443", "2001:db8::1", false},
+		{"deny v6 range, other port", nil, []string{"[2001:db8::/32]:443"}, false, "v6.example.com:80", "2001:db8::1", true},
+		{"deny range over allow local", nil, []string{"127.0.0.0/8"}, true, "localhost:80", "127.0.0.1", false},
+		{"host deny rules left to Check", nil, []string{"*.example.com"}, false, "www.example.com:80", "192.0.2.1", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			acl := newACL(t, tc.allow, tc.deny)
+			acl.SetAllowLocal(tc.allowLocal)
+			err := acl.CheckDial(tc.target, net.ParseIP(tc.ip))
+			if tc.allowed && err != nil {
+				t.Fatalf("CheckDial(%q, %s) = %v, want nil", tc.target, tc.ip, err)
+			}
+			if !tc.allowed && !errors.Is(err, ErrTargetDenied) {
+				t.Fatalf("CheckDial(%q, %s) = %v, want ErrTargetDenied", tc.target, tc.ip, err)
+			}
+		})
+	}
+}
+
+// checkOnlyConnection dials s itself and checks that its connection is the
+// first s accepted. Connections are accepted in order, so one the proxy
+// made earlier would be accepted first.
+func checkOnlyConnection(t *testing.T, s *repeatServer, want int64) {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "z 1\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.accepted.Load(); n != want+1 {
+		t.Fatalf("upstream accepted %d connections from the proxy, want %d", n-1, want)
+	}
+}
+
+func TestDeniedTargetIsNeverDialed(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		host   string
+		rules  func(*TargetACL)
+		denied bool
+	}{
+		{"deny CIDR", "127.0.0.1", func(a *TargetACL) {
+			a.SetAllowLocal(true)
+			a.Deny("127.0.0.0/8")
+		}, true},
+		{"deny CIDR by hostname", "localhost", func(a *TargetACL) {
+			a.SetAllowLocal(true)
+			a.Deny("127.0.0.0/8")
+			a.Deny("::1/128")
+		}, true},
+		{"loopback address", "127.0.0.1", func(*TargetACL) {}, true},
+		{"hostname resolving to loopback", "localhost", func(*TargetACL) {}, true},
+		{"allow local", "localhost", func(a *TargetACL) { a.SetAllowLocal(true) }, false},
+		{"allow rule naming loopback", "127.0.0.1", func(a *TargetACL) { a.Allow("127.0.0.0/8") }, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			upstream := newRepeatServer(t)
+			acl := NewTargetACL()
+			tc.rules(acl)
+			sp := NewServerProxy()
+			sp.SetACL(acl)
+			h := newProxyHarness(t, sp)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+
+			port := strconv.Itoa(upstream.listener.Addr().(*net.TCPAddr).Port)
+			target := net.JoinHostPort(tc.host, port)
+			stream, err := h.Client.OpenStreamTo(ctx, target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stream.Close()
+			fmt.Fprintln(stream, "a 3")
+			reply, err := io.ReadAll(io.LimitReader(stream, 3))
+
+			if tc.denied {
+				if !errors.Is(err, ErrTargetDenied) {
+					t.Fatalf("got reply %q and error %v, want ErrTargetDenied", reply, err)
+				}
+				checkOnlyConnection(t, upstream, 0)
+				return
+			}
+			if err != nil || string(reply) != "aaa" {
+				t.Fatalf("got reply %q and error %v, want \"aaa\"", reply, err)
+			}
+			checkOnlyConnection(t, upstream, 1)
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// idleTimer invokes a callback once no activity has been recorded for the
+// configured timeout. Activity is recorded with a timestamp rather than by
+// resetting the timer, so the hot read/write path never touches the timer.
+type idleTimer struct {
+	timeout  time.Duration
+	onIdle   func()
+	lastSeen atomic.Int64
+	timer    *time.Timer
+
+	// mu is held while the callback runs, so stop waits for it
+	mu      sync.Mutex
+	stopped bool
+}
+
+func newIdleTimer(timeout time.Duration, onIdle func()) *idleTimer {
+	t := &idleTimer{
+		timeout: timeout,
+		onIdle:  onIdle,
+	}
+	t.touch()
+	t.timer = time.AfterFunc(timeout, t.fire)
+	return t
+}
+
+func (t *idleTimer) touch() {
+	t.lastSeen.Store(time.Now().UnixNano())
+}
+
+func (t *idleTimer) fire() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stopped {
+		return
+	}
+	idle := time.Since(time.Unix(0, t.lastSeen.Load()))
+	if idle < t.timeout {
+		t.timer.Reset(t.timeout - idle)
+		return
+	}
+	t.onIdle()
+}
+
+// stop cancels the timer. Once it returns the callback isn't running and
+// never will, so the connections it closes can be reused.
+func (t *idleTimer) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.stopped = true
+	t.timer.Stop()
+}
+
+// wrap returns rwc with every successful read and write recorded as activity.
+// The result supports half-close if rwc does.
+func (t *idleTimer) wrap(rwc io.ReadWriteCloser) io.ReadWriteCloser {
+	wrapped := &idleReadWriteCloser{ReadWriteCloser: rwc, timer: t}
+	if cw, ok := rwc.(closeWriter); ok {
+		return &idleHalfCloser{idleReadWriteCloser: wrapped, closeWriter: cw}
+	}
+	return wrapped
+}
+
+type idleReadWriteCloser struct {
+	io.ReadWriteCloser
+	timer *idleTimer
+}
+
+func (c *idleReadWriteCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	if n > 0 {
+		c.timer.touch()
+	}
+	return n, err
+}
+
+func (c *idleReadWriteCloser) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	if n > 0 {
+		c.timer.touch()
+	}
+	return n, err
+}
+
+// idleHalfCloser is an idleReadWriteCloser whose stream supports half-close
+type idleHalfCloser struct {
+	*idleReadWriteCloser
+	closeWriter
+}
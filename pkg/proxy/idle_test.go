@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIdleTimerNeverFiresAfterStop(t *testing.T) {
+	for i := 0; i < 200; i++ {
+		var stopped, late atomic.Bool
+		timer := newIdleTimer(time.Millisecond, func() {
+			if stopped.Load() {
+				late.Store(true)
+			}
+		})
+
+		// Activity makes the timer re-arm itself, which stop can race with
+		for deadline := time.Now().Add(time.Duration(i%5) * time.Millisecond); time.Now().Before(deadline); {
+			timer.touch()
+		}
+		timer.stop()
+		stopped.Store(true)
+
+		time.Sleep(3 * time.Millisecond)
+		if late.Load() {
+			t.Fatalf("iteration %d: callback ran after stop returned", i)
+		}
+	}
+}
+
+func TestIdleTimerFiresWhenIdle(t *testing.T) {
+	fired := make(chan struct{})
+	timer := newIdleTimer(10*time.Millisecond, func() { close(fired) })
+	defer timer.stop()
+
+	select {
+	case <-fired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle timer never fired")
+	}
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// quietWait is how long release waits for more data from an upstream
+// connection before deciding the upstream has nothing left to send
+const quietWait = time.Millisecond
+
+// upstreamPool keeps idle upstream connections for reuse by later streams
+// to the same target. Each idle connection is closed once it has gone
+// unused for the idle timeout.
+type upstreamPool struct {
+	maxIdle     int
+	idleTimeout time.Duration
+
+	mu   sync.Mutex
+	idle map[string][]*idleConn
+}
+
+type idleConn struct {
+	conn  net.Conn
+	timer *time.Timer
+}
+
+func newUpstreamPool(maxIdle int, idleTimeout time.Duration) *upstreamPool {
+	return &upstreamPool{
+		maxIdle:     maxIdle,
+		idleTimeout: idleTimeout,
+		idle:        make(map[string][]*idleConn),
+	}
+}
+
+// get returns the most recently used idle connection to target, or nil
+func (p *upstreamPool) get(target string) net.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conns := p.idle[target]
+	for len(conns) > 0 {
+		ic := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		// A timer that already fired is evicting the connection
+		if ic.timer.Stop() {
+			p.idle[target] = conns
+			return ic.conn
+		}
+	}
+
+	delete(p.idle, target)
+	return nil
+}
+
+// put offers conn for reuse, closing it if the target already has the
+// maximum number of idle connections
+func (p *upstreamPool) put(target string, conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.idle[target]) >= p.maxIdle {
+		conn.Close()
+		return
+	}
+
+	ic := &idleConn{conn: conn}
+	ic.timer = time.AfterFunc(p.idleTimeout, func() {
+		p.evict(target, ic)
+	})
+	p.idle[target] = append(p.idle[target], ic)
+}
+
+func (p *upstreamPool) evict(target string, ic *idleConn) {
+	p.mu.Lock()
+	conns := p.idle[target]
+	for i, c := range conns {
+		if c == ic {
+			p.idle[target] = append(conns[:i:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(p.idle[target]) == 0 {
+		delete(p.idle, target)
+	}
+	p.mu.Unlock()
+
+	ic.conn.Close()
+}
+
+// pooledConn is an upstream connection lent to one stream. Closing it only
+// interrupts pending I/O; release then returns the connection to the pool
+// if the stream left it between two exchanges, and closes it otherwise.
+type pooledConn struct {
+	net.Conn
+	// reading is set while a read waits for upstream data
+	reading  atomic.Bool
+	released atomic.Bool
+	// broken is set once the connection may hold data of this stream that
+	// the next one would see, or can't be used at all
+	broken atomic.Bool
+}
+
+func (c *pooledConn) Read(p []byte) (int, error) {
+	c.reading.Store(true)
+	n, err := c.Conn.Read(p)
+	c.reading.Store(false)
+
+	// Data read after Close never reaches the stream, and only the timeout
+	// set by Close leaves the connection usable
+	released := c.released.Load()
+	if n > 0 && released || err != nil && !(released && isTimeout(err)) {
+		c.broken.Store(true)
+	}
+	return n, err
+}
+
+func (c *pooledConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if err != nil {
+		// Part of p may have been sent
+		c.broken.Store(true)
+	}
+	return n, err
+}
+
+// Close unblocks pending reads and writes without closing the connection.
+// Unless a read was waiting for the upstream, the stream was closed while
+// being sent the upstream's data, and the rest would reach the next stream.
+func (c *pooledConn) Close() error {
+	if c.released.CompareAndSwap(false, true) {
+		c.Conn.SetDeadline(time.Now())
+		if !c.reading.Load() {
+			c.broken.Store(true)
+		}
+	}
+	return nil
+}
+
+// release returns the connection to pool once the stream is done with it,
+// if the stream ended cleanly and the upstream has nothing more to send,
+// and closes it otherwise
+func (c *pooledConn) release(pool *upstreamPool, target string, clean bool) {
+	c.Close()
+	if !clean || c.broken.Load() || !quiet(c.Conn) {
+		c.Conn.Close()
+		return
+	}
+	pool.put(target, c.Conn)
+}
+
+// quiet reports whether conn has no data waiting and none arrives within
+// quietWait, and clears its deadlines if so
+func quiet(conn net.Conn) bool {
+	if conn.SetReadDeadline(time.Now().Add(quietWait)) != nil {
+		return false
+	}
+	var b [1]byte
+	if n, err := conn.Read(b[:]); n > 0 || !isTimeout(err) {
+		return false
+	}
+	return conn.SetDeadline(time.Time{}) == nil
+}
+
+// isTimeout reports whether err is from a deadline passing
+func isTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/getlantern/lantern/slipstream/pkg/slipstreamtest"
+)
+
+// request asks the upstream for n copies of letter and returns the first
+// read bytes of the reply. If read is less than n the stream is abandoned
+// in the middle of the reply; otherwise it is ended cleanly.
+func request(t *testing.T, h *slipstreamtest.Harness, letter string, n, read int) []byte {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := h.OpenStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	if _, err := fmt.Fprintf(stream, "%s %d\n", letter, n); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, read)
+	if _, err := io.ReadFull(stream, reply); err != nil {
+		t.Fatalf("reading reply to %s: %v", letter, err)
+	}
+	if read < n {
+		return reply
+	}
+
+	if err := stream.(closeWriter).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if rest, err := io.ReadAll(stream); err != nil || len(rest) > 0 {
+		t.Fatalf("reply to %s continued with %d bytes, %v", letter, len(rest), err)
+	}
+	return reply
+}
+
+func (p *upstreamPool) idleCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := 0
+	for _, conns := range p.idle {
+		n += len(conns)
+	}
+	return n
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPoolIsolatesClients(t *testing.T) {
+	upstream := newRepeatServer(t)
+	sp := NewServerProxy(upstream.listener.Addr().String())
+	sp.SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	sp.SetPooling(4, time.Minute)
+
+	first := newProxyHarness(t, sp)
+	second := newProxyHarness(t, sp)
+
+	// A clean use leaves the connection for the next client
+	if got := request(t, first, "A", 10, 10); string(got) != "AAAAAAAAAA" {
+		t.Fatalf("first client got %q", got)
+	}
+	waitFor(t, "the connection to be pooled", func() bool { return sp.pool.idleCount() == 1 })
+
+	// The second client reuses it, and abandons it in the middle of a reply
+	// much larger than the tunnel buffers
+	got := request(t, second, "B", 4<<20, 10)
+	if string(got) != "BBBBBBBBBB" {
+		t.Fatalf("second client got %q", got)
+	}
+	if n := upstream.accepted.Load(); n != 1 {
+		t.Fatalf("second client used a new upstream connection; %d accepted", n)
+	}
+	waitFor(t, "the abandoned connection to be closed", func() bool { return upstream.closed.Load() == 1 })
+	if n := sp.pool.idleCount(); n != 0 {
+		t.Fatalf("abandoned connection was pooled; %d idle", n)
+	}
+
+	// Neither client sees the rest of that reply
+	for i, h := range []*slipstreamtest.Harness{first, second} {
+		letter := string(rune('C' + i))
+		got := request(t, h, letter, 1000, 1000)
+		if want := bytes.Repeat([]byte(letter), 1000); !bytes.Equal(got, want) {
+			t.Fatalf("client %d got another client's data: %.20q...", i+1, got)
+		}
+		waitFor(t, "the connection to be pooled", func() bool { return sp.pool.idleCount() == 1 })
+	}
+	if n := upstream.accepted.Load(); n != 2 {
+		t.Fatalf("got %d upstream connections, want 2", n)
+	}
+}
@@ -2,19 +2,42 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/getlantern/lantern/slipstream/pkg/transport"
+)
+
+const (
+	// DefaultDialTimeout bounds each attempt to connect to an upstream target
+	DefaultDialTimeout = 10 * time.Second
+	// DefaultIdleTimeout is how long a proxied connection may go without
+	// traffic in either direction before it is torn down, so connections
+	// whose peer vanished don't hold a stream forever
+	DefaultIdleTimeout = time.Minute
+
+	// dialRetryDelay is the pause before the first dial retry; it doubles
+	// with every further attempt
+	dialRetryDelay = 250 * time.Millisecond
 )
 
 // TCPProxy handles proxying TCP connections through QUIC streams
 type TCPProxy struct {
-	listenAddr string
-	client     StreamOpener
-	listener   net.Listener
-	wg         sync.WaitGroup
+	listenAddr  string
+	client      StreamOpener
+	listener    net.Listener
+	idleTimeout time.Duration
+	target      string
+	log         *slog.Logger
+	wg          sync.WaitGroup
+	stats       proxyCounters
 }
 
 // StreamOpener opens new streams for proxying
@@ -22,14 +45,40 @@ type StreamOpener interface {
 	OpenStream(ctx context.Context) (io.ReadWriteCloser, error)
 }
 
+// TargetStreamOpener opens new streams to a target chosen by the client
+type TargetStreamOpener interface {
+	OpenStreamTo(ctx context.Context, target string) (io.ReadWriteCloser, error)
+}
+
 // NewTCPProxy creates a new TCP proxy
 func NewTCPProxy(listenAddr string, client StreamOpener) *TCPProxy {
 	return &TCPProxy{
-		listenAddr: listenAddr,
-		client:     client,
+		listenAddr:  listenAddr,
+		client:      client,
+		idleTimeout: DefaultIdleTimeout,
+		log:         slog.Default(),
 	}
 }
 
+// SetLogger sets the logger the proxy reports to, instead of slog.Default().
+// Per-connection messages are logged at debug level.
+func (p *TCPProxy) SetLogger(logger *slog.Logger) {
+	p.log = logger
+}
+
+// SetIdleTimeout closes proxied connections after the given duration
+// without traffic in either direction. Zero disables the timeout.
+func (p *TCPProxy) SetIdleTimeout(timeout time.Duration) {
+	p.idleTimeout = timeout
+}
+
+// SetTarget makes the proxy ask the server to connect every stream to target
+// instead of the server's default. The client must implement
+// TargetStreamOpener.
+func (p *TCPProxy) SetTarget(target string) {
+	p.target = target
+}
+
 // Listen starts listening for TCP connections
 func (p *TCPProxy) Listen(ctx context.Context) error {
 	listener, err := net.Listen("tcp", p.listenAddr)
@@ -38,7 +87,7 @@ func (p *TCPProxy) Listen(ctx context.Context) error {
 	}
 	p.listener = listener
 
-	log.Printf("TCP proxy listening on %s", p.listenAddr)
+	p.log.Info("TCP proxy listening", "addr", p.listenAddr)
 
 	for {
 		conn, err := listener.Accept()
@@ -47,7 +96,7 @@ func (p *TCPProxy) Listen(ctx context.Context) error {
 			case <-ctx.Done():
 				return ctx.Err()
 			default:
-				log.Printf("Failed to accept TCP connection: %v", err)
+				p.log.Warn("Failed to accept TCP connection", "error", err)
 				continue
 			}
 		}
@@ -61,22 +110,57 @@ func (p *TCPProxy) handleConnection(ctx context.Context, conn net.Conn) {
 	defer p.wg.Done()
 	defer conn.Close()
 
-	log.Printf("New TCP connection from %s", conn.RemoteAddr())
+	logger := p.log.With("remote", conn.RemoteAddr())
+	logger.Debug("New TCP connection")
 
 	// Open QUIC stream for this connection
-	stream, err := p.client.OpenStream(ctx)
+	stream, err := p.openStream(ctx)
 	if err != nil {
-		log.Printf("Failed to open stream: %v", err)
+		logger.Warn("Failed to open stream", "error", err)
 		return
 	}
+	proxyConn(ctx, logger, conn, stream, p.idleTimeout, &p.stats)
+}
+
+// proxyConn copies data between conn and stream in both directions until
+// both finish, then closes stream. Both are closed once idleTimeout passes
+// without traffic, unless it is zero.
+func proxyConn(ctx context.Context, logger *slog.Logger, conn net.Conn, stream io.ReadWriteCloser, idleTimeout time.Duration, stats *proxyCounters) {
 	defer stream.Close()
+	defer stats.open()()
+	stream = stats.wrap(stream)
+
+	var local io.ReadWriteCloser = conn
+	if idleTimeout > 0 {
+		idle := newIdleTimer(idleTimeout, func() {
+			logger.Debug("Closing idle connection")
+			conn.Close()
+			stream.Close()
+		})
+		defer idle.stop()
+		local, stream = idle.wrap(conn), idle.wrap(stream)
+	}
 
 	// Proxy data bidirectionally
-	if err := BiDirectionalCopy(conn, stream); err != nil {
-		log.Printf("Proxy error: %v", err)
+	sent, received, err := BiDirectionalCopyN(ctx, local, stream)
+	if err != nil && !transport.IsClosed(err) {
+		logger.Debug("Proxying failed", "side", failedSide(err, "local", "tunnel"), "error", err)
+	}
+
+	logger.Debug("Connection closed", "sent", sent, "received", received)
+}
+
+// openStream opens a stream to the configured target, if any
+func (p *TCPProxy) openStream(ctx context.Context) (io.ReadWriteCloser, error) {
+	if p.target == "" {
+		return p.client.OpenStream(ctx)
 	}
 
-	log.Printf("Connection closed: %s", conn.RemoteAddr())
+	opener, ok := p.client.(TargetStreamOpener)
+	if !ok {
+		return nil, fmt.Errorf("client cannot open streams to target %s", p.target)
+	}
+	return opener.OpenStreamTo(ctx, p.target)
 }
 
 // Close closes the TCP proxy
@@ -88,62 +172,528 @@ func (p *TCPProxy) Close() error {
 	return nil
 }
 
+// Stats returns a snapshot of the proxy's traffic
+func (p *TCPProxy) Stats() Stats {
+	return p.stats.snapshot()
+}
+
+// TargetPolicy selects the order a ServerProxy tries its default targets in
+type TargetPolicy int
+
+const (
+	// TargetFailover tries the targets in the order given, so later ones
+	// only take streams while earlier ones fail
+	TargetFailover TargetPolicy = iota
+	// TargetRoundRobin starts every stream at the target after the one the
+	// previous stream started at, spreading streams across all of them
+	TargetRoundRobin
+)
+
+// ParseTargetPolicy parses a target policy name: "failover" or
+// "round-robin"
+func ParseTargetPolicy(name string) (TargetPolicy, error) {
+	switch name {
+	case "failover":
+		return TargetFailover, nil
+	case "round-robin":
+		return TargetRoundRobin, nil
+	}
+	return 0, fmt.Errorf("unknown target policy %q", name)
+}
+
 // ServerProxy handles server-side proxying to upstream targets
 type ServerProxy struct {
-	targetAddr string
+	targets     []string
+	policy      TargetPolicy
+	nextTarget  atomic.Uint64
+	acl         *TargetACL
+	idleTimeout time.Duration
+	dialTimeout time.Duration
+	dialRetries int
+	pool        *upstreamPool
+	proxyProto  bool
+	log         *slog.Logger
+	stats       proxyCounters
 }
 
-// NewServerProxy creates a new server-side proxy
-func NewServerProxy(targetAddr string) *ServerProxy {
+// NewServerProxy creates a new server-side proxy. Each target is a TCP
+// host:port or a URL such as "unix:///run/app.sock"; see ParseTarget. They
+// are the defaults for streams whose client did not name a target, tried in
+// turn until one connects; see SetTargetPolicy. Empty targets are ignored,
+// and with none clients must name a target.
+func NewServerProxy(targetAddrs ...string) *ServerProxy {
+	var targets []string
+	for _, target := range targetAddrs {
+		if target != "" {
+			targets = append(targets, target)
+		}
+	}
 	return &ServerProxy{
-		targetAddr: targetAddr,
+		targets:     targets,
+		acl:         NewTargetACL(),
+		idleTimeout: DefaultIdleTimeout,
+		dialTimeout: DefaultDialTimeout,
+		log:         slog.Default(),
 	}
 }
 
-// HandleStream handles a QUIC stream by connecting to the target
+// SetLogger sets the logger the proxy reports to, instead of slog.Default().
+// Per-stream messages are logged at debug level.
+func (sp *ServerProxy) SetLogger(logger *slog.Logger) {
+	sp.log = logger
+}
+
+// SetDialTimeout bounds each attempt to connect to the target. Zero means
+// no timeout beyond the operating system's.
+func (sp *ServerProxy) SetDialTimeout(timeout time.Duration) {
+	sp.dialTimeout = timeout
+}
+
+// SetDialRetries sets how many more times a failed connection to the target
+// is attempted, with exponential backoff, before the stream is rejected
+func (sp *ServerProxy) SetDialRetries(retries int) {
+	sp.dialRetries = retries
+}
+
+// SetProxyProtocol makes the proxy send a PROXY protocol v2 header at the
+// start of every upstream connection, carrying the client's address from
+// the QUIC connection. The upstream must be configured to expect it. Since
+// the header describes a single client, upstream connections are not pooled
+// while it is enabled.
+func (sp *ServerProxy) SetProxyProtocol(enabled bool) {
+	sp.proxyProto = enabled
+}
+
+// SetTargetPolicy sets the order the default targets are tried in. The
+// default is TargetFailover.
+func (sp *ServerProxy) SetTargetPolicy(policy TargetPolicy) {
+	sp.policy = policy
+}
+
+// SetACL restricts the targets the proxy may connect to. By default only
+// local addresses named by clients are refused; see TargetACL. A nil ACL
+// permits every target.
+func (sp *ServerProxy) SetACL(acl *TargetACL) {
+	sp.acl = acl
+}
+
+// SetIdleTimeout closes proxied streams after the given duration without
+// traffic in either direction. Zero disables the timeout.
+func (sp *ServerProxy) SetIdleTimeout(timeout time.Duration) {
+	sp.idleTimeout = timeout
+}
+
+// SetPooling enables reuse of upstream connections: when a stream finishes
+// cleanly its connection is kept, up to maxIdle per target, and handed to
+// the next stream to the same target. A connection is only kept if the
+// stream ended while the upstream was silent, having delivered all its
+// data, so a stream closed in the middle of a response closes its
+// connection. Idle connections are closed after idleTimeout. Only enable
+// this for protocols where a connection can be reused by an unrelated
+// client, such as HTTP/1.1 keep-alive. A maxIdle of zero disables pooling.
+func (sp *ServerProxy) SetPooling(maxIdle int, idleTimeout time.Duration) {
+	if maxIdle <= 0 {
+		sp.pool = nil
+		return
+	}
+	sp.pool = newUpstreamPool(maxIdle, idleTimeout)
+}
+
+// HandleStream handles a QUIC stream by connecting to the target named in
+// its prologue, or to the first default target that connects if the client
+// did not name one. Clients may name TCP and UDP targets. For UDP targets
+// the stream carries datagrams, each preceded by its length as a 2-byte
+// big-endian integer.
 func (sp *ServerProxy) HandleStream(ctx context.Context, stream io.ReadWriteCloser) error {
 	defer stream.Close()
 
-	// Connect to upstream target
-	conn, err := net.Dial("tcp", sp.targetAddr)
+	targets, clientTarget := sp.defaultTargets(), false
+	if ts, ok := stream.(transport.TargetStream); ok && ts.Target() != "" {
+		targets, clientTarget = []string{ts.Target()}, true
+	}
+
+	if len(targets) == 0 {
+		return sp.reject(stream, fmt.Errorf("%w: no target requested and no default target configured", ErrTargetDenied))
+	}
+
+	logger := sp.log
+	info, hasInfo := stream.(transport.StreamInfo)
+	if hasInfo {
+		logger = logger.With("remote", info.RemoteAddr(), "conn", info.ConnID(), "stream", info.StreamID())
+	}
+
+	// Connect to the first target that accepts
+	var targetAddr, network string
+	var conn net.Conn
+	var release func(clean bool)
+	var err error
+	for i, target := range targets {
+		targetAddr = target
+		network, conn, release, err = sp.connect(ctx, target, clientTarget)
+		if err == nil {
+			break
+		}
+		if errors.Is(err, ErrTargetDenied) {
+			logger.Warn("Rejected stream", "target", target, "error", err)
+		}
+		if i < len(targets)-1 {
+			logger.Debug("Target failed, trying the next one", "target", target, "error", err)
+		}
+	}
 	if err != nil {
-		return fmt.Errorf("failed to connect to target %s: %w", sp.targetAddr, err)
+		return sp.reject(stream, err)
 	}
-	defer conn.Close()
+	clean := false
+	defer func() { release(clean) }()
+	logger = logger.With("target", targetAddr)
 
-	log.Printf("Proxying to %s", sp.targetAddr)
+	// PROXY protocol headers are only sent on stream connections
+	if sp.proxyProto && !isUDP(network) {
+		var header []byte
+		if hasInfo {
+			header = proxyHeader(info.RemoteAddr(), info.LocalAddr())
+		} else {
+			header = proxyHeader(nil, nil)
+		}
+		if _, err := conn.Write(header); err != nil {
+			return fmt.Errorf("failed to send PROXY protocol header: %w", err)
+		}
+	}
+
+	logger.Debug("Proxying stream")
+	defer sp.stats.open()()
+	stream = sp.stats.wrap(stream)
+
+	var upstream io.ReadWriteCloser = conn
+	if sp.idleTimeout > 0 {
+		idle := newIdleTimer(sp.idleTimeout, func() {
+			logger.Debug("Closing idle stream")
+			conn.Close()
+			stream.Close()
+		})
+		defer idle.stop()
+		stream, upstream = idle.wrap(stream), idle.wrap(conn)
+	}
 
 	// Proxy data bidirectionally
-	if err := BiDirectionalCopy(stream, conn); err != nil {
-		return fmt.Errorf("proxy error: %w", err)
+	copyFunc := BiDirectionalCopyN
+	if isUDP(network) {
+		copyFunc = relayDatagrams
+	}
+	sent, received, err := copyFunc(ctx, upstream, stream)
+	logger.Debug("Stream finished", "sent", sent, "received", received)
+	clean = err == nil
+	if err != nil {
+		if side := failedSide(err, "target", "tunnel"); side != "" {
+			return fmt.Errorf("proxying to %s failed on the %s side: %w", targetAddr, side, err)
+		}
+		return fmt.Errorf("proxying to %s: %w", targetAddr, err)
 	}
 
 	return nil
 }
 
+// failedSide names the side of a BiDirectionalCopyN between a and b whose
+// failure err reports, or returns "" if err isn't a *CopyError
+func failedSide(err error, a, b string) string {
+	var copyErr *CopyError
+	if !errors.As(err, &copyErr) {
+		return ""
+	}
+	if copyErr.FailedA() {
+		return a
+	}
+	return b
+}
+
+// defaultTargets returns the default targets in the order the policy tries
+// them for the next stream
+func (sp *ServerProxy) defaultTargets() []string {
+	if sp.policy != TargetRoundRobin || len(sp.targets) < 2 {
+		return sp.targets
+	}
+
+	start := int((sp.nextTarget.Add(1) - 1) % uint64(len(sp.targets)))
+	targets := make([]string, 0, len(sp.targets))
+	targets = append(targets, sp.targets[start:]...)
+	return append(targets, sp.targets[:start]...)
+}
+
+// connect connects to targetAddr, named by the client if clientTarget is
+// set, after checking it against the ACL. It returns the target's network
+// and the connection with its release function, as from dialUpstream.
+func (sp *ServerProxy) connect(ctx context.Context, targetAddr string, clientTarget bool) (string, net.Conn, func(bool), error) {
+	network, address, err := ParseTarget(targetAddr)
+	if err == nil && clientTarget && network == "unix" {
+		err = errors.New("clients may not name UNIX socket targets")
+	}
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("%w: %s: %v", ErrTargetDenied, targetAddr, err)
+	}
+
+	// The ACL only covers network targets; UNIX sockets can only be the
+	// operator's configured target
+	if sp.acl != nil && network != "unix" {
+		if err := sp.acl.Check(address); err != nil {
+			return "", nil, nil, err
+		}
+	}
+
+	// Targets named by clients are checked again once resolved, so
+	// hostnames can't lead to addresses the ACL refuses
+	var checkDial func(net.IP) error
+	if sp.acl != nil && clientTarget && network != "unix" {
+		checkDial = func(ip net.IP) error { return sp.acl.CheckDial(address, ip) }
+	}
+
+	conn, release, err := sp.dialUpstream(ctx, network, address, checkDial)
+	if errors.Is(err, ErrTargetDenied) {
+		return "", nil, nil, err
+	}
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("%w: %s: %w", transport.ErrTargetUnreachable, targetAddr, err)
+	}
+	return network, conn, release, nil
+}
+
+// Stats returns a snapshot of the traffic of the streams the proxy has
+// connected to their targets
+func (sp *ServerProxy) Stats() Stats {
+	return sp.stats.snapshot()
+}
+
+// dialUpstream connects to address on network, reusing a pooled connection
+// if pooling is enabled. If check is given, it must accept the IP address
+// of the connection, pooled or new. The returned function must be called
+// once the stream is done with the connection, reporting whether the stream
+// ended cleanly; it closes the connection or returns it to the pool.
+func (sp *ServerProxy) dialUpstream(ctx context.Context, network, address string, check func(net.IP) error) (net.Conn, func(bool), error) {
+	pool := sp.pool
+	if pool == nil || sp.proxyProto || isUDP(network) {
+		conn, err := sp.dial(ctx, network, address, check)
+		if err != nil {
+			return nil, nil, err
+		}
+		return conn, func(bool) { conn.Close() }, nil
+	}
+
+	target := network + "://" + address
+	conn := pool.get(target)
+	if conn != nil && check != nil {
+		// The pooled connection may have been made for the default target,
+		// which isn't checked
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			if err := check(addr.IP); err != nil {
+				pool.put(target, conn)
+				return nil, nil, err
+			}
+		}
+	}
+	if conn == nil {
+		var err error
+		if conn, err = sp.dial(ctx, network, address, check); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	pc := &pooledConn{Conn: conn}
+	return pc, func(clean bool) { pc.release(pool, target, clean) }, nil
+}
+
+// dial connects to address on network, retrying failed attempts with
+// exponential backoff. If check is given, every address the target resolves
+// to is passed to it before connecting, and refused addresses aren't dialed.
+func (sp *ServerProxy) dial(ctx context.Context, network, address string, check func(net.IP) error) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: sp.dialTimeout}
+	if check != nil {
+		dialer.Control = func(_, resolved string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(resolved)
+			if err != nil {
+				return err
+			}
+			return check(net.ParseIP(host))
+		}
+	}
+	delay := dialRetryDelay
+
+	for attempt := 0; ; attempt++ {
+		conn, err := dialer.DialContext(ctx, network, address)
+		var opErr *net.OpError
+		if errors.Is(err, ErrTargetDenied) && errors.As(err, &opErr) {
+			// Nothing was dialed, so the dial error adds nothing
+			return nil, opErr.Err
+		}
+		if err == nil || attempt >= sp.dialRetries {
+			return conn, err
+		}
+
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
+}
+
+// reject reports err to the client if the stream supports it, and returns
+// err for the caller to return from HandleStream
+func (sp *ServerProxy) reject(stream io.ReadWriteCloser, err error) error {
+	if r, ok := stream.(transport.StreamRejecter); ok {
+		if rerr := r.Reject(err); rerr != nil {
+			sp.log.Debug("Failed to reject stream", "error", rerr)
+		}
+	}
+	return err
+}
+
+// CopyError is returned by BiDirectionalCopy and BiDirectionalCopyN when a
+// copy fails, saying which one did and on which side
+type CopyError struct {
+	// AToB is set if the copy from a to b failed, and unset for b to a
+	AToB bool
+	// Read is set if reading from the source failed, and unset if writing
+	// to the destination did
+	Read bool
+	Err  error
+}
+
+func (e *CopyError) Error() string {
+	dir, op := "b to a", "write"
+	if e.AToB {
+		dir = "a to b"
+	}
+	if e.Read {
+		op = "read"
+	}
+	return fmt.Sprintf("copy %s: %s failed: %v", dir, op, e.Err)
+}
+
+func (e *CopyError) Unwrap() error {
+	return e.Err
+}
+
+// FailedA reports whether a, rather than b, is the side whose read or
+// write failed
+func (e *CopyError) FailedA() bool {
+	return e.AToB == e.Read
+}
+
+// sourceReader records whether reads from the source of a copy failed
+type sourceReader struct {
+	io.Reader
+	failed bool
+}
+
+func (r *sourceReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.failed = true
+	}
+	return n, err
+}
+
 // BiDirectionalCopy copies data bidirectionally between two ReadWriteClosers
-func BiDirectionalCopy(a, b io.ReadWriteCloser) error {
-	errChan := make(chan error, 2)
+func BiDirectionalCopy(ctx context.Context, a, b io.ReadWriteCloser) error {
+	_, _, err := BiDirectionalCopyN(ctx, a, b)
+	return err
+}
+
+// closeWriter is implemented by connections that support half-close, such as
+// *net.TCPConn and tunnel streams
+type closeWriter interface {
+	CloseWrite() error
+}
 
-	copy := func(dst io.Writer, src io.Reader) {
-		_, err := io.Copy(dst, src)
-		errChan <- err
+// BiDirectionalCopyN copies data bidirectionally between two ReadWriteClosers
+// and reports the number of bytes copied in each direction. When one
+// direction reaches EOF, its destination's sending side is closed with
+// CloseWrite if it supports half-close, and the other direction keeps
+// copying until it finishes too, so a peer can still reply after the other
+// has finished sending. Otherwise, or on any error or once ctx is cancelled,
+// both endpoints are closed so the other copy unblocks. It always waits for
+// both copies before returning. A failed copy is reported as a *CopyError.
+func BiDirectionalCopyN(ctx context.Context, a, b io.ReadWriteCloser) (aToB int64, bToA int64, err error) {
+	return biDirectionalCopy(ctx, a, b, 0)
+}
+
+// biDirectionalCopy implements BiDirectionalCopyN, copying through buffers of
+// bufSize bytes, or io.Copy's default size if bufSize is zero
+func biDirectionalCopy(ctx context.Context, a, b io.ReadWriteCloser, bufSize int) (aToB int64, bToA int64, err error) {
+	type result struct {
+		aToB bool
+		n    int64
+		err  error
+		// halfClosed is set when src reached EOF and dst's sending side
+		// was closed, leaving the other direction running
+		halfClosed bool
 	}
+	results := make(chan result, 2)
 
-	go copy(a, b)
-	go copy(b, a)
+	copy := func(dst io.Writer, src io.Reader, isAToB bool) {
+		var buf []byte
+		if bufSize > 0 {
+			buf = make([]byte, bufSize)
+		}
+		source := &sourceReader{Reader: src}
+		n, err := io.CopyBuffer(dst, source, buf)
+		if err != nil {
+			err = &CopyError{AToB: isAToB, Read: source.failed, Err: err}
+		}
+		halfClosed := false
+		if cw, ok := dst.(closeWriter); ok && err == nil {
+			halfClosed = cw.CloseWrite() == nil
+		}
+		results <- result{isAToB, n, err, halfClosed}
+	}
 
-	// Wait for first error (or EOF)
-	err1 := <-errChan
-	err2 := <-errChan
+	go copy(b, a, true)
+	go copy(a, b, false)
 
-	// Return first non-EOF error
-	if err1 != nil && err1 != io.EOF {
-		return err1
+	var closeOnce sync.Once
+	closeBoth := func() {
+		closeOnce.Do(func() {
+			a.Close()
+			b.Close()
+		})
 	}
-	if err2 != nil && err2 != io.EOF {
-		return err2
+
+	wait := func() result {
+		select {
+		case r := <-results:
+			return r
+		case <-ctx.Done():
+			closeBoth()
+			if err == nil {
+				err = ctx.Err()
+			}
+			return <-results
+		}
 	}
 
-	return nil
+	first := wait()
+	if !first.halfClosed {
+		closeBoth()
+	}
+	second := wait()
+	closeBoth()
+
+	for _, r := range []result{first, second} {
+		if r.aToB {
+			aToB = r.n
+		} else {
+			bToA = r.n
+		}
+	}
+
+	// Unless the first copy half-closed, the second was interrupted by
+	// closeBoth, so only the first result says why the session ended
+	if err == nil && !errors.Is(first.err, io.EOF) {
+		err = first.err
+	}
+	if err == nil && first.halfClosed && !errors.Is(second.err, io.EOF) {
+		err = second.err
+	}
+
+	return aToB, bToA, err
 }
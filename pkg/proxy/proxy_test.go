@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/lantern/slipstream/pkg/slipstreamtest"
+	"github.com/getlantern/lantern/slipstream/pkg/transport"
+)
+
+// failingConn fails every read and discards writes
+type failingConn struct {
+	err error
+}
+
+func (c failingConn) Read([]byte) (int, error)    { return 0, c.err }
+func (c failingConn) Write(p []byte) (int, error) { return len(p), nil }
+func (c failingConn) Close() error                { return nil }
+
+func TestBiDirectionalCopyDoesNotLeakOnError(t *testing.T) {
+	readErr := errors.New("read failed")
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 100; i++ {
+		// The peer of stalled never writes or closes, so only closing
+		// stalled ends the copy reading from it
+		stalled, peer := net.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			done <- BiDirectionalCopy(context.Background(), failingConn{readErr}, stalled)
+		}()
+
+		select {
+		case err := <-done:
+			if !errors.Is(err, readErr) {
+				t.Fatalf("got error %v, want %v", err, readErr)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("BiDirectionalCopy did not return after one side failed")
+		}
+		peer.Close()
+	}
+
+	// Allow exiting goroutines to finish
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines before copying, %d after", before, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// repeatServer answers each request line "<letter> <n>" with n copies of
+// letter, on connections it keeps open between requests
+type repeatServer struct {
+	listener net.Listener
+	accepted atomic.Int64
+	closed   atomic.Int64
+}
+
+func newRepeatServer(t *testing.T) *repeatServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &repeatServer{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.accepted.Add(1)
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *repeatServer) serve(conn net.Conn) {
+	defer s.closed.Add(1)
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	for {
+		var letter string
+		var n int
+		if _, err := fmt.Fscanln(r, &letter, &n); err != nil {
+			return
+		}
+		if _, err := conn.Write(bytes.Repeat([]byte(letter), n)); err != nil {
+			return
+		}
+	}
+}
+
+// newProxyHarness starts a client connected to a server that hands its
+// streams to sp
+func newProxyHarness(t *testing.T, sp *ServerProxy) *slipstreamtest.Harness {
+	t.Helper()
+	h, err := slipstreamtest.New(sp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+// replyAfterEOF reads each connection to EOF, then replies with a response
+// many messages long, a byte for every byte read repeated 1000 times
+func replyAfterEOF(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				request, err := io.ReadAll(conn)
+				if err != nil {
+					return
+				}
+				for _, b := range request {
+					if _, err := conn.Write(bytes.Repeat([]byte{b}, 1000)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestHalfCloseKeepsResponse(t *testing.T) {
+	h := newProxyHarness(t, NewServerProxy(replyAfterEOF(t)))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	stream, err := h.OpenStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	request := []byte("half-closed request")
+	if _, err := stream.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatalf("read failed after %d bytes: %v", len(got), err)
+	}
+	var want []byte
+	for _, b := range request {
+		want = append(want, bytes.Repeat([]byte{b}, 1000)...)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %d bytes of response, want %d", len(got), len(want))
+	}
+}
+
+// downAddr returns an address nothing listens on
+func downAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+func TestTargetFailover(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		targets func(up string) []string
+		up      bool
+	}{
+		{"all down", func(string) []string { return []string{downAddr(t), downAddr(t)} }, false},
+		{"first down", func(up string) []string { return []string{downAddr(t), up} }, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			upstream := newRepeatServer(t)
+			sp := NewServerProxy(tc.targets(upstream.listener.Addr().String())...)
+			sp.SetDialTimeout(time.Second)
+			sp.SetDialRetries(1)
+			h := newProxyHarness(t, sp)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			stream, err := h.OpenStream(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stream.Close()
+			fmt.Fprintln(stream, "a 3")
+			reply, err := io.ReadAll(io.LimitReader(stream, 3))
+
+			if !tc.up {
+				if !errors.Is(err, transport.ErrTargetUnreachable) {
+					t.Fatalf("got reply %q and error %v, want ErrTargetUnreachable", reply, err)
+				}
+				return
+			}
+			if err != nil || string(reply) != "aaa" {
+				t.Fatalf("got reply %q and error %v, want \"aaa\"", reply, err)
+			}
+		})
+	}
+}
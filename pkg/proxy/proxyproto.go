@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// proxyV2Signature starts every PROXY protocol version 2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyV2Local = 0x20 // version 2, LOCAL command
+	proxyV2Proxy = 0x21 // version 2, PROXY command
+
+	proxyV2TCP4 = 0x11 // TCP over IPv4
+	proxyV2TCP6 = 0x21 // TCP over IPv6
+)
+
+// proxyHeader builds a PROXY protocol v2 header announcing a TCP connection
+// from src to dst. If either address is not an IP address, it builds a LOCAL
+// header, which tells the upstream to use the connection's own addresses.
+func proxyHeader(src, dst net.Addr) []byte {
+	header := append([]byte(nil), proxyV2Signature...)
+
+	srcIP, srcPort, ok1 := addrIPPort(src)
+	dstIP, dstPort, ok2 := addrIPPort(dst)
+	if !ok1 || !ok2 {
+		return append(header, proxyV2Local, 0, 0, 0)
+	}
+
+	family := byte(proxyV2TCP6)
+	src4, dst4 := srcIP.To4(), dstIP.To4()
+	if src4 != nil && dst4 != nil {
+		family, srcIP, dstIP = proxyV2TCP4, src4, dst4
+	} else {
+		srcIP, dstIP = srcIP.To16(), dstIP.To16()
+	}
+
+	header = append(header, proxyV2Proxy, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(2*len(srcIP)+4))
+	header = append(header, srcIP...)
+	header = append(header, dstIP...)
+	header = binary.BigEndian.AppendUint16(header, srcPort)
+	header = binary.BigEndian.AppendUint16(header, dstPort)
+	return header
+}
+
+func addrIPPort(addr net.Addr) (net.IP, uint16, bool) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, uint16(a.Port), a.IP != nil
+	case *net.TCPAddr:
+		return a.IP, uint16(a.Port), a.IP != nil
+	default:
+		return nil, 0, false
+	}
+}
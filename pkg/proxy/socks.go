@@ -0,0 +1,505 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/getlantern/lantern/slipstream/pkg/transport"
+)
+
+// SOCKS5 protocol constants (RFC 1928)
+const (
+	socksVersion = 5
+
+	socksMethodNoAuth       byte = 0x00
+	socksMethodNoAcceptable byte = 0xFF
+
+	socksCmdConnect      byte = 0x01
+	socksCmdUDPAssociate byte = 0x03
+
+	socksAddrIPv4   byte = 0x01
+	socksAddrDomain byte = 0x03
+	socksAddrIPv6   byte = 0x04
+
+	socksReplySucceeded        byte = 0x00
+	socksReplyGeneralFailure   byte = 0x01
+	socksReplyNotAllowed       byte = 0x02
+	socksReplyHostUnreachable  byte = 0x04
+	socksReplyCmdNotSupported  byte = 0x07
+	socksReplyAddrNotSupported byte = 0x08
+
+	// socksUDPHeaderSize is the size of the reserved and fragment fields
+	// ahead of the address of a relayed datagram
+	socksUDPHeaderSize = 3
+)
+
+// socksHandshakeTimeout bounds the handshake of a new SOCKS5 connection
+const socksHandshakeTimeout = 30 * time.Second
+
+var errSOCKSAddrType = errors.New("unsupported SOCKS address type")
+
+// SOCKS5Proxy accepts SOCKS5 connections and tunnels each to the
+// destination the client asks for, so one client can reach any number of
+// hosts. CONNECT requests get a stream to the destination, and UDP
+// ASSOCIATE requests a relay whose datagrams get a stream per destination.
+// Only the no-authentication method is offered, so the proxy should listen
+// on a local address.
+//
+// The server reports a target it can't reach by closing the stream, after
+// the proxy has already replied that the connection succeeded, since the
+// target's first data may depend on the client's.
+type SOCKS5Proxy struct {
+	listenAddr  string
+	client      TargetStreamOpener
+	listener    net.Listener
+	idleTimeout time.Duration
+	log         *slog.Logger
+	wg          sync.WaitGroup
+	stats       proxyCounters
+}
+
+// NewSOCKS5Proxy creates a new SOCKS5 proxy
+func NewSOCKS5Proxy(listenAddr string, client TargetStreamOpener) *SOCKS5Proxy {
+	return &SOCKS5Proxy{
+		listenAddr:  listenAddr,
+		client:      client,
+		idleTimeout: DefaultIdleTimeout,
+		log:         slog.Default(),
+	}
+}
+
+// SetLogger sets the logger the proxy reports to, instead of slog.Default().
+// Per-connection messages are logged at debug level.
+func (p *SOCKS5Proxy) SetLogger(logger *slog.Logger) {
+	p.log = logger
+}
+
+// SetIdleTimeout closes proxied connections, and the streams of UDP
+// associations, after the given duration without traffic. Zero disables the
+// timeout for connections; UDP streams then use DefaultUDPIdleTimeout.
+func (p *SOCKS5Proxy) SetIdleTimeout(timeout time.Duration) {
+	p.idleTimeout = timeout
+}
+
+// Listen starts listening for SOCKS5 connections
+func (p *SOCKS5Proxy) Listen(ctx context.Context) error {
+	listener, err := net.Listen("tcp", p.listenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to start SOCKS5 listener: %w", err)
+	}
+	p.listener = listener
+
+	p.log.Info("SOCKS5 proxy listening", "addr", p.listenAddr)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+				if errors.Is(err, net.ErrClosed) {
+					return nil
+				}
+				p.log.Warn("Failed to accept SOCKS5 connection", "error", err)
+				continue
+			}
+		}
+
+		p.wg.Add(1)
+		go p.handleConnection(ctx, conn)
+	}
+}
+
+func (p *SOCKS5Proxy) handleConnection(ctx context.Context, conn net.Conn) {
+	defer p.wg.Done()
+	defer conn.Close()
+
+	logger := p.log.With("remote", conn.RemoteAddr())
+
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	cmd, target, err := socksHandshake(conn)
+	if err != nil {
+		logger.Debug("SOCKS5 handshake failed", "error", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	logger = logger.With("target", target)
+
+	switch cmd {
+	case socksCmdConnect:
+		p.connect(ctx, logger, conn, target)
+	case socksCmdUDPAssociate:
+		p.associate(ctx, logger, conn)
+	default:
+		logger.Debug("Unsupported SOCKS5 command", "command", cmd)
+		writeSOCKSReply(conn, socksReplyCmdNotSupported, nil)
+	}
+}
+
+// connect serves a CONNECT request by proxying conn over a stream to target
+func (p *SOCKS5Proxy) connect(ctx context.Context, logger *slog.Logger, conn net.Conn, target string) {
+	logger.Debug("New SOCKS5 connection")
+
+	stream, err := p.client.OpenStreamTo(ctx, target)
+	if err != nil {
+		logger.Warn("Failed to open stream", "error", err)
+		writeSOCKSReply(conn, socksReplyCode(err), nil)
+		return
+	}
+	if err := writeSOCKSReply(conn, socksReplySucceeded, nil); err != nil {
+		stream.Close()
+		return
+	}
+
+	proxyConn(ctx, logger, conn, stream, p.idleTimeout, &p.stats)
+}
+
+// associate serves a UDP ASSOCIATE request with a relay on a new UDP socket,
+// which lasts as long as conn
+func (p *SOCKS5Proxy) associate(ctx context.Context, logger *slog.Logger, conn net.Conn) {
+	localIP := conn.LocalAddr().(*net.TCPAddr).IP
+	relayConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		logger.Warn("Failed to start UDP relay", "error", err)
+		writeSOCKSReply(conn, socksReplyGeneralFailure, nil)
+		return
+	}
+	if err := writeSOCKSReply(conn, socksReplySucceeded, relayConn.LocalAddr()); err != nil {
+		relayConn.Close()
+		return
+	}
+	logger.Debug("New SOCKS5 UDP association", "relay", relayConn.LocalAddr())
+
+	relay := &socksRelay{
+		proxy:    p,
+		conn:     relayConn,
+		clientIP: conn.RemoteAddr().(*net.TCPAddr).IP,
+		logger:   logger,
+		streams:  make(map[string]*udpSession),
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		relay.run(ctx)
+	}()
+
+	// The association ends when the client closes the control connection
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	io.Copy(io.Discard, conn)
+
+	relay.close()
+	<-done
+	logger.Debug("SOCKS5 UDP association closed")
+}
+
+// Close closes the SOCKS5 proxy
+func (p *SOCKS5Proxy) Close() error {
+	if p.listener != nil {
+		p.listener.Close()
+	}
+	p.wg.Wait()
+	return nil
+}
+
+// Stats returns a snapshot of the proxy's traffic. Each CONNECT and each
+// destination of a UDP association counts as a connection.
+func (p *SOCKS5Proxy) Stats() Stats {
+	return p.stats.snapshot()
+}
+
+// socksRelay forwards the datagrams of one UDP association, with a stream
+// per destination
+type socksRelay struct {
+	proxy    *SOCKS5Proxy
+	conn     *net.UDPConn
+	clientIP net.IP
+	logger   *slog.Logger
+
+	mu sync.Mutex
+	// clientAddr is where replies go: the source of the client's latest
+	// datagram
+	clientAddr net.Addr
+	streams    map[string]*udpSession
+	wg         sync.WaitGroup
+}
+
+// run forwards the client's datagrams until the relay is closed
+func (r *socksRelay) run(ctx context.Context) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				r.logger.Warn("Failed to read UDP datagram", "error", err)
+			}
+			break
+		}
+		// Only the client that made the association may use it
+		if !addr.IP.Equal(r.clientIP) {
+			continue
+		}
+
+		target, payload, err := parseSOCKSDatagram(buf[:n])
+		if err != nil {
+			r.logger.Debug("Dropped SOCKS5 datagram", "error", err)
+			continue
+		}
+
+		r.mu.Lock()
+		r.clientAddr = addr
+		r.mu.Unlock()
+
+		session, err := r.session(ctx, target)
+		if err != nil {
+			r.logger.Warn("Failed to open stream", "target", target, "error", err)
+			continue
+		}
+		if _, err := session.stream.Write(payload); err != nil {
+			r.logger.Debug("Failed to forward datagram", "target", target, "error", err)
+			session.stream.Close()
+		}
+	}
+	r.wg.Wait()
+}
+
+// session returns the stream to target, opening it if needed
+func (r *socksRelay) session(ctx context.Context, target string) (*udpSession, error) {
+	r.mu.Lock()
+	session := r.streams[target]
+	r.mu.Unlock()
+	if session != nil {
+		return session, nil
+	}
+
+	stream, err := r.proxy.client.OpenStreamTo(ctx, "udp://"+target)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := r.proxy.idleTimeout
+	if timeout <= 0 {
+		timeout = DefaultUDPIdleTimeout
+	}
+	session = &udpSession{}
+	session.idle = newIdleTimer(timeout, func() {
+		r.logger.Debug("Closing idle UDP stream", "target", target)
+		stream.Close()
+	})
+	session.stream = session.idle.wrap(r.proxy.stats.wrap(&transport.DatagramStream{ReadWriteCloser: stream}))
+
+	r.mu.Lock()
+	r.streams[target] = session
+	r.mu.Unlock()
+
+	r.wg.Add(1)
+	go r.forwardReplies(session, target)
+	return session, nil
+}
+
+// forwardReplies sends datagrams arriving on the stream to target back to
+// the client until the stream is closed
+func (r *socksRelay) forwardReplies(session *udpSession, target string) {
+	defer r.wg.Done()
+	defer r.proxy.stats.open()()
+	defer func() {
+		session.idle.stop()
+		session.stream.Close()
+
+		r.mu.Lock()
+		delete(r.streams, target)
+		r.mu.Unlock()
+	}()
+
+	header, err := socksAddr(target)
+	if err != nil {
+		return
+	}
+	header = append(make([]byte, socksUDPHeaderSize), header...)
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := session.stream.Read(buf)
+		if err != nil {
+			if err != io.EOF {
+				r.logger.Debug("UDP stream ended", "target", target, "error", err)
+			}
+			return
+		}
+
+		r.mu.Lock()
+		clientAddr := r.clientAddr
+		r.mu.Unlock()
+		if _, err := r.conn.WriteTo(append(header, buf[:n]...), clientAddr); err != nil {
+			r.logger.Debug("Failed to send datagram", "error", err)
+			return
+		}
+	}
+}
+
+// close stops the relay and closes its streams
+func (r *socksRelay) close() {
+	r.conn.Close()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, session := range r.streams {
+		session.stream.Close()
+	}
+}
+
+// socksHandshake negotiates the authentication method and reads the
+// client's request, returning its command and destination address
+func socksHandshake(conn io.ReadWriter) (byte, string, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return 0, "", fmt.Errorf("failed to read greeting: %w", err)
+	}
+	if header[0] != socksVersion {
+		return 0, "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return 0, "", fmt.Errorf("failed to read greeting: %w", err)
+	}
+	if bytes.IndexByte(methods, socksMethodNoAuth) < 0 {
+		conn.Write([]byte{socksVersion, socksMethodNoAcceptable})
+		return 0, "", fmt.Errorf("client requires authentication")
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksMethodNoAuth}); err != nil {
+		return 0, "", err
+	}
+
+	var request [3]byte
+	if _, err := io.ReadFull(conn, request[:]); err != nil {
+		return 0, "", fmt.Errorf("failed to read request: %w", err)
+	}
+	if request[0] != socksVersion {
+		return 0, "", fmt.Errorf("unsupported SOCKS version %d", request[0])
+	}
+	target, err := readSOCKSAddr(conn)
+	if err != nil {
+		if errors.Is(err, errSOCKSAddrType) {
+			writeSOCKSReply(conn, socksReplyAddrNotSupported, nil)
+		}
+		return 0, "", err
+	}
+	return request[1], target, nil
+}
+
+// readSOCKSAddr reads an address type, address and port as host:port
+func readSOCKSAddr(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", fmt.Errorf("failed to read address: %w", err)
+	}
+
+	var host []byte
+	switch atyp[0] {
+	case socksAddrIPv4:
+		host = make([]byte, net.IPv4len)
+	case socksAddrIPv6:
+		host = make([]byte, net.IPv6len)
+	case socksAddrDomain:
+		var length [1]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return "", fmt.Errorf("failed to read address: %w", err)
+		}
+		host = make([]byte, length[0])
+	default:
+		return "", fmt.Errorf("%w %d", errSOCKSAddrType, atyp[0])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, host); err != nil {
+		return "", fmt.Errorf("failed to read address: %w", err)
+	}
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", fmt.Errorf("failed to read address: %w", err)
+	}
+
+	hostname := string(host)
+	if atyp[0] != socksAddrDomain {
+		hostname = net.IP(host).String()
+	}
+	return net.JoinHostPort(hostname, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// socksAddr encodes the host:port address as an address type, address and
+// port
+func socksAddr(addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+
+	var b []byte
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name %q too long", host)
+		}
+		b = append([]byte{socksAddrDomain, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append([]byte{socksAddrIPv4}, ip4...)
+	} else {
+		b = append([]byte{socksAddrIPv6}, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// writeSOCKSReply sends the reply to a request, with the bound address addr
+// or 0.0.0.0:0 if addr is nil
+func writeSOCKSReply(w io.Writer, rep byte, addr net.Addr) error {
+	bound := []byte{socksAddrIPv4, 0, 0, 0, 0, 0, 0}
+	if addr != nil {
+		if b, err := socksAddr(addr.String()); err == nil {
+			bound = b
+		}
+	}
+	_, err := w.Write(append([]byte{socksVersion, rep, 0}, bound...))
+	return err
+}
+
+// socksReplyCode maps an error opening a stream to a reply code
+func socksReplyCode(err error) byte {
+	switch {
+	case errors.Is(err, transport.ErrTargetDenied):
+		return socksReplyNotAllowed
+	case errors.Is(err, transport.ErrTargetUnreachable):
+		return socksReplyHostUnreachable
+	default:
+		return socksReplyGeneralFailure
+	}
+}
+
+// parseSOCKSDatagram splits a datagram from the client into its destination
+// and payload. Fragmented datagrams are not supported.
+func parseSOCKSDatagram(datagram []byte) (string, []byte, error) {
+	if len(datagram) < socksUDPHeaderSize {
+		return "", nil, fmt.Errorf("datagram too short")
+	}
+	if datagram[2] != 0 {
+		return "", nil, fmt.Errorf("fragmented datagrams are not supported")
+	}
+
+	r := bytes.NewReader(datagram[socksUDPHeaderSize:])
+	target, err := readSOCKSAddr(r)
+	if err != nil {
+		return "", nil, err
+	}
+	return target, datagram[len(datagram)-r.Len():], nil
+}
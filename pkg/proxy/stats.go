@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// Stats is a snapshot of a proxy's traffic since it was created
+type Stats struct {
+	// Connections counts proxied connections, UDP sessions or streams;
+	// ActiveConnections those still open
+	Connections       uint64
+	ActiveConnections int64
+	// BytesSent and BytesReceived count data written to and read from
+	// tunnel streams
+	BytesSent     uint64
+	BytesReceived uint64
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("%d connections (%d active), %d bytes sent, %d received",
+		s.Connections, s.ActiveConnections, s.BytesSent, s.BytesReceived)
+}
+
+// proxyCounters accumulates the traffic of a proxy
+type proxyCounters struct {
+	conns    atomic.Uint64
+	active   atomic.Int64
+	sent     atomic.Uint64
+	received atomic.Uint64
+}
+
+func (c *proxyCounters) snapshot() Stats {
+	return Stats{
+		Connections:       c.conns.Load(),
+		ActiveConnections: c.active.Load(),
+		BytesSent:         c.sent.Load(),
+		BytesReceived:     c.received.Load(),
+	}
+}
+
+// open counts a new connection and returns the function to call when it
+// ends
+func (c *proxyCounters) open() func() {
+	c.conns.Add(1)
+	c.active.Add(1)
+	return func() { c.active.Add(-1) }
+}
+
+// wrap returns the tunnel stream with the bytes written to and read from it
+// counted. The result supports half-close if stream does.
+func (c *proxyCounters) wrap(stream io.ReadWriteCloser) io.ReadWriteCloser {
+	wrapped := &countingStream{ReadWriteCloser: stream, counters: c}
+	if cw, ok := stream.(closeWriter); ok {
+		return &countingHalfCloser{countingStream: wrapped, closeWriter: cw}
+	}
+	return wrapped
+}
+
+type countingStream struct {
+	io.ReadWriteCloser
+	counters *proxyCounters
+}
+
+func (s *countingStream) Read(p []byte) (int, error) {
+	n, err := s.ReadWriteCloser.Read(p)
+	s.counters.received.Add(uint64(n))
+	return n, err
+}
+
+func (s *countingStream) Write(p []byte) (int, error) {
+	n, err := s.ReadWriteCloser.Write(p)
+	s.counters.sent.Add(uint64(n))
+	return n, err
+}
+
+// countingHalfCloser is a countingStream whose stream supports half-close
+type countingHalfCloser struct {
+	*countingStream
+	closeWriter
+}
@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseTarget splits a target of the form "scheme://address" into the
+// network and address to dial. Supported schemes are tcp, tcp4, tcp6, udp,
+// udp4, udp6 and unix; a target without a scheme is a TCP host:port.
+func ParseTarget(target string) (network, address string, err error) {
+	scheme, address, ok := strings.Cut(target, "://")
+	if !ok {
+		return "tcp", target, nil
+	}
+
+	switch scheme {
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6", "unix":
+	default:
+		return "", "", fmt.Errorf("unsupported target scheme %q", scheme)
+	}
+	if address == "" {
+		return "", "", fmt.Errorf("missing address in target %q", target)
+	}
+	return scheme, address, nil
+}
+
+// isUDP reports whether network is one of the UDP networks
+func isUDP(network string) bool {
+	return strings.HasPrefix(network, "udp")
+}
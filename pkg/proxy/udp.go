@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/getlantern/lantern/slipstream/pkg/transport"
+)
+
+const (
+	// DefaultUDPIdleTimeout is how long a UDP session may go without
+	// datagrams in either direction before its stream is closed
+	DefaultUDPIdleTimeout = 2 * time.Minute
+
+	// maxDatagramSize is the largest datagram a stream frame can carry
+	maxDatagramSize = 0xFFFF
+)
+
+// UDPProxy forwards UDP datagrams through QUIC streams. Each source address
+// gets its own stream, which is closed once the session has been idle for
+// the idle timeout, since UDP has no close signal of its own.
+type UDPProxy struct {
+	listenAddr  string
+	client      StreamOpener
+	target      string
+	idleTimeout time.Duration
+	log         *slog.Logger
+
+	mu       sync.Mutex
+	conn     net.PacketConn
+	sessions map[string]*udpSession
+	wg       sync.WaitGroup
+	stats    proxyCounters
+}
+
+type udpSession struct {
+	stream io.ReadWriteCloser
+	idle   *idleTimer
+}
+
+// NewUDPProxy creates a new UDP proxy
+func NewUDPProxy(listenAddr string, client StreamOpener) *UDPProxy {
+	return &UDPProxy{
+		listenAddr:  listenAddr,
+		client:      client,
+		idleTimeout: DefaultUDPIdleTimeout,
+		log:         slog.Default(),
+		sessions:    make(map[string]*udpSession),
+	}
+}
+
+// SetTarget makes the proxy ask the server to forward every session to the
+// UDP address target instead of the server's default, which must then be a
+// udp:// target. The client must implement TargetStreamOpener.
+func (p *UDPProxy) SetTarget(target string) {
+	p.target = target
+}
+
+// SetLogger sets the logger the proxy reports to, instead of slog.Default().
+// Per-session messages are logged at debug level.
+func (p *UDPProxy) SetLogger(logger *slog.Logger) {
+	p.log = logger
+}
+
+// SetIdleTimeout sets how long a session may go without datagrams before
+// its stream is closed
+func (p *UDPProxy) SetIdleTimeout(timeout time.Duration) {
+	p.idleTimeout = timeout
+}
+
+// Listen starts receiving datagrams and forwarding them until ctx is done or
+// the proxy is closed
+func (p *UDPProxy) Listen(ctx context.Context) error {
+	conn, err := net.ListenPacket("udp", p.listenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to start UDP listener: %w", err)
+	}
+	p.mu.Lock()
+	p.conn = conn
+	p.mu.Unlock()
+
+	p.log.Info("UDP proxy listening", "addr", conn.LocalAddr())
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			p.log.Warn("Failed to read UDP datagram", "error", err)
+			continue
+		}
+
+		session, err := p.session(ctx, addr)
+		if err != nil {
+			p.log.Warn("Failed to open stream", "remote", addr, "error", err)
+			continue
+		}
+		if _, err := session.stream.Write(buf[:n]); err != nil {
+			p.log.Debug("Failed to forward datagram", "remote", addr, "error", err)
+			session.stream.Close()
+		}
+	}
+}
+
+// session returns the session for addr, opening a stream for it if needed
+func (p *UDPProxy) session(ctx context.Context, addr net.Addr) (*udpSession, error) {
+	key := addr.String()
+
+	p.mu.Lock()
+	session := p.sessions[key]
+	p.mu.Unlock()
+	if session != nil {
+		return session, nil
+	}
+
+	stream, err := p.openStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.log.Debug("New UDP session", "remote", addr)
+
+	session = &udpSession{}
+	session.idle = newIdleTimer(p.idleTimeout, func() {
+		p.log.Debug("Closing idle UDP session", "remote", addr)
+		stream.Close()
+	})
+	session.stream = session.idle.wrap(p.stats.wrap(&transport.DatagramStream{ReadWriteCloser: stream}))
+
+	p.mu.Lock()
+	p.sessions[key] = session
+	p.mu.Unlock()
+
+	p.wg.Add(1)
+	go p.forwardReplies(session, addr)
+	return session, nil
+}
+
+// forwardReplies sends datagrams arriving on the session's stream back to
+// addr until the stream is closed
+func (p *UDPProxy) forwardReplies(session *udpSession, addr net.Addr) {
+	defer p.wg.Done()
+	defer p.stats.open()()
+	defer func() {
+		session.idle.stop()
+		session.stream.Close()
+
+		p.mu.Lock()
+		delete(p.sessions, addr.String())
+		p.mu.Unlock()
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := session.stream.Read(buf)
+		if err != nil {
+			if !transport.IsClosed(err) {
+				p.log.Debug("UDP session failed", "remote", addr, "error", err)
+			}
+			return
+		}
+		if _, err := p.conn.WriteTo(buf[:n], addr); err != nil {
+			p.log.Warn("Failed to send datagram", "remote", addr, "error", err)
+			return
+		}
+	}
+}
+
+// openStream opens a stream to the configured target, if any
+func (p *UDPProxy) openStream(ctx context.Context) (io.ReadWriteCloser, error) {
+	if p.target == "" {
+		return p.client.OpenStream(ctx)
+	}
+
+	opener, ok := p.client.(TargetStreamOpener)
+	if !ok {
+		return nil, fmt.Errorf("client cannot open streams to target %s", p.target)
+	}
+	return opener.OpenStreamTo(ctx, "udp://"+p.target)
+}
+
+// Close stops the UDP proxy and closes every session
+func (p *UDPProxy) Close() error {
+	p.mu.Lock()
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	for _, session := range p.sessions {
+		session.stream.Close()
+	}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+	return nil
+}
+
+// Stats returns a snapshot of the proxy's traffic. Each session counts as a
+// connection, and the bytes are datagram payloads.
+func (p *UDPProxy) Stats() Stats {
+	return p.stats.snapshot()
+}
+
+// relayDatagrams forwards datagrams between a connected UDP socket and a
+// stream carrying framed datagrams until either side fails or ctx is done
+func relayDatagrams(ctx context.Context, conn, stream io.ReadWriteCloser) (sent, received int64, err error) {
+	return biDirectionalCopy(ctx, conn, &transport.DatagramStream{ReadWriteCloser: stream}, maxDatagramSize)
+}
@@ -0,0 +1,141 @@
+// Package slipstreamtest runs a slipstream client and server in memory, so
+// handlers and the proxy can be exercised end to end without UDP sockets.
+// Harness runs QUIC over an in-memory packet pipe; SessionHarness skips QUIC
+// and hands DNS messages straight to the server.
+package slipstreamtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	dnspkg "github.com/getlantern/lantern/slipstream/pkg/dns"
+	"github.com/getlantern/lantern/slipstream/pkg/transport"
+)
+
+const (
+	// Domain is the tunnel domain the harness client and server use
+	Domain = "tunnel.example.com"
+
+	// connectTimeout bounds the client's handshake with the in-memory server
+	connectTimeout = 10 * time.Second
+)
+
+// Harness is a Server and a connected Client joined by a PacketPipe. It
+// implements the proxy package's StreamOpener, so it can stand in for a
+// Client anywhere streams are opened.
+type Harness struct {
+	Server *transport.Server
+	Client *transport.Client
+
+	serverConn net.PacketConn
+	clientConn net.PacketConn
+	cancel     context.CancelFunc
+	done       chan error
+}
+
+// Options configures a Harness created with NewWithOptions
+type Options struct {
+	// Config configures both the server and the client
+	Config transport.Config
+	// DNSConfig, if set, replaces the default DNS configuration of both
+	DNSConfig *dnspkg.Config
+	// Latency delays every packet between client and server, making the
+	// round-trip time twice Latency
+	Latency time.Duration
+}
+
+// New starts a server passing streams to handler and connects a client to it
+func New(handler transport.StreamHandler) (*Harness, error) {
+	return NewWithOptions(handler, Options{})
+}
+
+// NewWithOptions is like New, with the harness configured by opts
+func NewWithOptions(handler transport.StreamHandler, opts Options) (*Harness, error) {
+	serverConn, clientConn := PacketPipeWithLatency(opts.Latency)
+
+	server, err := transport.NewServerWithConfig(serverConn.LocalAddr().String(), Domain, handler, opts.Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create server: %w", err)
+	}
+	server.SetPacketConn(serverConn)
+	if opts.DNSConfig != nil {
+		server.SetDNSConfig(*opts.DNSConfig)
+	}
+
+	pin, err := server.CertificatePin()
+	if err != nil {
+		return nil, err
+	}
+
+	client := transport.NewClientWithConfig(serverConn.LocalAddr().String(), Domain, opts.Config)
+	client.SetPacketConn(clientConn)
+	if opts.DNSConfig != nil {
+		client.SetDNSConfig(*opts.DNSConfig)
+	}
+	if err := client.SetServerCertPin(pin); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &Harness{
+		Server:     server,
+		Client:     client,
+		serverConn: serverConn,
+		clientConn: clientConn,
+		cancel:     cancel,
+		done:       make(chan error, 1),
+	}
+	go func() {
+		h.done <- server.Listen(ctx)
+	}()
+
+	connectCtx, connectCancel := context.WithTimeout(ctx, connectTimeout)
+	defer connectCancel()
+	if err := client.Connect(connectCtx); err != nil {
+		h.Close()
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// OpenStream opens a stream to the server's default target
+func (h *Harness) OpenStream(ctx context.Context) (io.ReadWriteCloser, error) {
+	return h.Client.OpenStream(ctx)
+}
+
+// RestartServer stops the server, closing its connections, and starts it
+// listening again, as if its process had restarted. The client reconnects
+// the next time it opens a stream.
+func (h *Harness) RestartServer() error {
+	h.cancel()
+	if err := <-h.done; !errors.Is(err, context.Canceled) {
+		return fmt.Errorf("server stopped: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	go func() {
+		h.done <- h.Server.Listen(ctx)
+	}()
+	return nil
+}
+
+// Close shuts down the client and server and releases the pipe
+func (h *Harness) Close() error {
+	h.Client.Close()
+	h.cancel()
+
+	err := <-h.done
+	h.serverConn.Close()
+	h.clientConn.Close()
+
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
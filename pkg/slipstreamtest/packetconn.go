@@ -0,0 +1,212 @@
+package slipstreamtest
+
+import (
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// packetQueueSize is the number of packets buffered per direction. Like
+	// a UDP socket, a full queue drops packets rather than blocking the
+	// sender.
+	packetQueueSize = 1024
+	// delayQueueSize is the number of packets a pipe with latency holds in
+	// flight, and queued for reading, per direction, dropping any more
+	delayQueueSize = 1 << 16
+)
+
+// nextPort gives every pipe distinct addresses, since quic-go tracks
+// packet conns by local address
+var nextPort atomic.Uint32
+
+// PacketPipe returns two connected in-memory packet conns. Packets written
+// to one, to any address, arrive at the other. Their addresses are in the
+// 192.0.2.0/24 documentation range and are never bound on the host.
+func PacketPipe() (net.PacketConn, net.PacketConn) {
+	return PacketPipeWithLatency(0)
+}
+
+// PacketPipeWithLatency is like PacketPipe, but every packet takes latency
+// to arrive, in order, making the round-trip time twice latency. Its queues
+// are deep enough that a sender filling the path loses no packets, so
+// latency alone limits throughput.
+func PacketPipeWithLatency(latency time.Duration) (net.PacketConn, net.PacketConn) {
+	port := int(nextPort.Add(1))
+	a := newPacketConn(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: port})
+	b := newPacketConn(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: port})
+	a.peer, b.peer = b, a
+	if latency > 0 {
+		for _, c := range []*packetConn{a, b} {
+			c.latency = latency
+			c.delayed = make(chan delayedPacket, delayQueueSize)
+			c.in = make(chan []byte, delayQueueSize)
+			go c.delay()
+		}
+	}
+	return a, b
+}
+
+type packetConn struct {
+	addr   net.Addr
+	peer   *packetConn
+	in     chan []byte
+	closed chan struct{}
+	once   sync.Once
+
+	// delayed holds the packets sent while they are in flight, if the pipe
+	// has latency
+	latency time.Duration
+	delayed chan delayedPacket
+
+	mu           sync.Mutex
+	readDeadline time.Time
+	// deadlineSet is closed and replaced whenever the read deadline changes,
+	// waking blocked reads so they pick up the new deadline
+	deadlineSet chan struct{}
+}
+
+func newPacketConn(addr net.Addr) *packetConn {
+	return &packetConn{
+		addr:        addr,
+		in:          make(chan []byte, packetQueueSize),
+		closed:      make(chan struct{}),
+		deadlineSet: make(chan struct{}),
+	}
+}
+
+func (c *packetConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		deadline, deadlineSet := c.readDeadline, c.deadlineSet
+		c.mu.Unlock()
+
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(wait)
+			expired = timer.C
+		}
+
+		n, retry, err := c.wait(p, expired, deadlineSet)
+		if timer != nil {
+			timer.Stop()
+		}
+		if !retry {
+			return n, c.peer.addr, err
+		}
+	}
+}
+
+// wait blocks for a packet, close, or deadline. It reports retry if the
+// deadline changed while waiting.
+func (c *packetConn) wait(p []byte, expired <-chan time.Time, deadlineSet chan struct{}) (n int, retry bool, err error) {
+	select {
+	case pkt := <-c.in:
+		return copy(p, pkt), false, nil
+	case <-c.closed:
+		return 0, false, net.ErrClosed
+	case <-expired:
+		return 0, false, os.ErrDeadlineExceeded
+	case <-deadlineSet:
+		return 0, true, nil
+	}
+}
+
+func (c *packetConn) WriteTo(p []byte, _ net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	pkt := append([]byte(nil), p...)
+	if c.delayed == nil {
+		c.peer.deliver(pkt)
+		return len(p), nil
+	}
+
+	select {
+	case c.delayed <- delayedPacket{pkt: pkt, at: time.Now().Add(c.latency)}:
+	default:
+	}
+	return len(p), nil
+}
+
+// deliver queues pkt for reading
+func (c *packetConn) deliver(pkt []byte) {
+	select {
+	case c.in <- pkt:
+	default:
+		// Queue full: drop the packet, as a congested UDP path would
+	}
+}
+
+// delayedPacket is a packet in flight on a pipe with latency
+type delayedPacket struct {
+	pkt []byte
+	at  time.Time
+}
+
+// delay delivers the packets sent to the peer once their latency has
+// passed, until the conn is closed
+func (c *packetConn) delay() {
+	for {
+		select {
+		case dp := <-c.delayed:
+			if wait := time.Until(dp.at); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-timer.C:
+				case <-c.closed:
+					timer.Stop()
+					return
+				}
+			}
+			c.peer.deliver(dp.pkt)
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *packetConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *packetConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *packetConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *packetConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline = t
+	close(c.deadlineSet)
+	c.deadlineSet = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline is a no-op: writes never block
+func (c *packetConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// SetReadBuffer and SetWriteBuffer are no-ops. They stop quic-go warning
+// that it can't size the buffers of a conn that isn't a *net.UDPConn.
+func (c *packetConn) SetReadBuffer(int) error  { return nil }
+func (c *packetConn) SetWriteBuffer(int) error { return nil }
@@ -0,0 +1,144 @@
+package slipstreamtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/getlantern/lantern/slipstream/pkg/transport"
+)
+
+// SessionHarness is a Server and a SessionClient joined by direct function
+// calls instead of QUIC and sockets. Every query and
+// response is packed and unpacked on the way, so the DNS encoding is
+// exercised as it is on the wire. It implements the proxy package's
+// StreamOpener and TargetStreamOpener.
+type SessionHarness struct {
+	Server *transport.Server
+	Client *transport.SessionClient
+
+	clientAddr net.Addr
+	serverAddr net.Addr
+
+	mu     sync.Mutex
+	faults Faults
+}
+
+// Faults makes the exchanges of a SessionHarness as unreliable as those
+// through recursive resolvers, which retry, reorder and lose queries
+type Faults struct {
+	// Duplicate is the probability of a query reaching the server a second
+	// time, up to Delay later and so possibly after queries sent after it
+	Duplicate float64
+	Delay     time.Duration
+	// Drop is the probability of a response being lost after the server
+	// answered its query
+	Drop float64
+	// ServFail is the probability of a query being answered with SERVFAIL,
+	// as by an overloaded resolver, without reaching the server
+	ServFail float64
+}
+
+// errDropped is returned for exchanges whose response Faults dropped
+var errDropped = errors.New("response dropped")
+
+// SetFaults makes later exchanges fail as described by f. The zero Faults,
+// the default, delivers every query and response once and in order.
+func (h *SessionHarness) SetFaults(f Faults) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.faults = f
+}
+
+// NewSessionHarness creates a server passing streams to handler and a
+// session client exchanging queries with it in memory
+func NewSessionHarness(handler transport.StreamHandler) (*SessionHarness, error) {
+	port := int(nextPort.Add(1))
+	h := &SessionHarness{
+		clientAddr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: port},
+		serverAddr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: port},
+	}
+
+	// Sessions don't use the certificate, so the fastest key will do
+	server, err := transport.NewServerWithConfig(h.serverAddr.String(), Domain, handler, transport.Config{
+		Cert: transport.CertConfig{KeyType: transport.KeyTypeEd25519},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create server: %w", err)
+	}
+	h.Server = server
+	h.Client = transport.NewSessionClient(Domain, h.exchange)
+	return h, nil
+}
+
+// exchange passes query to the server as if it had crossed the network
+func (h *SessionHarness) exchange(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	query, err := repack(query)
+	if err != nil {
+		return nil, err
+	}
+
+	h.mu.Lock()
+	f := h.faults
+	h.mu.Unlock()
+	if rand.Float64() < f.ServFail {
+		resp := new(dns.Msg)
+		resp.SetRcode(query, dns.RcodeServerFailure)
+		return repack(resp)
+	}
+	if rand.Float64() < f.Duplicate {
+		delay := time.Duration(rand.Int63n(int64(f.Delay) + 1))
+		dup := query.Copy()
+		time.AfterFunc(delay, func() {
+			h.Server.ServeQuery(dup, h.clientAddr, h.serverAddr)
+		})
+	}
+
+	resp := h.Server.ServeQuery(query, h.clientAddr, h.serverAddr)
+	if rand.Float64() < f.Drop {
+		return nil, errDropped
+	}
+	return repack(resp)
+}
+
+// OpenStream opens a stream to the server's default target
+func (h *SessionHarness) OpenStream(ctx context.Context) (io.ReadWriteCloser, error) {
+	return h.Client.OpenStream(ctx)
+}
+
+// OpenStreamTo opens a stream and asks the server to connect it to target
+func (h *SessionHarness) OpenStreamTo(ctx context.Context, target string) (io.ReadWriteCloser, error) {
+	return h.Client.OpenStreamTo(ctx, target)
+}
+
+// Close ends every session, so their streams fail with
+// transport.ErrSessionReset
+func (h *SessionHarness) Close() error {
+	return h.Server.Shutdown(context.Background())
+}
+
+// repack returns a copy of msg as it would be seen by the receiver
+func repack(msg *dns.Msg) (*dns.Msg, error) {
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack DNS message: %w", err)
+	}
+
+	out := new(dns.Msg)
+	if err := out.Unpack(packed); err != nil {
+		return nil, fmt.Errorf("failed to unpack DNS message: %w", err)
+	}
+	return out, nil
+}
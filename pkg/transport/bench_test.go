@@ -0,0 +1,104 @@
+package transport_test
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	dnspkg "github.com/getlantern/lantern/slipstream/pkg/dns"
+	"github.com/getlantern/lantern/slipstream/pkg/slipstreamtest"
+	"github.com/getlantern/lantern/slipstream/pkg/transport"
+)
+
+// downloadHandler reads an 8-byte big-endian size and sends that many bytes
+type downloadHandler struct{}
+
+func (downloadHandler) HandleStream(ctx context.Context, stream io.ReadWriteCloser) error {
+	defer stream.Close()
+
+	var size uint64
+	if err := binary.Read(stream, binary.BigEndian, &size); err != nil {
+		return err
+	}
+	_, err := io.CopyN(stream, zeros{}, int64(size))
+	return err
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// benchmarkDownload measures how fast one stream at a time downloads size
+// bytes from a harness created with opts
+func benchmarkDownload(b *testing.B, opts slipstreamtest.Options, size int64) {
+	h, err := slipstreamtest.NewWithOptions(downloadHandler{}, opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer h.Close()
+
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		stream, err := h.OpenStream(context.Background())
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := binary.Write(stream, binary.BigEndian, uint64(size)); err != nil {
+			b.Fatal(err)
+		}
+		n, err := io.Copy(io.Discard, stream)
+		stream.Close()
+		if err != nil || n != size {
+			b.Fatalf("downloaded %d of %d bytes: %v", n, size, err)
+		}
+	}
+}
+
+// BenchmarkDownloadRTT200ms measures a stream's throughput over a path with
+// a 200ms round-trip time, like a DNS path through a distant resolver, where
+// the congestion controller's ramp-up decides throughput. quic-go v0.41 has
+// no way to choose the controller or its initial window, so this is the
+// baseline for comparing one once it does.
+func BenchmarkDownloadRTT200ms(b *testing.B) {
+	benchmarkDownload(b, slipstreamtest.Options{Latency: 100 * time.Millisecond}, 4<<20)
+}
+
+// BenchmarkTransfer1GB compares the throughput of a 1GB download over a
+// 600ms round-trip path with quic-go's default flow-control windows and
+// with the raised defaults. The stream window caps throughput at one window
+// per round trip, 10MB/s with quic-go's 6MB. Data travels in NULL records,
+// the cheapest to encode, so the windows rather than the encoding limit it.
+// Each run takes minutes.
+func BenchmarkTransfer1GB(b *testing.B) {
+	dnsConfig := dnspkg.DefaultConfig()
+	dnsConfig.RecordType = dns.TypeNULL
+
+	for _, bc := range []struct {
+		name   string
+		config transport.Config
+	}{
+		{"quic-go windows", transport.Config{
+			InitialStreamReceiveWindow:     512 << 10,
+			MaxStreamReceiveWindow:         6 << 20,
+			InitialConnectionReceiveWindow: 768 << 10,
+			MaxConnectionReceiveWindow:     15 << 20,
+		}},
+		{"default windows", transport.DefaultConfig()},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			benchmarkDownload(b, slipstreamtest.Options{
+				Config:    bc.config,
+				DNSConfig: &dnsConfig,
+				Latency:   300 * time.Millisecond,
+			}, 1<<30)
+		})
+	}
+}
@@ -1,12 +1,17 @@
 package transport
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
@@ -17,63 +22,463 @@ import (
 // Client represents a slipstream QUIC client
 type Client struct {
 	serverAddr string
+	localAddr  string
+	transport  *quic.Transport
 	domain     string
+	dnsConfig  dnspkg.Config
 	tlsConfig  *tls.Config
+	pin        []byte
+	insecure   bool
 	quicConfig *quic.Config
+	readBuffer int
+	log        *slog.Logger
+	auth       Authenticator
+	sizer      *payloadSizer
+	pacer      *pacer
 	conn       quic.Connection
+	closed     bool
 	mu         sync.RWMutex
+
+	// compressLevel is the flate level of data streams; see SetCompression.
+	// features holds the optional features negotiated on conn.
+	compressLevel int
+	features      byte
+
+	// paths are the connections from additional local addresses; see
+	// AddLocalAddr. nextPath picks the connection of the next stream.
+	paths    []*clientPath
+	nextPath atomic.Uint64
+
+	stats trafficCounters
+
+	// Reconnection policy and state; see SetReconnect
+	reconnectAttempts int
+	reconnectTimeout  time.Duration
+	reconnecting      chan struct{}
+	reconnectErr      error
+
+	// connectTimeout and openTimeout bound connecting and opening streams
+	// under contexts without a deadline
+	connectTimeout time.Duration
+	openTimeout    time.Duration
+
+	// pool keeps finished streams for reuse; see SetStreamPool
+	pool *streamPool
 }
 
 // NewClient creates a new slipstream client
 func NewClient(serverAddr, domain string) *Client {
+	return NewClientWithConfig(serverAddr, domain, DefaultConfig())
+}
+
+// NewClientWithConfig creates a new slipstream client using the given
+// transport configuration
+func NewClientWithConfig(serverAddr, domain string, config Config) *Client {
+	config = config.withDefaults()
 	return &Client{
 		serverAddr: serverAddr,
 		domain:     domain,
+		dnsConfig:  dnspkg.DefaultConfig(),
 		tlsConfig: &tls.Config{
-			InsecureSkipVerify: true, // TODO: Add proper certificate verification
-			NextProtos:         []string{ALPN},
-			ServerName:         SNI,
-		},
-		quicConfig: &quic.Config{
-			EnableDatagrams: true,
-			KeepAlivePeriod: 0, // Disable keep-alive by default
+			NextProtos: []string{config.ALPN},
+			ServerName: config.SNI,
 		},
+		quicConfig: config.quicConfig(),
+		readBuffer: config.ReadBufferSize,
+		log:        config.Logger,
+		sizer:      newPayloadSizer(dnspkg.DefaultConfig().MaxPayloadSize(len(domain))),
+
+		reconnectAttempts: DefaultReconnectAttempts,
+		reconnectTimeout:  DefaultReconnectTimeout,
+		connectTimeout:    DefaultConnectTimeout,
+		openTimeout:       DefaultOpenStreamTimeout,
 	}
 }
 
-// Connect establishes a connection to the server
+// SetDNSConfig sets how data is encoded in DNS messages. It must be called
+// before Connect.
+func (c *Client) SetDNSConfig(cfg dnspkg.Config) {
+	c.dnsConfig = cfg
+	c.sizer = newPayloadSizer(cfg.MaxPayloadSize(len(c.domain)))
+}
+
+// SetRootCAs makes the client verify the server's certificate chain against
+// pool instead of the system roots. The certificate must be valid for the
+// configured SNI. Add a self-signed server certificate to pool to trust it.
+func (c *Client) SetRootCAs(pool *x509.CertPool) {
+	c.tlsConfig.RootCAs = pool
+}
+
+// SetServerCertPin makes the client accept only a server certificate whose
+// key matches pin, as returned by CertificatePin. Unless SetRootCAs is also
+// used, the pin alone identifies the server, so self-signed certificates
+// are accepted.
+func (c *Client) SetServerCertPin(pin string) error {
+	digest, err := parsePin(pin)
+	if err != nil {
+		return err
+	}
+	c.pin = digest
+	return nil
+}
+
+// SetInsecureSkipVerify disables verification of the server's certificate,
+// leaving the tunnel open to interception. Prefer SetServerCertPin for
+// servers with self-signed certificates.
+func (c *Client) SetInsecureSkipVerify(skip bool) {
+	c.insecure = skip
+}
+
+// SetLocalAddr binds the client's UDP socket to addr, of the form
+// "host[:port]", so tunnel traffic leaves from a specific address. The host
+// may also be a network interface name such as "wwan0". It takes effect on
+// the next Connect.
+func (c *Client) SetLocalAddr(addr string) {
+	c.localAddr = addr
+}
+
+// SetPacketConn makes the client send its QUIC traffic over pc instead of a
+// socket of its own. The caller keeps ownership of pc. To share one socket
+// between several clients, give them the same transport with SetTransport.
+func (c *Client) SetPacketConn(pc net.PacketConn) {
+	c.SetTransport(&quic.Transport{Conn: pc})
+}
+
+// SetTransport makes the client dial through tr, which may be shared with
+// other clients and a server. It takes precedence over SetLocalAddr. The
+// caller keeps ownership of tr.
+func (c *Client) SetTransport(tr *quic.Transport) {
+	c.transport = tr
+}
+
+// SetAuthenticator sets the authenticator used to prove the client's identity
+// to the server on every new connection
+func (c *Client) SetAuthenticator(auth Authenticator) {
+	c.auth = auth
+}
+
+// SetPSK authenticates the client with a pre-shared key
+func (c *Client) SetPSK(psk []byte) {
+	c.SetAuthenticator(NewPSKAuthenticator(psk))
+}
+
+// Stats returns a snapshot of the client's traffic since it was created
+func (c *Client) Stats() Stats {
+	return c.stats.snapshot()
+}
+
+// PayloadSize returns the number of bytes currently carried per query. The
+// client adapts it to the server endpoint, growing it while queries succeed
+// and backing off when they fail.
+func (c *Client) PayloadSize() int {
+	return c.sizer.size()
+}
+
+// Connect establishes a connection to the server. If the connection is
+// later lost, opening a stream re-establishes it; see SetReconnect.
 func (c *Client) Connect(ctx context.Context) error {
 	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	conn, err := quic.DialAddr(ctx, c.serverAddr, c.tlsConfig, c.quicConfig)
+	conn, features, err := c.connect(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to connect to server: %w", err)
+		c.mu.Unlock()
+		return err
 	}
 
 	c.conn = conn
-	log.Printf("Connected to server at %s", c.serverAddr)
+	c.features = features
+	c.closed = false
+	c.mu.Unlock()
+	c.log.Info("Connected to server", "server", c.serverAddr)
+
+	c.connectPaths(ctx)
+	return nil
+}
+
+// connect dials the server, authenticates the new connection and
+// negotiates its optional features
+func (c *Client) connect(ctx context.Context) (quic.Connection, byte, error) {
+	return c.connectWith(ctx, c.dial)
+}
+
+// connectWith establishes a connection like connect, dialing it with dial
+func (c *Client) connectWith(ctx context.Context, dial func(context.Context) (quic.Connection, error)) (quic.Connection, byte, error) {
+	ctx, cancel := withDefaultTimeout(ctx, c.connectTimeout)
+	defer cancel()
+
+	conn, err := dial(ctx)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to connect to server: %w", contextError(ctx, err))
+	}
+
+	if c.auth != nil {
+		if err := c.authenticate(ctx, conn); err != nil {
+			conn.CloseWithError(ErrorCodeAuthFailed, "authentication failed")
+			return nil, 0, err
+		}
+	}
+
+	features, err := c.hello(ctx, conn)
+	if err != nil {
+		conn.CloseWithError(ErrorCodeNone, "feature negotiation failed")
+		return nil, 0, err
+	}
+	return conn, features, nil
+}
+
+// dial establishes the QUIC connection over the configured transport or
+// from the configured local address, if either is set
+func (c *Client) dial(ctx context.Context) (quic.Connection, error) {
+	if c.transport == nil {
+		if c.localAddr != "" {
+			return c.dialFrom(ctx, c.localAddr)
+		}
+		return quic.DialAddr(ctx, c.serverAddr, c.verifiedTLSConfig(), c.quicConfig)
+	}
+
+	remote, err := net.ResolveUDPAddr("udp", c.serverAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server address %q: %w", c.serverAddr, err)
+	}
+	return c.transport.Dial(ctx, remote, c.verifiedTLSConfig(), c.quicConfig)
+}
+
+// dialFrom establishes a QUIC connection from a socket of its own bound to
+// localAddr
+func (c *Client) dialFrom(ctx context.Context, localAddr string) (quic.Connection, error) {
+	remote, err := net.ResolveUDPAddr("udp", c.serverAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server address %q: %w", c.serverAddr, err)
+	}
+
+	udpConn, err := listenUDP(localAddr)
+	if err != nil {
+		return nil, err
+	}
+	tr := &quic.Transport{Conn: udpConn}
+
+	conn, err := tr.Dial(ctx, remote, c.verifiedTLSConfig(), c.quicConfig)
+	if err != nil {
+		tr.Close()
+		udpConn.Close()
+		return nil, err
+	}
+
+	// The transport doesn't own the socket, so release both with the
+	// connection
+	go func() {
+		<-conn.Context().Done()
+		tr.Close()
+		udpConn.Close()
+	}()
+
+	return conn, nil
+}
+
+// verifiedTLSConfig returns the TLS configuration with the server
+// verification the client was configured with
+func (c *Client) verifiedTLSConfig() *tls.Config {
+	return verifiedTLSConfig(c.tlsConfig, c.pin, c.insecure)
+}
+
+// authenticate runs the authentication handshake on a dedicated stream and
+// waits for the server to accept it
+func (c *Client) authenticate(ctx context.Context, conn quic.Connection) error {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open auth stream: %w", contextError(ctx, err))
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+
+	ds := c.newDNSStream(stream)
+	defer ds.Close()
+
+	if err := c.auth.Authenticate(ds); err != nil {
+		return err
+	}
+
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(ds, status); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("failed to read auth status: %w", ctx.Err())
+		}
+		return fmt.Errorf("%w: %v", ErrAuthFailed, err)
+	}
+	if status[0] != authOK {
+		return ErrAuthFailed
+	}
+
 	return nil
 }
 
-// OpenStream opens a new QUIC stream for proxying a connection
+// OpenStream opens a new QUIC stream for proxying a connection to the
+// server's default target, or reuses one from the stream pool
 func (c *Client) OpenStream(ctx context.Context) (io.ReadWriteCloser, error) {
+	return c.OpenStreamTo(ctx, "")
+}
+
+// OpenStreamTo opens a new QUIC stream, or reuses one from the stream pool,
+// and asks the server to connect it to target, a host:port address. An
+// empty target selects the server's default.
+func (c *Client) OpenStreamTo(ctx context.Context, target string) (io.ReadWriteCloser, error) {
+	if c.pool != nil {
+		return c.openReusable(ctx, target)
+	}
+	return c.openStream(ctx, target)
+}
+
+// OpenConn opens a new stream to the server's default target and returns it
+// as a net.Conn
+func (c *Client) OpenConn(ctx context.Context) (*StreamConn, error) {
+	ds, err := c.openStream(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	return c.newStreamConn(ds), nil
+}
+
+// openStream opens a new data stream and sends the target prologue
+func (c *Client) openStream(ctx context.Context, target string) (*dnsStream, error) {
+	if err := ValidateTarget(target); err != nil {
+		return nil, err
+	}
+
+	ds, err := c.openKindStream(ctx, streamKindData, func(w io.Writer) error {
+		return WriteTarget(w, target)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.startData(ds)
+	return ds, nil
+}
+
+// startData prepares a newly opened data stream, or reusable one, for the
+// server's status and stream data
+func (c *Client) startData(ds *dnsStream) {
+	ds.needStatus = true
+	if ds.features&featureCompression != 0 {
+		ds.compressor = newFrameCompressor(c.compressLevel)
+		ds.decompressor = &frameDecompressor{}
+	}
+}
+
+// openKindStream opens a new QUIC stream and sends its kind, followed by
+// the kind-specific prologue if one is given
+func (c *Client) openKindStream(ctx context.Context, kind byte, prologue func(io.Writer) error) (*dnsStream, error) {
 	c.mu.RLock()
-	defer c.mu.RUnlock()
+	openTimeout := c.openTimeout
+	c.mu.RUnlock()
+	ctx, cancel := withDefaultTimeout(ctx, openTimeout)
+	defer cancel()
 
-	if c.conn == nil {
-		return nil, fmt.Errorf("not connected to server")
+	// OpenStreamSync blocks while the server's stream limit is exhausted, so
+	// it is called without holding the lock
+	conn, features, err := c.pickConn(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	stream, err := c.conn.OpenStreamSync(ctx)
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil && ctx.Err() == nil && conn.Context().Err() != nil {
+		// The connection died while the stream was being opened, so fail
+		// over to another path or reconnect
+		if conn, features, err = c.pickConn(ctx); err != nil {
+			return nil, err
+		}
+		stream, err = conn.OpenStreamSync(ctx)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to open stream: %w", err)
+		return nil, fmt.Errorf("failed to open stream: %w", contextError(ctx, err))
+	}
+
+	// Bound the prologue by the context's deadline, in case flow control
+	// blocks the write
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetWriteDeadline(deadline)
+		defer stream.SetWriteDeadline(time.Time{})
+	}
+
+	ds := c.newDNSStream(stream)
+	ds.features = features
+	ds.active = &c.stats.activeStreams
+	c.stats.streams.Add(1)
+	c.stats.activeStreams.Add(1)
+
+	if _, err := ds.Write([]byte{kind}); err != nil {
+		ds.Close()
+		return nil, fmt.Errorf("failed to send stream kind: %w", contextError(ctx, err))
 	}
 
+	if prologue != nil {
+		if err := prologue(ds); err != nil {
+			ds.Close()
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	return ds, nil
+}
+
+// contextError returns ctx's error in place of err once ctx is done, so
+// callers can identify cancellation and deadlines with errors.Is whatever
+// error the QUIC layer reported
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+func (c *Client) newDNSStream(stream quic.Stream) *dnsStream {
 	return &dnsStream{
 		stream: stream,
+		reader: bufio.NewReaderSize(stream, c.readBuffer),
 		domain: c.domain,
-	}, nil
+		config: c.dnsConfig,
+		sizer:  c.sizer,
+		pacer:  c.pacer,
+		stats:  &c.stats,
+	}
+}
+
+func (c *Client) newStreamConn(ds *dnsStream) *StreamConn {
+	// Both ends of a stream share its ID, so local and remote addresses match
+	addr := Addr{Domain: c.domain, StreamID: int64(ds.stream.StreamID())}
+	return &StreamConn{
+		deadlineStream: ds,
+		local:          addr,
+		remote:         addr,
+	}
+}
+
+// Connected reports whether the client has a live connection to the server.
+// Use Ping to check that the tunnel actually carries data.
+func (c *Client) Connected() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.conn != nil && c.conn.Context().Err() == nil
+}
+
+// CloseError returns why the connection to the server was closed, or nil if
+// it is still open or was never established. Use ErrorCode to extract the
+// application error code the server closed it with.
+func (c *Client) CloseError() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.conn == nil {
+		return nil
+	}
+
+	ctx := c.conn.Context()
+	if ctx.Err() == nil {
+		return nil
+	}
+	return context.Cause(ctx)
 }
 
 // Close closes the client connection
@@ -81,8 +486,13 @@ func (c *Client) Close() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	c.closed = true
+	c.pool.closeAll()
+	for _, p := range c.paths {
+		p.close()
+	}
 	if c.conn != nil {
-		return c.conn.CloseWithError(0, "client closing")
+		return c.conn.CloseWithError(ErrorCodeNone, "client closing")
 	}
 	return nil
 }
@@ -90,56 +500,192 @@ func (c *Client) Close() error {
 // dnsStream wraps a QUIC stream with DNS encoding/decoding
 type dnsStream struct {
 	stream quic.Stream
+	reader *bufio.Reader
 	domain string
+	config dnspkg.Config
+	sizer  *payloadSizer
+	pacer  *pacer
+	stats  *trafficCounters
+	// active counts the client's open streams if this stream is one of
+	// them, until closed is set
+	active *atomic.Int64
+	closed atomic.Bool
+	// needStatus is set on data streams until the server's stream status
+	// has been read; status holds its bytes received so far
+	needStatus bool
+	status     []byte
+	// features holds the optional features negotiated on the stream's
+	// connection. compressor and decompressor are set on data streams of
+	// connections that negotiated compression.
+	features     byte
+	compressor   *frameCompressor
+	decompressor *frameDecompressor
+	// pending holds decoded data not yet returned by Read
+	pending []byte
 }
 
 func (ds *dnsStream) Read(p []byte) (int, error) {
-	// For the client, we read QUIC data and decode it as DNS responses
-	buf := make([]byte, 4096)
-	n, err := ds.stream.Read(buf)
+	// A response may carry more data than fits in p, so the rest is kept
+	// for the next calls
+	for len(ds.pending) == 0 {
+		data, err := ds.readData()
+		if err != nil {
+			return 0, err
+		}
+		if ds.decompressor != nil {
+			if data, err = ds.decompressor.decompress(data); err != nil {
+				return 0, err
+			}
+		}
+		ds.pending = data
+	}
+
+	n := copy(p, ds.pending)
+	ds.pending = ds.pending[n:]
+	ds.stats.bytesRead.Add(uint64(n))
+	return n, nil
+}
+
+// readData reads the next DNS response and returns its data, after the
+// stream status on data streams
+func (ds *dnsStream) readData() ([]byte, error) {
+	data, err := ds.readMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	// Data streams start with the server's stream status, which may share
+	// a response with the first data
+	for ds.needStatus {
+		ds.status = append(ds.status, data...)
+		rest, more, err := parseStatus(ds.status)
+		if err != nil {
+			ds.needStatus = false
+			return nil, err
+		}
+		if !more {
+			ds.needStatus, ds.status = false, nil
+			data = rest
+			break
+		}
+		if data, err = ds.readMessage(); err != nil {
+			return nil, err
+		}
+	}
+
+	return data, nil
+}
+
+// readMessage reads the next DNS response and returns the data it carries
+func (ds *dnsStream) readMessage() ([]byte, error) {
+	// For the client, we read framed DNS responses from the QUIC stream
+	buf, err := readFrame(ds.reader)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
+	ds.stats.responses.Add(1)
+	ds.stats.wireIn.Add(uint64(frameLen(buf)))
 
 	// Parse DNS response
 	msg := new(dns.Msg)
-	if err := msg.Unpack(buf[:n]); err != nil {
-		return 0, fmt.Errorf("failed to parse DNS response: %w", err)
+	if err := msg.Unpack(buf); err != nil {
+		ds.sizer.failure()
+		return nil, fmt.Errorf("stream %d: %w: failed to parse DNS response: %w", ds.stream.StreamID(), ErrDNSDecode, err)
 	}
 
 	// Extract data from response
-	data, err := dnspkg.ParseResponseData(msg)
+	data, err := ds.config.ParseResponseData(msg)
 	if err != nil {
-		return 0, fmt.Errorf("failed to extract data from DNS response: %w", err)
+		ds.sizer.failure()
+		return nil, fmt.Errorf("stream %d: %w", ds.stream.StreamID(), dataError("DNS response", err))
 	}
-
-	// Copy to output buffer
-	copied := copy(p, data)
-	return copied, nil
+	return data, nil
 }
 
 func (ds *dnsStream) Write(p []byte) (int, error) {
-	// For the client, we encode data as DNS queries
-	msg, err := dnspkg.CreateQuery(p, ds.domain)
+	var n int
+	var err error
+	if ds.compressor == nil {
+		n, err = ds.write(p)
+	} else if _, err = ds.write(ds.compressor.compress(p)); err == nil {
+		// A partially sent frame can't be decompressed, so a failed write
+		// consumes none of p
+		n = len(p)
+	}
+	ds.stats.bytesWritten.Add(uint64(n))
+	return n, err
+}
+
+// write encodes p as DNS queries
+func (ds *dnsStream) write(p []byte) (int, error) {
+	// For the client, we encode data as DNS queries, one per chunk of the
+	// current payload size
+	written := 0
+	for written < len(p) {
+		chunk := p[written:min(len(p), written+ds.sizer.size())]
+
+		packed, err := ds.packQuery(chunk)
+		if err != nil {
+			// Nothing was sent, so retry the chunk at a smaller size
+			if ds.sizer.failure() {
+				continue
+			}
+			return written, err
+		}
+
+		// Write to QUIC stream
+		ds.pacer.wait()
+		if err := writeFrame(ds.stream, packed); err != nil {
+			return written, err
+		}
+		ds.stats.queries.Add(1)
+		ds.stats.wireOut.Add(uint64(frameLen(packed)))
+		ds.sizer.success()
+		written += len(chunk)
+	}
+
+	return written, nil
+}
+
+// packQuery encodes data as a packed DNS query
+func (ds *dnsStream) packQuery(data []byte) ([]byte, error) {
+	msg, err := ds.config.CreateQuery(data, ds.domain)
 	if err != nil {
-		return 0, fmt.Errorf("failed to create DNS query: %w", err)
+		return nil, fmt.Errorf("failed to create DNS query: %w", err)
 	}
 
 	// Pack DNS message
 	packed, err := msg.Pack()
 	if err != nil {
-		return 0, fmt.Errorf("failed to pack DNS query: %w", err)
+		return nil, fmt.Errorf("failed to pack DNS query: %w", err)
 	}
+	return packed, nil
+}
 
-	// Write to QUIC stream
-	_, err = ds.stream.Write(packed)
-	if err != nil {
-		return 0, err
-	}
+func (ds *dnsStream) SetDeadline(t time.Time) error {
+	return ds.stream.SetDeadline(t)
+}
+
+func (ds *dnsStream) SetReadDeadline(t time.Time) error {
+	return ds.stream.SetReadDeadline(t)
+}
 
-	return len(p), nil
+func (ds *dnsStream) SetWriteDeadline(t time.Time) error {
+	return ds.stream.SetWriteDeadline(t)
 }
 
+// CloseWrite closes the send side of the stream, so the server reads EOF
+// while the stream can still be read from
+func (ds *dnsStream) CloseWrite() error {
+	return ds.stream.Close()
+}
+
+// Close closes both directions of the stream. quic.Stream.Close only closes
+// the send side, so the receive side is cancelled to unblock pending reads.
 func (ds *dnsStream) Close() error {
+	if ds.active != nil && ds.closed.CompareAndSwap(false, true) {
+		ds.active.Add(-1)
+	}
+	ds.stream.CancelRead(quic.StreamErrorCode(ErrorCodeNone))
 	return ds.stream.Close()
 }
@@ -0,0 +1,91 @@
+package transport_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/getlantern/lantern/slipstream/pkg/slipstreamtest"
+	"github.com/getlantern/lantern/slipstream/pkg/transport"
+)
+
+// smallReadSize is smaller than any payload a DNS message carries
+const smallReadSize = 7
+
+// smallReadEcho echoes the stream back, reading smallReadSize bytes at a
+// time
+type smallReadEcho struct{}
+
+func (smallReadEcho) HandleStream(ctx context.Context, stream io.ReadWriteCloser) error {
+	defer stream.Close()
+
+	buf := make([]byte, smallReadSize)
+	for {
+		n, err := stream.Read(buf)
+		if n > 0 {
+			if _, err := stream.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// newHarness starts a harness passing streams to handler
+func newHarness(t *testing.T, handler transport.StreamHandler) *slipstreamtest.Harness {
+	t.Helper()
+	h, err := slipstreamtest.New(handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+// testContext returns a context that ends with the test or after a minute
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestReadsSmallerThanPayloads(t *testing.T) {
+	h := newHarness(t, smallReadEcho{})
+
+	stream, err := h.OpenStream(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	data := make([]byte, 5000)
+	rand.New(rand.NewSource(1)).Read(data)
+	go func() {
+		stream.Write(data)
+		stream.(interface{ CloseWrite() error }).CloseWrite()
+	}()
+
+	var got []byte
+	buf := make([]byte, smallReadSize)
+	for {
+		n, err := stream.Read(buf)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read failed after %d bytes: %v", len(got), err)
+		}
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("echoed %d bytes, differing from the %d sent", len(got), len(data))
+	}
+}
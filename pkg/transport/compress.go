@@ -0,0 +1,226 @@
+package transport
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// featureCompression is set in a hello message by a peer that compresses
+	// data streams
+	featureCompression byte = 1 << 0
+
+	// helloTimeout bounds the feature negotiation on a new connection
+	helloTimeout = 10 * time.Second
+
+	// Compressed data streams carry a sequence of frames, each a flag byte
+	// saying whether the body is deflated, a 2-byte big-endian body length
+	// and the body
+	frameStored   byte = 0
+	frameDeflated byte = 1
+	frameHeader        = 3
+
+	// minCompressSize is the smallest chunk worth compressing
+	minCompressSize = 64
+	// maxCompressChunk is the most stream data one frame carries, so the
+	// body length fits in two bytes even when the data doesn't compress
+	maxCompressChunk = 16 << 10
+)
+
+// validCompressionLevel checks that level is a compress/flate level
+func validCompressionLevel(level int) error {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return fmt.Errorf("invalid compression level %d", level)
+	}
+	return nil
+}
+
+// SetCompression compresses the data of streams at the given compress/flate
+// level, if the server supports it. Whether to compress is negotiated once
+// per connection. flate.NoCompression, the default, disables compression.
+// It takes effect on the next Connect.
+func (c *Client) SetCompression(level int) error {
+	if err := validCompressionLevel(level); err != nil {
+		return err
+	}
+	c.compressLevel = level
+	return nil
+}
+
+// SetCompression lets clients that ask for it compress stream data, with
+// the server compressing its own data at the given compress/flate level.
+// flate.NoCompression, the default, refuses compression.
+func (s *Server) SetCompression(level int) error {
+	if err := validCompressionLevel(level); err != nil {
+		return err
+	}
+	s.compressLevel = level
+	return nil
+}
+
+// hello negotiates the optional features of a new connection with the
+// server and returns those both sides support
+func (c *Client) hello(ctx context.Context, conn quic.Connection) (byte, error) {
+	var features byte
+	if c.compressLevel != flate.NoCompression {
+		features |= featureCompression
+	}
+	if features == 0 {
+		return 0, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, helloTimeout)
+	defer cancel()
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open hello stream: %w", contextError(ctx, err))
+	}
+	deadline, _ := ctx.Deadline()
+	stream.SetDeadline(deadline)
+
+	ds := c.newDNSStream(stream)
+	defer ds.Close()
+
+	if _, err := ds.Write([]byte{streamKindHello, features}); err != nil {
+		return 0, fmt.Errorf("failed to send hello: %w", err)
+	}
+
+	reply := make([]byte, 1)
+	if _, err := io.ReadFull(ds, reply); err != nil {
+		// Servers that predate feature negotiation reset the stream
+		var streamErr *quic.StreamError
+		if errors.As(err, &streamErr) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to read hello reply: %w", contextError(ctx, err))
+	}
+	return features & reply[0], nil
+}
+
+// handleHello answers a client's hello with the features the server
+// supports and records those both sides support for the connection
+func (s *Server) handleHello(ds *serverDNSStream, counters *connCounters) error {
+	ds.SetDeadline(time.Now().Add(helloTimeout))
+
+	requested := make([]byte, 1)
+	if _, err := io.ReadFull(ds, requested); err != nil {
+		return fmt.Errorf("failed to read hello: %w", err)
+	}
+
+	var features byte
+	if s.compressLevel != flate.NoCompression {
+		features |= featureCompression
+	}
+	counters.compress.Store(requested[0]&features&featureCompression != 0)
+
+	if _, err := ds.write([]byte{features}); err != nil {
+		return fmt.Errorf("failed to send hello reply: %w", err)
+	}
+	return nil
+}
+
+// frameCompressor splits stream data into frames, deflating each one that
+// gets smaller for it
+type frameCompressor struct {
+	w   *flate.Writer
+	buf bytes.Buffer
+}
+
+func newFrameCompressor(level int) *frameCompressor {
+	c := &frameCompressor{}
+	// The level was validated when it was configured
+	c.w, _ = flate.NewWriter(&c.buf, level)
+	return c
+}
+
+// compress returns the frames carrying p
+func (c *frameCompressor) compress(p []byte) []byte {
+	var out []byte
+	for len(p) > 0 {
+		chunk := p[:min(len(p), maxCompressChunk)]
+		p = p[len(chunk):]
+
+		flag, body := frameStored, chunk
+		if len(chunk) >= minCompressSize {
+			c.buf.Reset()
+			c.w.Reset(&c.buf)
+			c.w.Write(chunk)
+			c.w.Close()
+			// Incompressible data is sent as is
+			if c.buf.Len() < len(chunk) {
+				flag, body = frameDeflated, c.buf.Bytes()
+			}
+		}
+
+		var header [frameHeader]byte
+		header[0] = flag
+		binary.BigEndian.PutUint16(header[1:], uint16(len(body)))
+		out = append(append(out, header[:]...), body...)
+	}
+	return out
+}
+
+// frameDecompressor restores stream data from frames, which may arrive
+// split across any number of messages
+type frameDecompressor struct {
+	partial []byte
+	r       io.ReadCloser
+}
+
+// decompress consumes data and returns the stream data of the frames it
+// completes
+func (d *frameDecompressor) decompress(data []byte) ([]byte, error) {
+	d.partial = append(d.partial, data...)
+
+	out := []byte{}
+	for len(d.partial) >= frameHeader {
+		n := int(binary.BigEndian.Uint16(d.partial[1:frameHeader]))
+		if len(d.partial) < frameHeader+n {
+			break
+		}
+		flag, body := d.partial[0], d.partial[frameHeader:frameHeader+n]
+
+		switch flag {
+		case frameStored:
+			out = append(out, body...)
+		case frameDeflated:
+			inflated, err := d.inflate(body)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, inflated...)
+		default:
+			return nil, fmt.Errorf("unknown compression frame type %d", flag)
+		}
+		d.partial = d.partial[frameHeader+n:]
+	}
+	return out, nil
+}
+
+// inflate decompresses one frame body, which can't expand past
+// maxCompressChunk
+func (d *frameDecompressor) inflate(body []byte) ([]byte, error) {
+	if d.r == nil {
+		d.r = flate.NewReader(bytes.NewReader(body))
+	} else {
+		d.r.(flate.Resetter).Reset(bytes.NewReader(body), nil)
+	}
+
+	inflated, err := io.ReadAll(io.LimitReader(d.r, maxCompressChunk+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress frame: %w", err)
+	}
+	if len(inflated) > maxCompressChunk {
+		return nil, fmt.Errorf("compressed frame expands past %d bytes", maxCompressChunk)
+	}
+	return inflated, nil
+}
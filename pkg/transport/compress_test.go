@@ -0,0 +1,90 @@
+package transport
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	dnspkg "github.com/getlantern/lantern/slipstream/pkg/dns"
+)
+
+const testDomain = "tunnel.example.com"
+
+// encodeNames returns the query names carrying data under testDomain
+func encodeNames(t *testing.T, data []byte) []string {
+	t.Helper()
+	enc, err := dnspkg.NewSubdomainEncoder(testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc.Write(data)
+	enc.Close()
+
+	var names []string
+	for name, ok := enc.Next(); ok; name, ok = enc.Next() {
+		names = append(names, name)
+	}
+	return names
+}
+
+// totalLen returns the combined length of names
+func totalLen(names []string) int {
+	n := 0
+	for _, name := range names {
+		n += len(name)
+	}
+	return n
+}
+
+func TestCompressionShrinksRedundantPayload(t *testing.T) {
+	var data []byte
+	for i := 0; len(data) < 100<<10; i++ {
+		data = fmt.Appendf(data, `{"id":%d,"status":"ok","items":["alpha","beta","gamma"]}`+"\n", i)
+	}
+
+	frames := newFrameCompressor(flate.DefaultCompression).compress(data)
+	plain, compressed := encodeNames(t, data), encodeNames(t, frames)
+	if len(compressed)*4 > len(plain) {
+		t.Fatalf("compressed payload took %d names, uncompressed %d", len(compressed), len(plain))
+	}
+	if totalLen(compressed)*4 > totalLen(plain) {
+		t.Fatalf("compressed names took %d bytes, uncompressed %d", totalLen(compressed), totalLen(plain))
+	}
+
+	// Frames are restored whatever messages they arrive split across
+	d := &frameDecompressor{}
+	var got []byte
+	for rest := frames; len(rest) > 0; {
+		n := min(len(rest), 100)
+		out, err := d.decompress(rest[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, out...)
+		rest = rest[n:]
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("decompressed %d bytes, differing from the %d compressed", len(got), len(data))
+	}
+}
+
+func TestCompressionStoresIncompressiblePayload(t *testing.T) {
+	data := make([]byte, 100<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	frames := newFrameCompressor(flate.BestCompression).compress(data)
+	chunks := (len(data) + maxCompressChunk - 1) / maxCompressChunk
+	if len(frames) != len(data)+chunks*frameHeader {
+		t.Fatalf("%d random bytes took %d bytes of frames, want %d", len(data), len(frames), len(data)+chunks*frameHeader)
+	}
+
+	got, err := (&frameDecompressor{}).decompress(frames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("stored frames changed the data")
+	}
+}
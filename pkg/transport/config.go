@@ -0,0 +1,148 @@
+package transport
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Default QUIC flow-control windows. They are raised from quic-go's defaults
+// (512 KB / 6 MB per stream, 768 KB / 15 MB per connection) so a single bulk
+// transfer isn't throttled by flow control on high-latency paths.
+const (
+	DefaultInitialStreamReceiveWindow     = 1 << 20  // 1 MB
+	DefaultMaxStreamReceiveWindow         = 16 << 20 // 16 MB
+	DefaultInitialConnectionReceiveWindow = 2 << 20  // 2 MB
+	DefaultMaxConnectionReceiveWindow     = 32 << 20 // 32 MB
+)
+
+const (
+	// DefaultKeepAlivePeriod is how often an idle connection sends a QUIC
+	// PING to keep itself and NAT bindings along the path alive
+	DefaultKeepAlivePeriod = 15 * time.Second
+	// DefaultMaxIdleTimeout is how long a connection may go without packets
+	// from the peer before it is closed
+	DefaultMaxIdleTimeout = 30 * time.Second
+)
+
+const (
+	// DefaultReadBufferSize is the default size of the buffer a stream
+	// wrapper reads framed DNS messages through
+	DefaultReadBufferSize = 4096
+	// MaxReadBufferSize fits the largest DNS message plus its 2-byte length
+	// prefix
+	MaxReadBufferSize = 64 << 10
+)
+
+// Config holds the connection settings shared by Client and
+// Server. Client and server must use the same ALPN and SNI, otherwise the
+// TLS handshake fails.
+type Config struct {
+	// ALPN is the application protocol negotiated during the TLS handshake
+	ALPN string
+	// SNI is the server name sent by the client and required by the server.
+	// The server's self-signed certificate is issued for this name.
+	SNI string
+	// Cert configures the server's self-signed certificate
+	Cert CertConfig
+
+	// Flow-control windows, in bytes. The initial windows grow up to the
+	// maximums as the connection's bandwidth-delay product is measured.
+	// Zero selects the corresponding default.
+	InitialStreamReceiveWindow     uint64
+	MaxStreamReceiveWindow         uint64
+	InitialConnectionReceiveWindow uint64
+	MaxConnectionReceiveWindow     uint64
+
+	// ReadBufferSize is the size of the buffer each stream reads framed DNS
+	// messages through, up to MaxReadBufferSize. Messages larger than the
+	// buffer are still read whole. Zero selects DefaultReadBufferSize.
+	ReadBufferSize int
+
+	// HandshakeIdleTimeout is how long a QUIC handshake may go without a
+	// packet from the peer before it fails. Zero selects quic-go's default
+	// of 5 seconds.
+	HandshakeIdleTimeout time.Duration
+
+	// KeepAlivePeriod is how often an idle connection sends a keep-alive.
+	// Zero selects DefaultKeepAlivePeriod and a negative value disables
+	// keep-alives, so an idle connection closes after MaxIdleTimeout.
+	// quic-go caps the period at half the idle timeout.
+	KeepAlivePeriod time.Duration
+	// MaxIdleTimeout is how long a connection may go without packets from
+	// the peer before it is closed. The smaller of the two ends' values
+	// applies. Zero selects DefaultMaxIdleTimeout.
+	MaxIdleTimeout time.Duration
+
+	// Logger receives the client's or server's log messages. Per-connection
+	// and per-stream messages are logged at debug level. Nil selects
+	// slog.Default().
+	Logger *slog.Logger
+}
+
+// DefaultConfig returns the default transport configuration
+func DefaultConfig() Config {
+	return Config{
+		ALPN:                           ALPN,
+		SNI:                            SNI,
+		InitialStreamReceiveWindow:     DefaultInitialStreamReceiveWindow,
+		MaxStreamReceiveWindow:         DefaultMaxStreamReceiveWindow,
+		InitialConnectionReceiveWindow: DefaultInitialConnectionReceiveWindow,
+		MaxConnectionReceiveWindow:     DefaultMaxConnectionReceiveWindow,
+		ReadBufferSize:                 DefaultReadBufferSize,
+		KeepAlivePeriod:                DefaultKeepAlivePeriod,
+		MaxIdleTimeout:                 DefaultMaxIdleTimeout,
+	}
+}
+
+func (c Config) withDefaults() Config {
+	if c.ALPN == "" {
+		c.ALPN = ALPN
+	}
+	if c.SNI == "" {
+		c.SNI = SNI
+	}
+	if c.InitialStreamReceiveWindow == 0 {
+		c.InitialStreamReceiveWindow = DefaultInitialStreamReceiveWindow
+	}
+	if c.MaxStreamReceiveWindow == 0 {
+		c.MaxStreamReceiveWindow = DefaultMaxStreamReceiveWindow
+	}
+	if c.InitialConnectionReceiveWindow == 0 {
+		c.InitialConnectionReceiveWindow = DefaultInitialConnectionReceiveWindow
+	}
+	if c.MaxConnectionReceiveWindow == 0 {
+		c.MaxConnectionReceiveWindow = DefaultMaxConnectionReceiveWindow
+	}
+	if c.ReadBufferSize <= 0 {
+		c.ReadBufferSize = DefaultReadBufferSize
+	}
+	if c.ReadBufferSize > MaxReadBufferSize {
+		c.ReadBufferSize = MaxReadBufferSize
+	}
+	if c.KeepAlivePeriod == 0 {
+		c.KeepAlivePeriod = DefaultKeepAlivePeriod
+	}
+	if c.MaxIdleTimeout <= 0 {
+		c.MaxIdleTimeout = DefaultMaxIdleTimeout
+	}
+	if c.Logger == nil {
+		c.Logger = slog.Default()
+	}
+	return c
+}
+
+// quicConfig returns the QUIC configuration shared by client and server
+func (c Config) quicConfig() *quic.Config {
+	return &quic.Config{
+		EnableDatagrams:                true,
+		InitialStreamReceiveWindow:     c.InitialStreamReceiveWindow,
+		MaxStreamReceiveWindow:         c.MaxStreamReceiveWindow,
+		InitialConnectionReceiveWindow: c.InitialConnectionReceiveWindow,
+		MaxConnectionReceiveWindow:     c.MaxConnectionReceiveWindow,
+		HandshakeIdleTimeout:           c.HandshakeIdleTimeout,
+		KeepAlivePeriod:                max(c.KeepAlivePeriod, 0),
+		MaxIdleTimeout:                 c.MaxIdleTimeout,
+	}
+}
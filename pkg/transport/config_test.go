@@ -0,0 +1,55 @@
+package transport_test
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/getlantern/lantern/slipstream/pkg/slipstreamtest"
+	"github.com/getlantern/lantern/slipstream/pkg/transport"
+)
+
+func TestKeepAliveOutlastsIdleTimeout(t *testing.T) {
+	const idleTimeout = 500 * time.Millisecond
+
+	for _, tc := range []struct {
+		name      string
+		keepAlive time.Duration
+		alive     bool
+	}{
+		{"keep-alives", 100 * time.Millisecond, true},
+		{"no keep-alives", -1, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := transport.DefaultConfig()
+			config.KeepAlivePeriod = tc.keepAlive
+			config.MaxIdleTimeout = idleTimeout
+			h, err := slipstreamtest.NewWithOptions(transport.EchoHandler{}, slipstreamtest.Options{Config: config})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { h.Close() })
+
+			time.Sleep(3 * idleTimeout)
+			if h.Client.Connected() != tc.alive {
+				t.Fatalf("Connected() = %v after %v idle, want %v", h.Client.Connected(), 3*idleTimeout, tc.alive)
+			}
+			if !tc.alive {
+				return
+			}
+
+			stream, err := h.Client.OpenStream(testContext(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stream.Close()
+			if _, err := stream.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			reply := make([]byte, 4)
+			if _, err := io.ReadFull(stream, reply); err != nil || string(reply) != "ping" {
+				t.Fatalf("echoed %q, %v", reply, err)
+			}
+		})
+	}
+}
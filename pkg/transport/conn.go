@@ -0,0 +1,77 @@
+package transport
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Addr is the synthetic network address of a tunnel stream
+type Addr struct {
+	Domain   string
+	StreamID int64
+}
+
+// Network returns the address's network name
+func (a Addr) Network() string {
+	return "slipstream"
+}
+
+func (a Addr) String() string {
+	return fmt.Sprintf("%s/%d", a.Domain, a.StreamID)
+}
+
+// deadlineStream is a tunnel stream whose deadlines can be set, as
+// implemented by the DNS stream wrappers on both ends
+type deadlineStream interface {
+	io.ReadWriteCloser
+	SetDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// StreamConn adapts a tunnel stream to the net.Conn interface so it can be
+// used with libraries such as net/http and crypto/tls. Deadlines are
+// delegated to the underlying QUIC stream.
+type StreamConn struct {
+	deadlineStream
+	local  net.Addr
+	remote net.Addr
+}
+
+var _ net.Conn = (*StreamConn)(nil)
+
+// CloseWrite closes the sending side of the stream, so the peer reads EOF
+// while the stream can still be read from, like net.TCPConn.CloseWrite
+func (c *StreamConn) CloseWrite() error {
+	if cw, ok := c.deadlineStream.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return fmt.Errorf("stream does not support half-close")
+}
+
+// LocalAddr returns the synthetic local address of the stream
+func (c *StreamConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr returns the synthetic remote address of the stream
+func (c *StreamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// writeFull writes all of p to w, retrying after short writes
+func writeFull(w io.Writer, p []byte) error {
+	for len(p) > 0 {
+		n, err := w.Write(p)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		p = p[n:]
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// shortWriter accepts at most max bytes per write. Once it has made left
+// writes, unless left is negative, it accepts nothing and returns err.
+type shortWriter struct {
+	bytes.Buffer
+	max  int
+	left int
+	err  error
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if w.left == 0 {
+		return 0, w.err
+	}
+	w.left--
+	return w.Buffer.Write(p[:min(len(p), w.max)])
+}
+
+func TestWriteFull(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	errBroken := errors.New("broken")
+
+	for _, tc := range []struct {
+		name    string
+		w       *shortWriter
+		want    int
+		wantErr error
+	}{
+		{"whole write", &shortWriter{max: len(data), left: -1}, len(data), nil},
+		{"short writes", &shortWriter{max: 7, left: -1}, len(data), nil},
+		{"single bytes", &shortWriter{max: 1, left: -1}, len(data), nil},
+		{"no progress", &shortWriter{max: 7, left: 3}, 21, io.ErrShortWrite},
+		{"no progress at first", &shortWriter{max: 7}, 0, io.ErrShortWrite},
+		{"error", &shortWriter{max: 7, left: 3, err: errBroken}, 21, errBroken},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := writeFull(tc.w, data)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("writeFull returned %v, want %v", err, tc.wantErr)
+			}
+			if !bytes.Equal(tc.w.Bytes(), data[:tc.want]) {
+				t.Fatalf("wrote %d bytes, want the first %d", tc.w.Len(), tc.want)
+			}
+		})
+	}
+}
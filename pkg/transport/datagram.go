@@ -0,0 +1,110 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// DefaultMaxDatagramSize is the initial datagram payload limit. It fits in
+	// the 1200-byte minimum packet every QUIC path must carry, after packet
+	// header, AEAD tag and DATAGRAM frame overhead.
+	DefaultMaxDatagramSize = 1150
+
+	// datagramFrameOverhead is the most a DATAGRAM frame adds to its payload:
+	// a type byte and a varint length of up to 2 bytes for sizes below 16KB
+	datagramFrameOverhead = 3
+)
+
+// ErrDatagramTooLarge is returned when a message exceeds the current maximum
+// datagram size. The message is not sent; the caller should carry less
+// data per message and retry.
+var ErrDatagramTooLarge = errors.New("message exceeds maximum datagram size")
+
+// DatagramSender sends DNS messages as QUIC datagrams without exceeding the
+// connection's maximum datagram size. quic-go only reveals the peer's limit
+// when a send fails and silently drops datagrams that don't fit the path,
+// so the sender keeps its own estimate, lowering it when the connection
+// rejects a datagram and letting callers adjust it as the path MTU changes.
+type DatagramSender struct {
+	conn quic.Connection
+
+	mu           sync.Mutex
+	maxSize      int
+	onSizeChange func(size int)
+}
+
+// NewDatagramSender creates a sender for conn, which must have been
+// established with datagrams enabled
+func NewDatagramSender(conn quic.Connection) *DatagramSender {
+	return &DatagramSender{
+		conn:    conn,
+		maxSize: DefaultMaxDatagramSize,
+	}
+}
+
+// SetSizeChangeCallback sets a function called with the new limit whenever
+// the maximum datagram size changes
+func (s *DatagramSender) SetSizeChangeCallback(fn func(size int)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onSizeChange = fn
+}
+
+// MaxSize returns the current maximum datagram payload size
+func (s *DatagramSender) MaxSize() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.maxSize
+}
+
+// SetMaxSize sets the maximum datagram payload size, for callers that learn
+// the path MTU by other means
+func (s *DatagramSender) SetMaxSize(size int) {
+	s.setMaxSize(size)
+}
+
+// Send sends msg as a single datagram. Oversized messages are rejected with
+// an error wrapping ErrDatagramTooLarge.
+func (s *DatagramSender) Send(msg *dns.Msg) error {
+	packed, err := msg.Pack()
+	if err != nil {
+		return fmt.Errorf("failed to pack DNS message: %w", err)
+	}
+
+	if limit := s.MaxSize(); len(packed) > limit {
+		return fmt.Errorf("%w: %d bytes, limit %d", ErrDatagramTooLarge, len(packed), limit)
+	}
+
+	err = s.conn.SendDatagram(packed)
+	var tooLarge *quic.DatagramTooLargeError
+	if errors.As(err, &tooLarge) {
+		limit := int(tooLarge.PeerMaxDatagramFrameSize) - datagramFrameOverhead
+		s.setMaxSize(min(limit, len(packed)-1))
+		return fmt.Errorf("%w: %d bytes, limit %d", ErrDatagramTooLarge, len(packed), s.MaxSize())
+	}
+	if err != nil {
+		return fmt.Errorf("failed to send datagram: %w", err)
+	}
+	return nil
+}
+
+func (s *DatagramSender) setMaxSize(size int) {
+	if size < 0 {
+		size = 0
+	}
+
+	s.mu.Lock()
+	changed := size != s.maxSize
+	s.maxSize = size
+	fn := s.onSizeChange
+	s.mu.Unlock()
+
+	if changed && fn != nil {
+		fn(size)
+	}
+}
@@ -0,0 +1,50 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// Dialer dials TCP and UDP addresses through a connected Client. Each
+// connection is a new tunnel stream whose prologue asks the server to connect
+// to addr, so DialContext can be used as http.Transport.DialContext. UDP
+// connections carry one datagram per Read and Write.
+type Dialer struct {
+	client *Client
+}
+
+// NewDialer creates a dialer that tunnels connections through client
+func NewDialer(client *Client) *Dialer {
+	return &Dialer{
+		client: client,
+	}
+}
+
+// Dial connects to the address on the named network through the tunnel
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to the address on the named network through the tunnel
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	target := addr
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	case "udp", "udp4", "udp6":
+		target = "udp://" + addr
+	default:
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+
+	ds, err := d.client.openStream(ctx, target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s through tunnel: %w", addr, err)
+	}
+
+	conn := d.client.newStreamConn(ds)
+	if target != addr {
+		conn.deadlineStream = datagramConn{ds}
+	}
+	return conn, nil
+}
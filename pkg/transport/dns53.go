@@ -0,0 +1,135 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// DNSClient tunnels streams through plain DNS queries sent to a resolver,
+// which forwards them to the server's ServeDNS as to any authoritative
+// server, using sessions in place of QUIC. Nothing protects the data on the
+// way, so the streams carried should be encrypted end to end, such as TLS.
+type DNSClient struct {
+	*SessionClient
+	resolver string
+	udp      *dns.Client
+	tcp      *dns.Client
+}
+
+// NewDNSClient creates a client that sends queries for domain to the DNS
+// resolver at resolverAddr, a host:port such as "1.1.1.1:53". Queries go
+// over UDP and are retried over TCP when a response is truncated.
+func NewDNSClient(resolverAddr, domain string) *DNSClient {
+	c := &DNSClient{
+		resolver: resolverAddr,
+		udp:      &dns.Client{Net: "udp", Timeout: sessionQueryTimeout},
+		tcp:      &dns.Client{Net: "tcp", Timeout: sessionQueryTimeout},
+	}
+	c.SessionClient = NewSessionClient(domain, c.exchange)
+	return c
+}
+
+// exchange sends query to the resolver and returns the response
+func (c *DNSClient) exchange(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	// The UDP buffer must hold the largest response the query allows
+	c.udp.UDPSize = uint16(c.dnsConfig.MaxResponseSize())
+
+	resp, _, err := c.udp.ExchangeContext(ctx, query, c.resolver)
+	if err == nil && resp.Truncated {
+		resp, _, err = c.tcp.ExchangeContext(ctx, query, c.resolver)
+	}
+	return resp, err
+}
+
+// ServeDNS answers DNS queries carrying the sessions of DNSClient, making
+// the server a dns.Handler for github.com/miekg/dns servers. Each session
+// is passed to the server's handler like a QUIC stream. Sessions have no
+// authentication, so a server with an Authenticator refuses them.
+func (s *Server) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	var resp *dns.Msg
+	if r.Opcode != dns.OpcodeQuery || len(r.Question) != 1 {
+		resp = new(dns.Msg)
+		resp.SetRcode(r, dns.RcodeFormatError)
+	} else {
+		resp = s.ServeQuery(r, w.RemoteAddr(), w.LocalAddr())
+	}
+	// Answer as the authority for the tunnel domains
+	resp.Authoritative = true
+
+	if err := w.WriteMsg(resp); err != nil {
+		s.log.Debug("Failed to send DNS response", "remote", w.RemoteAddr(), "error", err)
+	}
+}
+
+// ListenDNS serves DNS on the listen address over both UDP and TCP, like an
+// authoritative server for the tunnel domains. It runs in place of Listen
+// and returns once ctx is done or Shutdown is called, ending every session.
+func (s *Server) ListenDNS(ctx context.Context) error {
+	pc, err := net.ListenPacket("udp", s.listenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to start UDP listener: %w", err)
+	}
+	listener, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		return fmt.Errorf("failed to start TCP listener: %w", err)
+	}
+
+	servers := []*dns.Server{
+		{PacketConn: pc, Handler: s},
+		{Listener: listener, Handler: s},
+	}
+	// Closing the sockets also stops servers that haven't started yet,
+	// which Shutdown doesn't
+	stopServers := func() {
+		for _, server := range servers {
+			server.Shutdown()
+		}
+		pc.Close()
+		listener.Close()
+	}
+
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		stopServers()
+		return ErrServerClosed
+	}
+	s.stopDNS = stopServers
+	s.mu.Unlock()
+	defer s.sessions.closeAll()
+
+	stop := context.AfterFunc(ctx, stopServers)
+	defer stop()
+
+	s.log.Info("Server listening for DNS", "addr", pc.LocalAddr())
+	errs := make(chan error, len(servers))
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *dns.Server) {
+			defer wg.Done()
+			errs <- server.ActivateAndServe()
+		}(server)
+	}
+
+	// Either server failing stops the other
+	err = <-errs
+	stopServers()
+	wg.Wait()
+
+	switch {
+	case s.shuttingDown():
+		return ErrServerClosed
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case err == nil:
+		err = errors.New("server stopped")
+	}
+	return fmt.Errorf("DNS server failed: %w", err)
+}
@@ -0,0 +1,214 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// DoHPath is the path ListenDoH serves DNS-over-HTTPS queries on
+	DoHPath = "/dns-query"
+
+	// dohMediaType is the content type of DNS messages in DNS-over-HTTPS
+	// requests and responses (RFC 8484)
+	dohMediaType = "application/dns-message"
+)
+
+// DoHClient tunnels streams through DNS-over-HTTPS queries POSTed to a
+// server's ServeHTTP, using sessions in place of QUIC. The HTTPS connection
+// protects the data on its way to the server, but sessions are neither
+// authenticated with a PSK nor compressed.
+type DoHClient struct {
+	*SessionClient
+	url       string
+	tlsConfig *tls.Config
+	pin       []byte
+	insecure  bool
+
+	httpOnce   sync.Once
+	httpClient *http.Client
+}
+
+// NewDoHClient creates a client that sends queries for domain to the
+// DNS-over-HTTPS endpoint url, such as "https://example.com/dns-query"
+func NewDoHClient(url, domain string) *DoHClient {
+	c := &DoHClient{
+		url:       url,
+		tlsConfig: &tls.Config{},
+	}
+	c.SessionClient = NewSessionClient(domain, c.exchange)
+	return c
+}
+
+// SetRootCAs makes the client verify the endpoint's certificate chain
+// against pool instead of the system roots. It must be called before
+// opening streams.
+func (c *DoHClient) SetRootCAs(pool *x509.CertPool) {
+	c.tlsConfig.RootCAs = pool
+}
+
+// SetServerCertPin makes the client accept only an endpoint certificate
+// whose key matches pin, as returned by CertificatePin. It must be called
+// before opening streams.
+func (c *DoHClient) SetServerCertPin(pin string) error {
+	digest, err := parsePin(pin)
+	if err != nil {
+		return err
+	}
+	c.pin = digest
+	return nil
+}
+
+// SetInsecureSkipVerify disables verification of the endpoint's
+// certificate. It must be called before opening streams.
+func (c *DoHClient) SetInsecureSkipVerify(skip bool) {
+	c.insecure = skip
+}
+
+// exchange POSTs query to the endpoint and returns the response
+func (c *DoHClient) exchange(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	c.httpOnce.Do(func() {
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		tr.TLSClientConfig = verifiedTLSConfig(c.tlsConfig, c.pin, c.insecure)
+		c.httpClient = &http.Client{Transport: tr}
+	})
+
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack DNS query: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohMediaType)
+	req.Header.Set("Accept", dohMediaType)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH request failed: %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DoH response: %w", err)
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(body); err != nil {
+		return nil, fmt.Errorf("failed to parse DNS response: %w", err)
+	}
+	return msg, nil
+}
+
+// ServeHTTP answers DNS-over-HTTPS queries (RFC 8484), by POST or GET,
+// carrying the sessions of DoHClient. Each session is passed to the
+// server's handler like a QUIC stream. Sessions have no authentication, so
+// a server with an Authenticator refuses them.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var packed []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		packed, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != dohMediaType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		packed, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := new(dns.Msg)
+	if err == nil {
+		err = query.Unpack(packed)
+	}
+	if err != nil || len(query.Question) != 1 {
+		http.Error(w, "invalid DNS query", http.StatusBadRequest)
+		return
+	}
+
+	var remote, local net.Addr
+	if addrPort, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		remote = net.TCPAddrFromAddrPort(addrPort)
+	}
+	local, _ = r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+
+	resp, err := s.ServeQuery(query, remote, local).Pack()
+	if err != nil {
+		s.log.Warn("Failed to pack DNS response", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", dohMediaType)
+	w.Write(resp)
+}
+
+// ListenDoH serves DNS-over-HTTPS on the listen address over TCP, at
+// DoHPath, with the server's certificate. It runs in place of Listen and
+// returns once ctx is done or Shutdown is called, ending every session.
+func (s *Server) ListenDoH(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.listenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to start listener: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(DoHPath, s)
+	server := &http.Server{
+		Handler: mux,
+		TLSConfig: &tls.Config{
+			NextProtos: []string{"h2", "http/1.1"},
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return s.cert.Load(), nil
+			},
+		},
+		ErrorLog: slog.NewLogLogger(s.log.Handler(), slog.LevelDebug),
+	}
+
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	s.dohServer = server
+	s.mu.Unlock()
+	defer s.sessions.closeAll()
+
+	stop := context.AfterFunc(ctx, func() { server.Close() })
+	defer stop()
+
+	s.log.Info("Server listening for DNS-over-HTTPS", "addr", listener.Addr())
+	err = server.ServeTLS(listener, "", "")
+	if errors.Is(err, http.ErrServerClosed) {
+		if s.shuttingDown() {
+			return ErrServerClosed
+		}
+		return ctx.Err()
+	}
+	return fmt.Errorf("DoH server failed: %w", err)
+}
@@ -0,0 +1,48 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// EchoHandler is a StreamHandler that writes every byte it reads back to
+// the client. Run a server with it to check the tunnel end to end with
+// Client.Echo.
+type EchoHandler struct{}
+
+var _ StreamHandler = EchoHandler{}
+
+// HandleStream copies the stream back to itself until the client closes it
+func (EchoHandler) HandleStream(ctx context.Context, stream io.ReadWriteCloser) error {
+	defer stream.Close()
+
+	if _, err := io.Copy(stream, stream); err != nil {
+		return fmt.Errorf("echo error: %w", err)
+	}
+	return nil
+}
+
+// Echo sends data on a new stream to a server running EchoHandler and
+// returns what comes back
+func (c *Client) Echo(ctx context.Context, data []byte) ([]byte, error) {
+	ds, err := c.openStream(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	defer ds.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		ds.SetDeadline(deadline)
+	}
+
+	if _, err := ds.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to send echo data: %w", err)
+	}
+
+	reply := make([]byte, len(data))
+	if _, err := io.ReadFull(ds, reply); err != nil {
+		return nil, fmt.Errorf("failed to read echo reply: %w", err)
+	}
+	return reply, nil
+}
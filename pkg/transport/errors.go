@@ -0,0 +1,103 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/quic-go/quic-go"
+
+	dnspkg "github.com/getlantern/lantern/slipstream/pkg/dns"
+)
+
+// QUIC application error codes used when closing connections and resetting
+// streams, so the peer can tell why a tunnel or stream went away
+const (
+	// ErrorCodeNone is used for orderly closes
+	ErrorCodeNone quic.ApplicationErrorCode = 0
+	// ErrorCodeAuthFailed closes connections that fail authentication
+	ErrorCodeAuthFailed quic.ApplicationErrorCode = 1
+	// ErrorCodeShutdown closes connections when the server shuts down
+	ErrorCodeShutdown quic.ApplicationErrorCode = 2
+	// ErrorCodeTargetUnreachable resets streams whose target could not be
+	// dialed
+	ErrorCodeTargetUnreachable quic.ApplicationErrorCode = 3
+	// ErrorCodeTargetDenied resets streams whose target was rejected by the
+	// server's access control list
+	ErrorCodeTargetDenied quic.ApplicationErrorCode = 4
+	// ErrorCodeInternal is used for any other handler failure
+	ErrorCodeInternal quic.ApplicationErrorCode = 5
+	// ErrorCodeBusy closes connections and resets streams beyond the
+	// server's limits
+	ErrorCodeBusy quic.ApplicationErrorCode = 6
+)
+
+var (
+	// ErrTargetUnreachable is wrapped by handler errors for targets that could
+	// not be dialed
+	ErrTargetUnreachable = errors.New("target unreachable")
+	// ErrTargetDenied is wrapped by handler errors for targets the server is
+	// not allowed to connect to
+	ErrTargetDenied = errors.New("target denied by access control list")
+	// ErrDNSDecode is wrapped by stream errors for DNS messages that could
+	// not be parsed or carried no valid tunnel data
+	ErrDNSDecode = errors.New("invalid DNS message")
+	// ErrStreamClosed is returned by reads and writes of streams and
+	// sessions after they were closed. It wraps net.ErrClosed.
+	ErrStreamClosed = fmt.Errorf("stream %w", net.ErrClosed)
+)
+
+// dataError describes a failure to extract tunnel data from a DNS message,
+// what, wrapping ErrDNSDecode unless the message was a well-formed error
+// response
+func dataError(what string, err error) error {
+	if errors.Is(err, dnspkg.ErrNXDomain) || errors.Is(err, dnspkg.ErrRcode) || errors.Is(err, dnspkg.ErrTruncated) || dnspkg.IsRetryable(err) {
+		return fmt.Errorf("failed to extract data from %s: %w", what, err)
+	}
+	return fmt.Errorf("%w: failed to extract data from %s: %w", ErrDNSDecode, what, err)
+}
+
+// IsClosed reports whether err only says that a stream or connection ended
+// the way they normally do: io.EOF, net.ErrClosed such as ErrStreamClosed,
+// context.Canceled, or a stream reset or connection close with
+// ErrorCodeNone or ErrorCodeShutdown. Anything else is a failure.
+func IsClosed(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || errors.Is(err, context.Canceled) {
+		return true
+	}
+	code, ok := ErrorCode(err)
+	return ok && (code == ErrorCodeNone || code == ErrorCodeShutdown)
+}
+
+// ErrorCode extracts the application error code from an error returned by a
+// closed connection or reset stream. It reports false if err carries none.
+func ErrorCode(err error) (quic.ApplicationErrorCode, bool) {
+	var appErr *quic.ApplicationError
+	if errors.As(err, &appErr) {
+		return appErr.ErrorCode, true
+	}
+
+	var streamErr *quic.StreamError
+	if errors.As(err, &streamErr) {
+		return quic.ApplicationErrorCode(streamErr.ErrorCode), true
+	}
+
+	return 0, false
+}
+
+// streamErrorCode maps a handler error to the code used to reset its stream
+func streamErrorCode(err error) quic.StreamErrorCode {
+	switch {
+	case errors.Is(err, ErrTargetDenied):
+		return quic.StreamErrorCode(ErrorCodeTargetDenied)
+	case errors.Is(err, ErrTargetUnreachable):
+		return quic.StreamErrorCode(ErrorCodeTargetUnreachable)
+	default:
+		return quic.StreamErrorCode(ErrorCodeInternal)
+	}
+}
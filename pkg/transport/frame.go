@@ -0,0 +1,93 @@
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maxFrameSize is the largest DNS message or datagram a frame can carry
+const maxFrameSize = 0xFFFF
+
+// DNS messages are framed on QUIC streams as in DNS over TCP (RFC 1035
+// section 4.2.2): each is preceded by its length as a 2-byte big-endian
+// integer. QUIC streams are byte streams, so without framing a read could
+// return part of a message or several coalesced ones.
+
+// writeFrame writes msg to w preceded by its length
+func writeFrame(w io.Writer, msg []byte) error {
+	if len(msg) > maxFrameSize {
+		return fmt.Errorf("message of %d bytes exceeds the %d byte frame limit", len(msg), maxFrameSize)
+	}
+
+	frame := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(frame, uint16(len(msg)))
+	return writeFull(w, append(frame, msg...))
+}
+
+// frameLen returns the number of bytes msg takes up on a stream once framed
+func frameLen(msg []byte) int {
+	return 2 + len(msg)
+}
+
+// readFrame reads the next framed DNS message from r. It returns io.EOF if
+// the stream ends cleanly between frames and io.ErrUnexpectedEOF if it ends
+// inside one.
+func readFrame(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+// DatagramStream carries datagrams over a stream, each framed like a DNS
+// message with a 2-byte length prefix so boundaries are preserved. Every Read
+// returns one whole datagram and every Write sends one. It is the format of
+// streams to udp:// targets.
+type DatagramStream struct {
+	io.ReadWriteCloser
+}
+
+// Read reads the next datagram into p. It fails with io.ErrShortBuffer if
+// the datagram is larger than p.
+func (s *DatagramStream) Read(p []byte) (int, error) {
+	msg, err := readFrame(s.ReadWriteCloser)
+	if err != nil {
+		return 0, err
+	}
+	if len(msg) > len(p) {
+		return 0, io.ErrShortBuffer
+	}
+	return copy(p, msg), nil
+}
+
+// Write sends p as one datagram
+func (s *DatagramStream) Write(p []byte) (int, error) {
+	if err := writeFrame(s.ReadWriteCloser, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// datagramConn adds deadlines to a DatagramStream over a tunnel stream
+type datagramConn struct {
+	deadlineStream
+}
+
+func (c datagramConn) Read(p []byte) (int, error) {
+	return (&DatagramStream{c.deadlineStream}).Read(p)
+}
+
+func (c datagramConn) Write(p []byte) (int, error) {
+	return (&DatagramStream{c.deadlineStream}).Write(p)
+}
@@ -0,0 +1,64 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	dnspkg "github.com/getlantern/lantern/slipstream/pkg/dns"
+	"github.com/miekg/dns"
+)
+
+func TestReadFrameReassemblesSplitMessages(t *testing.T) {
+	var queries [][]byte
+	for _, data := range []string{"first", "second message"} {
+		msg, err := dnspkg.CreateQuery([]byte(data), "tunnel.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		packed, err := msg.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		queries = append(queries, packed)
+	}
+
+	// Both messages written back to back, and read a byte at a time
+	var stream bytes.Buffer
+	for _, packed := range queries {
+		if err := writeFrame(&stream, packed); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := iotest.OneByteReader(&stream)
+
+	for i, want := range queries {
+		got, err := readFrame(r)
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("message %d: got %d bytes, want %d", i, len(got), len(want))
+		}
+		if err := new(dns.Msg).Unpack(got); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+	if _, err := readFrame(r); err != io.EOF {
+		t.Fatalf("got %v after the last message, want EOF", err)
+	}
+}
+
+func TestReadFrameTruncated(t *testing.T) {
+	var stream bytes.Buffer
+	if err := writeFrame(&stream, []byte("message")); err != nil {
+		t.Fatal(err)
+	}
+	stream.Truncate(stream.Len() - 1)
+
+	if _, err := readFrame(&stream); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("got %v for a truncated frame, want io.ErrUnexpectedEOF", err)
+	}
+}
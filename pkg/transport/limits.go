@@ -0,0 +1,63 @@
+package transport
+
+import (
+	"github.com/quic-go/quic-go"
+)
+
+// SetMaxConnections limits how many client connections the server handles
+// at once. Connections beyond the limit are closed with ErrorCodeBusy as
+// soon as they are accepted. Zero, the default, means no limit. It must be
+// called before Listen.
+func (s *Server) SetMaxConnections(n int) {
+	s.connSlots = newSemaphore(n)
+}
+
+// SetMaxStreams limits how many streams of one connection the server
+// handles at once. Streams beyond the limit are reset with ErrorCodeBusy.
+// Zero, the default, means no limit.
+func (s *Server) SetMaxStreams(n int) {
+	s.maxStreams = n
+}
+
+// semaphore bounds concurrent work; a nil semaphore never blocks
+type semaphore chan struct{}
+
+func newSemaphore(n int) semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
+
+// tryAcquire takes a slot if one is free, without waiting
+func (s semaphore) tryAcquire() bool {
+	if s == nil {
+		return true
+	}
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s semaphore) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+// rejectConnection closes a connection accepted beyond the connection limit
+func (s *Server) rejectConnection(conn quic.Connection) {
+	s.log.Warn("Rejected connection: too many connections", "remote", conn.RemoteAddr())
+	conn.CloseWithError(ErrorCodeBusy, "too many connections")
+}
+
+// rejectStream resets a stream opened beyond the server's limits, logging
+// the reason
+func (s *Server) rejectStream(conn quic.Connection, stream quic.Stream, reason string) {
+	s.log.Warn("Rejected stream: "+reason, "remote", conn.RemoteAddr(), "stream", stream.StreamID())
+	stream.CancelRead(quic.StreamErrorCode(ErrorCodeBusy))
+	stream.CancelWrite(quic.StreamErrorCode(ErrorCodeBusy))
+}
@@ -0,0 +1,211 @@
+package transport_test
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+
+	"github.com/getlantern/lantern/slipstream/pkg/slipstreamtest"
+	"github.com/getlantern/lantern/slipstream/pkg/transport"
+)
+
+// byteEcho answers each stream's first byte and then closes it
+type byteEcho struct{}
+
+func (byteEcho) HandleStream(ctx context.Context, stream io.ReadWriteCloser) error {
+	defer stream.Close()
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(stream, b); err != nil {
+		return err
+	}
+	_, err := stream.Write(b)
+	return err
+}
+
+// holdHandler keeps every stream open until the client closes it
+type holdHandler struct{}
+
+func (holdHandler) HandleStream(ctx context.Context, stream io.ReadWriteCloser) error {
+	defer stream.Close()
+	_, err := io.Copy(io.Discard, stream)
+	return err
+}
+
+// limitedServer starts a server passing streams to handler, configured by
+// setup, and returns a function connecting a new client to it
+func limitedServer(t *testing.T, handler transport.StreamHandler, setup func(*transport.Server)) func() *transport.Client {
+	t.Helper()
+	serverConn, clientConn := slipstreamtest.PacketPipe()
+	t.Cleanup(func() {
+		serverConn.Close()
+		clientConn.Close()
+	})
+
+	server, err := transport.NewServer(serverConn.LocalAddr().String(), slipstreamtest.Domain, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SetPacketConn(serverConn)
+	setup(server)
+	pin, err := server.CertificatePin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.Listen(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	// The clients share one socket, as clients behind one address do
+	tr := &quic.Transport{Conn: clientConn}
+	t.Cleanup(func() { tr.Close() })
+
+	return func() *transport.Client {
+		client := transport.NewClient(serverConn.LocalAddr().String(), slipstreamtest.Domain)
+		client.SetTransport(tr)
+		client.SetReconnect(0, 0)
+		if err := client.SetServerCertPin(pin); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Connect(testContext(t)); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+		return client
+	}
+}
+
+// checkBusy fails the test unless err carries ErrorCodeBusy
+func checkBusy(t *testing.T, err error) {
+	t.Helper()
+	if code, ok := transport.ErrorCode(err); !ok || code != transport.ErrorCodeBusy {
+		t.Fatalf("got %v, want error code %d", err, transport.ErrorCodeBusy)
+	}
+}
+
+func TestMaxConnectionsRejectsExcess(t *testing.T) {
+	const limit = 2
+	connect := limitedServer(t, holdHandler{}, func(s *transport.Server) { s.SetMaxConnections(limit) })
+	ctx := testContext(t)
+
+	for i := 0; i < limit; i++ {
+		stream, err := connect().OpenStream(ctx)
+		if err != nil {
+			t.Fatalf("connection %d: %v", i, err)
+		}
+		defer stream.Close()
+	}
+
+	excess := connect()
+	deadline := time.Now().Add(10 * time.Second)
+	for excess.Connected() {
+		if time.Now().After(deadline) {
+			t.Fatal("connection over the limit is still open")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	checkBusy(t, excess.CloseError())
+	if _, err := excess.OpenStream(ctx); err == nil {
+		t.Fatal("opened a stream on the connection over the limit")
+	}
+}
+
+func TestMaxStreamsRejectsExcess(t *testing.T) {
+	const limit = 3
+	client := limitedServer(t, holdHandler{}, func(s *transport.Server) { s.SetMaxStreams(limit) })()
+	ctx := testContext(t)
+
+	var held []io.ReadWriteCloser
+	for i := 0; i < limit; i++ {
+		stream, err := client.OpenStream(ctx)
+		if err != nil {
+			t.Fatalf("stream %d: %v", i, err)
+		}
+		defer stream.Close()
+		held = append(held, stream)
+	}
+
+	// The server accepts streams in order, so the held streams have taken
+	// every slot by the time it accepts the next
+	stream, err := client.OpenStream(ctx)
+	if err != nil {
+		checkBusy(t, err)
+		return
+	}
+	defer stream.Close()
+	stream.(interface{ SetReadDeadline(time.Time) error }).SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, err = stream.Read(make([]byte, 1))
+	checkBusy(t, err)
+
+	// Streams within the limit are unaffected
+	if _, err := held[0].Write([]byte("still open")); err != nil {
+		t.Fatalf("held stream failed: %v", err)
+	}
+}
+
+func TestStreamRateLimitThrottles(t *testing.T) {
+	// 5 streams a second after a burst of 2: of 10 streams opened at once,
+	// 2 start at once, the next 5 are delayed by up to a second and the rest
+	// would wait too long and are rejected
+	client := limitedServer(t, byteEcho{}, func(s *transport.Server) { s.SetStreamRateLimit(5, 2) })()
+	ctx := testContext(t)
+
+	const streams = 10
+	type result struct {
+		elapsed time.Duration
+		err     error
+	}
+	results := make(chan result, streams)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < streams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stream, err := client.OpenStream(ctx)
+			if err != nil {
+				results <- result{err: err}
+				return
+			}
+			defer stream.Close()
+			stream.(interface{ SetDeadline(time.Time) error }).SetDeadline(time.Now().Add(10 * time.Second))
+			if _, err := stream.Write([]byte{1}); err != nil {
+				results <- result{err: err}
+				return
+			}
+			_, err = io.ReadFull(stream, make([]byte, 1))
+			results <- result{time.Since(start), err}
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	var admitted, rejected int
+	var slowest time.Duration
+	for r := range results {
+		if r.err != nil {
+			checkBusy(t, r.err)
+			rejected++
+			continue
+		}
+		admitted++
+		slowest = max(slowest, r.elapsed)
+	}
+	if admitted < 7 || rejected < 1 {
+		t.Fatalf("%d streams admitted and %d rejected, want at least 7 and 1", admitted, rejected)
+	}
+	if slowest < 800*time.Millisecond {
+		t.Fatalf("all %d admitted streams answered within %v", admitted, slowest)
+	}
+}
@@ -0,0 +1,107 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// ErrListenerClosed is returned by Listener.Accept after the listener is closed
+var ErrListenerClosed = errors.New("listener closed")
+
+// Listener exposes the streams accepted by a Server as net.Conns, so the
+// tunnel can carry any server built on net.Listener (http.Serve, gRPC, ...)
+// instead of the built-in proxy. Pass it to NewServer as the StreamHandler.
+type Listener struct {
+	addr    net.Addr
+	conns   chan net.Conn
+	closed  chan struct{}
+	closeMu sync.Once
+}
+
+var _ net.Listener = (*Listener)(nil)
+var _ StreamHandler = (*Listener)(nil)
+
+// NewListener creates a listener for streams tunneled under domain
+func NewListener(domain string) *Listener {
+	return &Listener{
+		addr:   Addr{Domain: domain},
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// HandleStream hands the stream to Accept and blocks until the returned
+// connection is closed, since the server closes the stream on return
+func (l *Listener) HandleStream(ctx context.Context, stream io.ReadWriteCloser) error {
+	ds, ok := stream.(*serverDNSStream)
+	if !ok {
+		return errors.New("listener requires a tunnel stream")
+	}
+
+	addr := Addr{Domain: ds.lastReply().domain, StreamID: ds.StreamID()}
+	conn := &listenerConn{
+		StreamConn: StreamConn{
+			deadlineStream: ds,
+			local:          addr,
+			remote:         addr,
+		},
+		done: make(chan struct{}),
+	}
+
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		return ErrListenerClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-conn.done:
+	case <-ctx.Done():
+		conn.Close()
+	}
+	return nil
+}
+
+// Accept waits for and returns the next tunneled stream
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Close stops accepting streams. Connections already accepted stay open.
+func (l *Listener) Close() error {
+	l.closeMu.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+// Addr returns the synthetic address of the listener
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
+
+// listenerConn signals HandleStream when the application closes it
+type listenerConn struct {
+	StreamConn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *listenerConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.StreamConn.Close()
+		close(c.done)
+	})
+	return err
+}
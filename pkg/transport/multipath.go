@@ -0,0 +1,181 @@
+package transport
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// The pinned quic-go has no multipath support, so each additional path is a
+// connection of its own from a different local address. Streams are spread
+// across the live connections, and a path that dies is redialed in the
+// background while the others carry its share.
+
+// clientPath is an additional connection to the server from one local
+// address
+type clientPath struct {
+	localAddr string
+
+	mu       sync.Mutex
+	conn     quic.Connection
+	features byte
+	dialing  bool
+	// retryAt is when a failed path may next be redialed
+	retryAt time.Time
+}
+
+// AddLocalAddr adds a path to the server from addr, of the form
+// "host[:port]" or a network interface name, alongside the one from
+// SetLocalAddr. Each path is a separate connection; streams are spread
+// across every live path, and when one fails its streams go to the others
+// while it is redialed. It takes effect on the next Connect.
+func (c *Client) AddLocalAddr(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.paths = append(c.paths, &clientPath{localAddr: addr})
+}
+
+// connectPaths connects every additional path that isn't already
+// connected, logging those that fail so they are retried when streams are
+// opened
+func (c *Client) connectPaths(ctx context.Context) {
+	c.mu.RLock()
+	paths := c.paths
+	c.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, p := range paths {
+		p.mu.Lock()
+		busy := p.dialing || p.conn != nil && p.conn.Context().Err() == nil
+		p.dialing = true
+		p.mu.Unlock()
+		if busy {
+			continue
+		}
+
+		wg.Add(1)
+		go func(p *clientPath) {
+			defer wg.Done()
+			c.dialPath(ctx, p)
+		}(p)
+	}
+	wg.Wait()
+}
+
+// dialPath connects p, which the caller has marked as dialing
+func (c *Client) dialPath(ctx context.Context, p *clientPath) {
+	conn, features, err := c.connectWith(ctx, func(ctx context.Context) (quic.Connection, error) {
+		return c.dialFrom(ctx, p.localAddr)
+	})
+
+	p.mu.Lock()
+	p.dialing = false
+	if err != nil {
+		p.retryAt = time.Now().Add(reconnectMaxDelay)
+		p.mu.Unlock()
+		c.log.Warn("Failed to connect path", "local", p.localAddr, "error", err)
+		return
+	}
+	if p.conn != nil {
+		c.stats.reconnects.Add(1)
+	}
+	p.conn, p.features = conn, features
+	p.mu.Unlock()
+
+	// Close marks the client closed before closing its paths, so either it
+	// saw this connection or the client is seen closed here
+	c.mu.RLock()
+	closed := c.closed
+	c.mu.RUnlock()
+	if closed {
+		p.close()
+		return
+	}
+	c.log.Info("Connected path", "local", p.localAddr)
+}
+
+// live returns the path's connection if it is open. Otherwise it starts
+// redialing the path in the background, unless a recent attempt failed.
+func (p *clientPath) live(c *Client) (quic.Connection, byte, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn != nil && p.conn.Context().Err() == nil {
+		return p.conn, p.features, true
+	}
+	if !p.dialing && time.Now().After(p.retryAt) {
+		p.dialing = true
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), c.pathDialTimeout())
+			defer cancel()
+			c.dialPath(ctx, p)
+		}()
+	}
+	return nil, 0, false
+}
+
+// close closes the path's connection, if any
+func (p *clientPath) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn != nil {
+		p.conn.CloseWithError(ErrorCodeNone, "client closing")
+	}
+}
+
+// pathDialTimeout bounds a background redial of a path
+func (c *Client) pathDialTimeout() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.reconnectTimeout > 0 {
+		return c.reconnectTimeout
+	}
+	return DefaultReconnectTimeout
+}
+
+// pickConn returns the connection the next stream should use and the
+// features negotiated on it. Streams take turns across the primary
+// connection and every live path; the primary connection is reconnected
+// when no path is left.
+func (c *Client) pickConn(ctx context.Context) (quic.Connection, byte, error) {
+	type candidate struct {
+		conn     quic.Connection
+		features byte
+	}
+
+	c.mu.RLock()
+	if c.conn == nil || c.closed {
+		c.mu.RUnlock()
+		return nil, 0, ErrNotConnected
+	}
+	paths := c.paths
+	var candidates []candidate
+	if c.conn.Context().Err() == nil {
+		candidates = append(candidates, candidate{c.conn, c.features})
+	}
+	c.mu.RUnlock()
+
+	for _, p := range paths {
+		if conn, features, ok := p.live(c); ok {
+			candidates = append(candidates, candidate{conn, features})
+		}
+	}
+
+	if len(candidates) == 0 {
+		conn, err := c.liveConn(ctx)
+		if err != nil {
+			return nil, 0, err
+		}
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		return conn, c.features, nil
+	}
+
+	next := candidates[c.nextPath.Add(1)%uint64(len(candidates))]
+	return next.conn, next.features, nil
+}
@@ -0,0 +1,100 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// muxOK is sent by the Mux when it accepts a service ID
+	muxOK byte = 0
+	// muxUnknownService is sent by the Mux when no handler is registered
+	// for the requested service ID
+	muxUnknownService byte = 1
+)
+
+// ErrUnknownService is returned when a stream requests a service that has
+// no registered handler
+var ErrUnknownService = errors.New("unknown service")
+
+// Mux is a StreamHandler that multiplexes several services over one tunnel.
+// Each stream starts with a one-byte service ID, sent by SelectService, and
+// is dispatched to the handler registered for that ID.
+type Mux struct {
+	mu       sync.RWMutex
+	handlers map[byte]StreamHandler
+}
+
+var _ StreamHandler = (*Mux)(nil)
+
+// NewMux creates an empty Mux
+func NewMux() *Mux {
+	return &Mux{
+		handlers: make(map[byte]StreamHandler),
+	}
+}
+
+// Handle registers the handler for the given service ID
+func (m *Mux) Handle(id byte, handler StreamHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers[id] = handler
+}
+
+// HandleFunc registers the handler function for the given service ID
+func (m *Mux) HandleFunc(id byte, handler func(ctx context.Context, stream io.ReadWriteCloser) error) {
+	m.Handle(id, StreamHandlerFunc(handler))
+}
+
+// HandleStream reads the service ID from the stream, acknowledges it, and
+// dispatches the stream to the registered handler. Unknown IDs are answered
+// with an error status before the stream is closed.
+func (m *Mux) HandleStream(ctx context.Context, stream io.ReadWriteCloser) error {
+	var id [1]byte
+	if _, err := io.ReadFull(stream, id[:]); err != nil {
+		stream.Close()
+		return fmt.Errorf("failed to read service ID: %w", err)
+	}
+
+	m.mu.RLock()
+	handler, ok := m.handlers[id[0]]
+	m.mu.RUnlock()
+
+	if !ok {
+		stream.Write([]byte{muxUnknownService})
+		stream.Close()
+		return fmt.Errorf("%w: %d", ErrUnknownService, id[0])
+	}
+
+	if _, err := stream.Write([]byte{muxOK}); err != nil {
+		stream.Close()
+		return fmt.Errorf("failed to acknowledge service %d: %w", id[0], err)
+	}
+
+	return handler.HandleStream(ctx, stream)
+}
+
+// SelectService requests the given service on a newly opened stream and
+// waits for the server's Mux to accept it
+func SelectService(stream io.ReadWriter, id byte) error {
+	if _, err := stream.Write([]byte{id}); err != nil {
+		return fmt.Errorf("failed to send service ID: %w", err)
+	}
+
+	var status [1]byte
+	if _, err := io.ReadFull(stream, status[:]); err != nil {
+		return fmt.Errorf("failed to read service status: %w", err)
+	}
+
+	switch status[0] {
+	case muxOK:
+		return nil
+	case muxUnknownService:
+		return fmt.Errorf("%w: %d", ErrUnknownService, id)
+	default:
+		return fmt.Errorf("unexpected service status %d", status[0])
+	}
+}
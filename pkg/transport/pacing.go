@@ -0,0 +1,51 @@
+package transport
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// SetPacing spaces out the client's queries, across all its streams, so
+// they arrive at a steady trickle like ordinary lookups rather than in
+// bursts: consecutive queries are at least interval apart, plus a random
+// delay of up to jitter. Throughput drops accordingly. Zero interval and
+// jitter, the default, send queries as fast as the connection allows. It
+// must be called before Connect.
+func (c *Client) SetPacing(interval, jitter time.Duration) {
+	if interval <= 0 && jitter <= 0 {
+		c.pacer = nil
+		return
+	}
+	c.pacer = &pacer{interval: max(interval, 0), jitter: max(jitter, 0)}
+}
+
+// pacer schedules queries at paced intervals. A nil pacer never waits.
+type pacer struct {
+	interval time.Duration
+	jitter   time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// wait blocks until the next query may be sent
+func (p *pacer) wait() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	at := p.next
+	if now := time.Now(); at.Before(now) {
+		at = now
+	}
+	gap := p.interval
+	if p.jitter > 0 {
+		gap += time.Duration(rand.Int63n(int64(p.jitter)))
+	}
+	p.next = at.Add(gap)
+	p.mu.Unlock()
+
+	time.Sleep(time.Until(at))
+}
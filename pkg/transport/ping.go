@@ -0,0 +1,79 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	// DefaultPingTimeout bounds Client.Ping when the context has no earlier
+	// deadline
+	DefaultPingTimeout = 5 * time.Second
+
+	// pingSize is the size of the nonce a ping stream echoes
+	pingSize = 8
+)
+
+// Stream kinds, sent as the first byte of every stream so the server can
+// answer control streams itself instead of passing them to the handler
+const (
+	streamKindData  byte = 0
+	streamKindPing  byte = 1
+	streamKindHello byte = 2
+	// streamKindReusable streams carry data like streamKindData ones, but
+	// for a series of uses; see SetStreamPool
+	streamKindReusable byte = 3
+)
+
+// ErrPingMismatch is returned when the server echoes back a different nonce
+var ErrPingMismatch = errors.New("ping reply does not match request")
+
+// Ping checks that the tunnel is usable by sending a nonce on a new stream
+// and waiting for the server to echo it, and returns the round-trip time
+// from opening the stream to the reply. No upstream target is dialed.
+func (c *Client) Ping(ctx context.Context) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, DefaultPingTimeout)
+	defer cancel()
+
+	start := time.Now()
+	ds, err := c.openKindStream(ctx, streamKindPing, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer ds.Close()
+
+	deadline, _ := ctx.Deadline()
+	ds.SetDeadline(deadline)
+
+	nonce := make([]byte, pingSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return 0, fmt.Errorf("failed to generate ping nonce: %w", err)
+	}
+	if _, err := ds.Write(nonce); err != nil {
+		return 0, fmt.Errorf("failed to send ping: %w", err)
+	}
+
+	reply := make([]byte, pingSize)
+	if _, err := io.ReadFull(ds, reply); err != nil {
+		return 0, fmt.Errorf("failed to read ping reply: %w", err)
+	}
+	if !bytes.Equal(reply, nonce) {
+		return 0, ErrPingMismatch
+	}
+
+	return time.Since(start), nil
+}
+
+// handlePing echoes a ping nonce back to the client
+func handlePing(ds *serverDNSStream) error {
+	ds.SetDeadline(time.Now().Add(DefaultPingTimeout))
+	if _, err := io.CopyN(ds, ds, pingSize); err != nil {
+		return fmt.Errorf("failed to echo ping: %w", err)
+	}
+	return nil
+}
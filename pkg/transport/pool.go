@@ -0,0 +1,366 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// A reusable stream carries a series of proxied connections, one after the
+// other. Each use starts like a data stream, with the target prologue and
+// the server's stream status, but its data travels in frames preceded by
+// their length as a 2-byte big-endian integer, and an empty frame ends each
+// direction like CloseWrite. Once both directions have ended the client may
+// start the next use with another prologue, which is compressed like data
+// if the connection negotiated compression. A use that doesn't end cleanly
+// ends the stream instead, so nothing left of it can reach the next use.
+
+// DefaultStreamPoolIdleTimeout is how long SetStreamPool keeps an idle
+// stream by default
+const DefaultStreamPoolIdleTimeout = 30 * time.Second
+
+// SetStreamPool makes OpenStream and OpenStreamTo reuse streams, saving the
+// round trips of opening one and of the server connecting to a new target
+// for every short-lived connection. A stream whose use ended cleanly, with
+// both sides having sent and read all their data, is kept instead of closed
+// and handed to the next stream opened to the same target. Up to maxIdle
+// streams are kept, each for up to idleTimeout, or
+// DefaultStreamPoolIdleTimeout if it is zero; idle streams count against
+// the server's stream limit and the client's active streams. Zero maxIdle,
+// the default, disables pooling. Streams opened by OpenConn and Dialer are
+// never reused. It must be called before opening streams.
+func (c *Client) SetStreamPool(maxIdle int, idleTimeout time.Duration) {
+	if maxIdle <= 0 {
+		c.pool = nil
+		return
+	}
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultStreamPoolIdleTimeout
+	}
+	c.pool = &streamPool{maxIdle: maxIdle, idleTimeout: idleTimeout}
+}
+
+// openReusable starts a use of an idle stream to target from the pool, or
+// of a new reusable stream if there is none
+func (c *Client) openReusable(ctx context.Context, target string) (io.ReadWriteCloser, error) {
+	if err := ValidateTarget(target); err != nil {
+		return nil, err
+	}
+
+	for {
+		ds := c.pool.get(target)
+		if ds == nil {
+			break
+		}
+		if err := WriteTarget(ds, target); err != nil {
+			// The stream broke while idle
+			ds.Close()
+			continue
+		}
+		ds.needStatus, ds.status = true, nil
+		return c.pool.use(ds, target), nil
+	}
+
+	ds, err := c.openKindStream(ctx, streamKindReusable, func(w io.Writer) error {
+		return WriteTarget(w, target)
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.startData(ds)
+	return c.pool.use(ds, target), nil
+}
+
+// streamUse is one use of a reusable stream, carrying its data in frames
+type streamUse struct {
+	stream io.ReadWriter
+	// pending holds data of the last frame not yet returned by Read
+	pending []byte
+	// wmu serializes writes, so CloseWrite can't split a frame
+	wmu sync.Mutex
+	// readDone is set once the peer has ended its data, writeDone once this
+	// side has, and broken once the stream failed
+	readDone  atomic.Bool
+	writeDone atomic.Bool
+	broken    atomic.Bool
+}
+
+func (u *streamUse) Read(p []byte) (int, error) {
+	for len(u.pending) == 0 {
+		if u.readDone.Load() {
+			return 0, io.EOF
+		}
+		frame, err := readFrame(u.stream)
+		if err != nil {
+			u.broken.Store(true)
+			return 0, err
+		}
+		if len(frame) == 0 {
+			u.readDone.Store(true)
+			return 0, io.EOF
+		}
+		u.pending = frame
+	}
+
+	n := copy(p, u.pending)
+	u.pending = u.pending[n:]
+	return n, nil
+}
+
+func (u *streamUse) Write(p []byte) (int, error) {
+	u.wmu.Lock()
+	defer u.wmu.Unlock()
+
+	if u.writeDone.Load() {
+		return 0, ErrStreamClosed
+	}
+
+	// An empty frame would end the use
+	written := 0
+	for written < len(p) {
+		chunk := p[written:min(len(p), written+maxFrameSize)]
+		if err := writeFrame(u.stream, chunk); err != nil {
+			u.broken.Store(true)
+			return written, err
+		}
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+// CloseWrite ends this side's data of the use, while the peer's can still
+// be read
+func (u *streamUse) CloseWrite() error {
+	u.wmu.Lock()
+	defer u.wmu.Unlock()
+
+	if u.writeDone.Load() {
+		return nil
+	}
+	if err := writeFrame(u.stream, nil); err != nil {
+		u.broken.Store(true)
+		return err
+	}
+	u.writeDone.Store(true)
+	return nil
+}
+
+// finished reports whether both sides ended the use cleanly, leaving the
+// stream ready for the next one
+func (u *streamUse) finished() bool {
+	return u.readDone.Load() && u.writeDone.Load() && !u.broken.Load()
+}
+
+// pooledStream is a use of one of the client's reusable streams
+type pooledStream struct {
+	*streamUse
+	ds     *dnsStream
+	pool   *streamPool
+	target string
+	once   sync.Once
+}
+
+// Close ends the use. The stream goes back to the pool if the server's data
+// was read to the end, and is closed otherwise, which also unblocks pending
+// reads.
+func (s *pooledStream) Close() error {
+	var err error
+	s.once.Do(func() {
+		if s.readDone.Load() && s.CloseWrite() == nil && s.finished() {
+			s.pool.put(s.target, s.ds)
+			return
+		}
+		err = s.ds.Close()
+	})
+	return err
+}
+
+// streamPool holds the client's idle reusable streams by target
+type streamPool struct {
+	maxIdle     int
+	idleTimeout time.Duration
+
+	mu     sync.Mutex
+	idle   map[string][]*idleStream
+	count  int
+	closed bool
+}
+
+// idleStream is a stream waiting in the pool, closed by its timer once it
+// has been idle too long
+type idleStream struct {
+	ds    *dnsStream
+	timer *time.Timer
+}
+
+// use starts a use of ds, a reusable stream to target
+func (p *streamPool) use(ds *dnsStream, target string) *pooledStream {
+	return &pooledStream{
+		streamUse: &streamUse{stream: ds},
+		ds:        ds,
+		pool:      p,
+		target:    target,
+	}
+}
+
+// get takes the most recently used idle stream to target from the pool, or
+// returns nil if there is none
+func (p *streamPool) get(target string) *dnsStream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	streams := p.idle[target]
+	defer func() {
+		if len(streams) == 0 {
+			delete(p.idle, target)
+		} else {
+			p.idle[target] = streams
+		}
+	}()
+
+	for len(streams) > 0 {
+		is := streams[len(streams)-1]
+		streams = streams[:len(streams)-1]
+		p.count--
+		is.timer.Stop()
+
+		// The stream ends with its connection, or if the server reset it
+		if is.ds.stream.Context().Err() == nil {
+			return is.ds
+		}
+		is.ds.Close()
+	}
+	return nil
+}
+
+// put keeps ds, a reusable stream to target whose use ended cleanly, for
+// the next use, or closes it if the pool is full
+func (p *streamPool) put(target string, ds *dnsStream) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed || p.count >= p.maxIdle {
+		ds.Close()
+		return
+	}
+
+	is := &idleStream{ds: ds}
+	is.timer = time.AfterFunc(p.idleTimeout, func() { p.evict(target, is) })
+	if p.idle == nil {
+		p.idle = make(map[string][]*idleStream)
+	}
+	p.idle[target] = append(p.idle[target], is)
+	p.count++
+}
+
+// evict closes is once it has been idle for too long, unless it was taken
+// in the meantime
+func (p *streamPool) evict(target string, is *idleStream) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	streams := p.idle[target]
+	for i, s := range streams {
+		if s != is {
+			continue
+		}
+		streams = append(streams[:i], streams[i+1:]...)
+		if len(streams) == 0 {
+			delete(p.idle, target)
+		} else {
+			p.idle[target] = streams
+		}
+		p.count--
+		is.ds.Close()
+		return
+	}
+}
+
+// closeAll closes every idle stream, and any put back later. A nil pool
+// holds nothing.
+func (p *streamPool) closeAll() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for _, streams := range p.idle {
+		for _, is := range streams {
+			is.timer.Stop()
+			is.ds.Close()
+		}
+	}
+	p.idle, p.count = nil, 0
+}
+
+// handleReusable serves the uses of a reusable stream one after the other,
+// until the client closes it or a use doesn't end cleanly
+func (s *Server) handleReusable(ctx context.Context, tc *trackedConn, counters *connCounters, limit *clientLimit, dnsStream *serverDNSStream) {
+	for first := true; ; first = false {
+		if !first {
+			s.idleStream(tc)
+		}
+		target, err := ReadTarget(dnsStream)
+		if !first && !s.resumeStream(tc) {
+			dnsStream.stream.CancelWrite(quic.StreamErrorCode(ErrorCodeShutdown))
+			return
+		}
+		if err != nil {
+			// Clients close idle streams they no longer need
+			if first || !errors.Is(err, io.EOF) {
+				s.log.Warn("Invalid stream prologue", "conn", counters.connID, "stream", dnsStream.StreamID(), "error", err)
+			}
+			return
+		}
+
+		if !s.startUse(counters, limit, dnsStream, target) {
+			return
+		}
+		use := &serverStreamUse{serverDNSStream: dnsStream, use: &streamUse{stream: dnsStream}}
+		if !s.runHandler(ctx, counters, dnsStream, use) {
+			return
+		}
+		// Handlers that never wrote or closed their side still end it
+		if use.use.CloseWrite() != nil || !use.use.finished() {
+			return
+		}
+	}
+}
+
+// serverStreamUse is a use of a reusable stream as passed to the handler,
+// with the stream's information and Reject
+type serverStreamUse struct {
+	*serverDNSStream
+	use *streamUse
+}
+
+func (u *serverStreamUse) Read(p []byte) (int, error) {
+	return u.use.Read(p)
+}
+
+func (u *serverStreamUse) Write(p []byte) (int, error) {
+	return u.use.Write(p)
+}
+
+// CloseWrite ends the handler's data of the use, while the client's can
+// still be read
+func (u *serverStreamUse) CloseWrite() error {
+	return u.use.CloseWrite()
+}
+
+// Close ends the use. Unless the client's data was read to the end, the
+// stream can't be reused and is closed, which also unblocks pending reads.
+func (u *serverStreamUse) Close() error {
+	if u.use.readDone.Load() {
+		return u.use.CloseWrite()
+	}
+	return u.serverDNSStream.Close()
+}
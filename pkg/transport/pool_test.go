@@ -0,0 +1,137 @@
+package transport_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/getlantern/lantern/slipstream/pkg/slipstreamtest"
+	"github.com/getlantern/lantern/slipstream/pkg/transport"
+)
+
+// bigReplySize is the size of the reply to a "big" request, far more than
+// the client reads before abandoning it
+const bigReplySize = 1 << 20
+
+// targetEcho answers each use with its target and the data the client sent,
+// or with bigReplySize bytes if the client sent "big"
+type targetEcho struct{}
+
+func (targetEcho) HandleStream(ctx context.Context, stream io.ReadWriteCloser) error {
+	defer stream.Close()
+
+	request, err := io.ReadAll(stream)
+	if err != nil {
+		return err
+	}
+	if string(request) == "big" {
+		_, err = stream.Write(bytes.Repeat([]byte("x"), bigReplySize))
+		return err
+	}
+	target := stream.(transport.TargetStream).Target()
+	_, err = stream.Write([]byte(target + " " + string(request)))
+	return err
+}
+
+// newPoolHarness starts a harness whose client pools streams
+func newPoolHarness(t *testing.T) *slipstreamtest.Harness {
+	t.Helper()
+	h := newHarness(t, targetEcho{})
+	h.Client.SetStreamPool(4, time.Minute)
+	return h
+}
+
+// use sends request to target on a pooled stream and returns the reply,
+// read to the end
+func use(t *testing.T, h *slipstreamtest.Harness, target, request string) string {
+	t.Helper()
+	stream, err := h.Client.OpenStreamTo(testContext(t), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	if _, err := io.WriteString(stream, request); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatalf("read failed after %q: %v", reply, err)
+	}
+	return string(reply)
+}
+
+// checkStreams fails the test unless the client has opened want streams
+func checkStreams(t *testing.T, h *slipstreamtest.Harness, want uint64) {
+	t.Helper()
+	if n := h.Client.Stats().Streams; n != want {
+		t.Fatalf("client opened %d streams, want %d", n, want)
+	}
+}
+
+func TestStreamPoolReusesStream(t *testing.T) {
+	h := newPoolHarness(t)
+
+	for _, request := range []string{"one", "two", "three"} {
+		if got, want := use(t, h, "a.example:80", request), "a.example:80 "+request; got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+	checkStreams(t, h, 1)
+}
+
+func TestStreamPoolDropsAbandonedUse(t *testing.T) {
+	h := newPoolHarness(t)
+	const target = "a.example:80"
+
+	if got := use(t, h, target, "first"); got != target+" first" {
+		t.Fatalf("got %q", got)
+	}
+
+	// Close the stream in the middle of the reply
+	stream, err := h.Client.OpenStreamTo(testContext(t), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(stream, "big")
+	stream.(interface{ CloseWrite() error }).CloseWrite()
+	if _, err := io.ReadFull(stream, make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+	checkStreams(t, h, 1)
+
+	// The rest of the reply can't reach the next use, which gets a new
+	// stream
+	if got := use(t, h, target, "next"); got != target+" next" {
+		t.Fatalf("got %q after an abandoned use", got)
+	}
+	checkStreams(t, h, 2)
+}
+
+func TestStreamPoolKeepsTargetsApart(t *testing.T) {
+	h := newPoolHarness(t)
+
+	if got := use(t, h, "a.example:80", "first"); got != "a.example:80 first" {
+		t.Fatalf("got %q", got)
+	}
+	// The stream to a.example is idle, but b.example gets one of its own
+	if got := use(t, h, "b.example:443", "second"); got != "b.example:443 second" {
+		t.Fatalf("got %q", got)
+	}
+	checkStreams(t, h, 2)
+
+	// Each target reuses its own stream
+	if got := use(t, h, "a.example:80", "third"); got != "a.example:80 third" {
+		t.Fatalf("got %q", got)
+	}
+	if got := use(t, h, "b.example:443", "fourth"); got != "b.example:443 fourth" {
+		t.Fatalf("got %q", got)
+	}
+	checkStreams(t, h, 2)
+}
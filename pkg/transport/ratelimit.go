@@ -0,0 +1,214 @@
+package transport
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// rateLimitMaxDelay is the longest a new stream is held back to stay
+	// within its client's stream rate; streams that would wait longer are
+	// rejected with ErrorCodeBusy
+	rateLimitMaxDelay = time.Second
+	// rateLimitIdle is how long the limits of a client IP are kept after its
+	// last stream or traffic
+	rateLimitIdle = 10 * time.Minute
+)
+
+// SetStreamRateLimit limits how fast each client IP may open streams, across
+// all its connections, with a token bucket refilled at perSecond streams
+// per second and holding up to burst. A stream over the limit is delayed
+// for up to a second and otherwise reset with ErrorCodeBusy; the
+// connection is left open. A zero rate, the default, means no limit, and a
+// burst below one allows one stream at a time. It must be called before
+// Listen.
+func (s *Server) SetStreamRateLimit(perSecond float64, burst int) {
+	if s.limiter == nil {
+		s.limiter = &rateLimiter{}
+	}
+	s.limiter.streamRate = perSecond
+	s.limiter.streamBurst = float64(max(burst, 1))
+}
+
+// SetBandwidthLimit limits the stream data each client IP may send and
+// receive, across all its connections, to bytesPerSecond in each
+// direction. Streams over the limit are slowed down rather than closed.
+// Zero, the default, means no limit. It must be called before Listen.
+func (s *Server) SetBandwidthLimit(bytesPerSecond int) {
+	if s.limiter == nil {
+		s.limiter = &rateLimiter{}
+	}
+	s.limiter.byteRate = float64(bytesPerSecond)
+}
+
+// rateLimiter tracks the limits of each client IP. A nil rateLimiter
+// limits nothing.
+type rateLimiter struct {
+	streamRate  float64
+	streamBurst float64
+	byteRate    float64
+
+	mu        sync.Mutex
+	clients   map[string]*clientLimit
+	lastSweep time.Time
+}
+
+// client returns the limits of the client at addr, or nil if there are none
+func (l *rateLimiter) client(addr net.Addr) *clientLimit {
+	if l == nil || l.streamRate <= 0 && l.byteRate <= 0 {
+		return nil
+	}
+	ip := addrIP(addr)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	c := l.clients[ip]
+	if c == nil {
+		c = &clientLimit{lastSeen: now}
+		if l.streamRate > 0 {
+			c.streams = newTokenBucket(l.streamRate, l.streamBurst, now)
+		}
+		if l.byteRate > 0 {
+			// A second's worth of data may be sent at once
+			c.in = newTokenBucket(l.byteRate, l.byteRate, now)
+			c.out = newTokenBucket(l.byteRate, l.byteRate, now)
+		}
+		if l.clients == nil {
+			l.clients = make(map[string]*clientLimit)
+		}
+		l.clients[ip] = c
+	}
+	return c
+}
+
+// sweep forgets clients idle for rateLimitIdle, at most once per
+// rateLimitIdle, so the table doesn't grow with every IP ever seen. The
+// caller holds l.mu.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitIdle {
+		return
+	}
+	l.lastSweep = now
+	for ip, c := range l.clients {
+		if c.idleSince(now) >= rateLimitIdle {
+			delete(l.clients, ip)
+		}
+	}
+}
+
+// addrIP returns the IP of addr, the key clients are limited by
+func addrIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP.String()
+	case *net.TCPAddr:
+		return a.IP.String()
+	case nil:
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
+
+// clientLimit holds the token buckets of one client IP. A nil clientLimit
+// limits nothing.
+type clientLimit struct {
+	mu       sync.Mutex
+	streams  *tokenBucket
+	in       *tokenBucket
+	out      *tokenBucket
+	lastSeen time.Time
+}
+
+// admitStream waits until the client may open another stream and reports
+// whether it may, without waiting longer than rateLimitMaxDelay
+func (c *clientLimit) admitStream() bool {
+	if c == nil || c.streams == nil {
+		return true
+	}
+
+	c.mu.Lock()
+	now := time.Now()
+	c.lastSeen = now
+	wait, ok := c.streams.reserve(now, 1, rateLimitMaxDelay)
+	c.mu.Unlock()
+
+	if ok {
+		time.Sleep(wait)
+	}
+	return ok
+}
+
+// throttleIn and throttleOut wait until n more bytes from or to the client
+// are within its bandwidth
+func (c *clientLimit) throttleIn(n int) {
+	if c != nil {
+		c.throttle(c.in, n)
+	}
+}
+
+func (c *clientLimit) throttleOut(n int) {
+	if c != nil {
+		c.throttle(c.out, n)
+	}
+}
+
+func (c *clientLimit) throttle(bucket *tokenBucket, n int) {
+	if bucket == nil || n == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	now := time.Now()
+	c.lastSeen = now
+	wait, _ := bucket.reserve(now, float64(n), -1)
+	c.mu.Unlock()
+
+	time.Sleep(wait)
+}
+
+func (c *clientLimit) idleSince(now time.Time) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return now.Sub(c.lastSeen)
+}
+
+// tokenBucket refills at rate tokens per second up to burst. Tokens may be
+// taken before they are available, leaving a debt that later callers wait
+// out.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+// reserve takes n tokens and returns how long to wait until they are
+// available. If that is longer than maxWait, nothing is taken and ok is
+// false; a negative maxWait never refuses.
+func (b *tokenBucket) reserve(now time.Time, n float64, maxWait time.Duration) (wait time.Duration, ok bool) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	if deficit := n - b.tokens; deficit > 0 {
+		wait = time.Duration(deficit / b.rate * float64(time.Second))
+	}
+	if maxWait >= 0 && wait > maxWait {
+		return wait, false
+	}
+	b.tokens -= n
+	return wait, true
+}
@@ -0,0 +1,72 @@
+package transport
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketReserve(t *testing.T) {
+	start := time.Now()
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+
+	for _, tc := range []struct {
+		name    string
+		steps   []reserveStep
+		maxWait time.Duration
+	}{
+		{"burst", []reserveStep{
+			{at: 0, n: 1, wait: 0, ok: true},
+			{at: 0, n: 1, wait: 0, ok: true},
+			{at: 0, n: 1, wait: 0, ok: true},
+		}, time.Second},
+		{"refill", []reserveStep{
+			{at: 0, n: 3, wait: 0, ok: true},
+			{at: time.Second, n: 2, wait: 0, ok: true},
+			{at: time.Second, n: 1, wait: 500 * time.Millisecond, ok: true},
+		}, time.Second},
+		{"refill stops at burst", []reserveStep{
+			{at: time.Hour, n: 3, wait: 0, ok: true},
+			{at: time.Hour, n: 1, wait: 500 * time.Millisecond, ok: true},
+		}, time.Second},
+		{"debt", []reserveStep{
+			{at: 0, n: 3, wait: 0, ok: true},
+			{at: 0, n: 1, wait: 500 * time.Millisecond, ok: true},
+			{at: 0, n: 1, wait: time.Second, ok: true},
+			// The debt is paid off before tokens accumulate again
+			{at: time.Second, n: 1, wait: 500 * time.Millisecond, ok: true},
+		}, time.Second},
+		{"refused over maxWait", []reserveStep{
+			{at: 0, n: 3, wait: 0, ok: true},
+			{at: 0, n: 2, wait: time.Second, ok: true},
+			{at: 0, n: 1, wait: 1500 * time.Millisecond, ok: false},
+			// A refused reservation takes nothing
+			{at: 0, n: 1, wait: 1500 * time.Millisecond, ok: false},
+			{at: 500 * time.Millisecond, n: 1, wait: time.Second, ok: true},
+		}, time.Second},
+		{"negative maxWait never refuses", []reserveStep{
+			{at: 0, n: 3, wait: 0, ok: true},
+			{at: 0, n: 10, wait: 5 * time.Second, ok: true},
+			{at: 0, n: 1, wait: 5500 * time.Millisecond, ok: true},
+		}, -1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// 2 tokens a second, up to 3
+			b := newTokenBucket(2, 3, start)
+			for i, step := range tc.steps {
+				wait, ok := b.reserve(at(step.at), step.n, tc.maxWait)
+				if wait != step.wait || ok != step.ok {
+					t.Fatalf("step %d: reserve(%v, %v) = %v, %v; want %v, %v", i, step.at, step.n, wait, ok, step.wait, step.ok)
+				}
+			}
+		})
+	}
+}
+
+// reserveStep is a reservation of n tokens at a time after the bucket was
+// created, and its expected result
+type reserveStep struct {
+	at   time.Duration
+	n    float64
+	wait time.Duration
+	ok   bool
+}
@@ -0,0 +1,167 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// DefaultReconnectAttempts is how many times a client redials a lost
+	// connection before OpenStream gives up
+	DefaultReconnectAttempts = 5
+	// DefaultReconnectTimeout bounds one reconnection, across all attempts
+	DefaultReconnectTimeout = time.Minute
+
+	// reconnectBaseDelay is the backoff before the second attempt; it
+	// doubles with every further attempt up to reconnectMaxDelay
+	reconnectBaseDelay = 500 * time.Millisecond
+	reconnectMaxDelay  = 10 * time.Second
+)
+
+// ErrNotConnected is returned when opening a stream on a client that was
+// never connected or has been closed
+var ErrNotConnected = errors.New("not connected to server")
+
+// SetReconnect sets how the client re-establishes a lost connection when a
+// stream is opened: up to attempts dials, with exponential backoff and
+// jitter between them, within timeout overall. Zero attempts disables
+// reconnection; a zero timeout leaves only the attempts as the limit.
+func (c *Client) SetReconnect(attempts int, timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.reconnectAttempts = attempts
+	c.reconnectTimeout = timeout
+}
+
+// liveConn returns the client's connection, reconnecting first if it has
+// been lost
+func (c *Client) liveConn(ctx context.Context) (quic.Connection, error) {
+	c.mu.RLock()
+	conn, closed := c.conn, c.closed
+	c.mu.RUnlock()
+
+	if conn == nil || closed {
+		return nil, ErrNotConnected
+	}
+	if conn.Context().Err() == nil {
+		return conn, nil
+	}
+	return c.reconnect(ctx, conn)
+}
+
+// reconnect replaces the lost connection dead. Concurrent callers share a
+// single reconnection; each waits for it until its own ctx is done.
+func (c *Client) reconnect(ctx context.Context, dead quic.Connection) (quic.Connection, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrNotConnected
+	}
+	if c.conn != dead {
+		// Another caller already reconnected
+		conn := c.conn
+		c.mu.Unlock()
+		return conn, nil
+	}
+	if c.reconnectAttempts <= 0 {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("connection lost: %w", context.Cause(dead.Context()))
+	}
+
+	done := c.reconnecting
+	if done == nil {
+		done = make(chan struct{})
+		c.reconnecting = done
+		go c.redial(dead, done)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.conn == dead {
+		return nil, c.reconnectErr
+	}
+	if c.closed {
+		return nil, ErrNotConnected
+	}
+	return c.conn, nil
+}
+
+// redial dials the server until it succeeds or the reconnect policy is
+// exhausted, then installs the new connection and closes done. It runs
+// independently of any caller's context so that no single caller can abort
+// the reconnection for the others.
+func (c *Client) redial(dead quic.Connection, done chan struct{}) {
+	c.mu.RLock()
+	attempts, timeout := c.reconnectAttempts, c.reconnectTimeout
+	c.mu.RUnlock()
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	c.log.Warn("Connection lost, reconnecting", "server", c.serverAddr, "error", context.Cause(dead.Context()))
+
+	var conn quic.Connection
+	var features byte
+	var err error
+	delay := reconnectBaseDelay
+	for attempt := 1; ; attempt++ {
+		if conn, features, err = c.connect(ctx); err == nil {
+			break
+		}
+		c.log.Warn("Reconnect attempt failed", "attempt", attempt, "error", err)
+		if attempt >= attempts {
+			break
+		}
+
+		// Sleep for a random duration in [delay/2, delay) so clients that
+		// lost the same server don't all redial at once
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			break
+		}
+		delay = min(2*delay, reconnectMaxDelay)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer close(done)
+
+	c.reconnecting = nil
+	if err != nil {
+		c.reconnectErr = fmt.Errorf("failed to reconnect to server: %w", err)
+		return
+	}
+	if c.closed {
+		// Closed while reconnecting
+		conn.CloseWithError(ErrorCodeNone, "client closing")
+		return
+	}
+
+	c.conn = conn
+	c.features = features
+	c.reconnectErr = nil
+	c.stats.reconnects.Add(1)
+	c.log.Info("Reconnected to server", "server", c.serverAddr)
+}
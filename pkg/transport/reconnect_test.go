@@ -0,0 +1,91 @@
+package transport_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/lantern/slipstream/pkg/slipstreamtest"
+	"github.com/getlantern/lantern/slipstream/pkg/transport"
+)
+
+// echo opens a stream on h, sends data and checks that it comes back
+func echo(ctx context.Context, h *slipstreamtest.Harness, data []byte) error {
+	stream, err := h.OpenStream(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open stream: %w", err)
+	}
+	defer stream.Close()
+
+	if _, err := stream.Write(data); err != nil {
+		return fmt.Errorf("failed to write: %w", err)
+	}
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(stream, got); err != nil {
+		return fmt.Errorf("failed to read: %w", err)
+	}
+	if !bytes.Equal(got, data) {
+		return fmt.Errorf("echoed %q, want %q", got, data)
+	}
+	return nil
+}
+
+func TestReconnectAfterServerRestart(t *testing.T) {
+	h := newHarness(t, transport.EchoHandler{})
+	ctx := testContext(t)
+
+	if err := echo(ctx, h, []byte("before")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A stream open across the restart fails
+	stream, err := h.OpenStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if _, err := stream.Write([]byte("in flight")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.RestartServer(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for h.Client.Connected() {
+		if time.Now().After(deadline) {
+			t.Fatal("client still connected after the server restarted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := io.ReadAll(stream); err == nil {
+		t.Fatal("stream open across the restart ended cleanly")
+	}
+
+	// Concurrent callers share one reconnection
+	const callers = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- echo(ctx, h, []byte(fmt.Sprintf("after %d", i)))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := h.Client.Stats().Reconnects; n != 1 {
+		t.Fatalf("client reconnected %d times, want 1", n)
+	}
+}
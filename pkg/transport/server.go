@@ -1,16 +1,17 @@
 package transport
 
 import (
+	"bufio"
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/pem"
 	"fmt"
-	"log"
-	"math/big"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -22,28 +23,87 @@ import (
 // Server represents a slipstream QUIC server
 type Server struct {
 	listenAddr string
-	domain     string
+	domains    []string
+	dnsConfig  dnspkg.Config
 	tlsConfig  *tls.Config
+	cert       atomic.Pointer[tls.Certificate]
 	quicConfig *quic.Config
+	readBuffer int
+	log        *slog.Logger
+	transport  *quic.Transport
 	handler    StreamHandler
+	auth       Authenticator
+	// compressLevel is the flate level of compressed data streams; see
+	// SetCompression
+	compressLevel int
+	// connSlots and maxStreams limit concurrent connections and streams per
+	// connection; see SetMaxConnections and SetMaxStreams
+	connSlots  semaphore
+	maxStreams int
+	// limiter limits the stream rate and bandwidth of each client IP; see
+	// SetStreamRateLimit and SetBandwidthLimit
+	limiter    *rateLimiter
+	nextConnID atomic.Uint64
+	connStats  connStatsTable
+	stats      trafficCounters
+	// sessions are the streams carried outside QUIC; see ServeHTTP
+	sessions sessionTable
+
+	// Shutdown state; see Shutdown
+	mu       sync.Mutex
+	listener *quic.Listener
+	closing  bool
+	conns    map[*trackedConn]struct{}
+	connWG   sync.WaitGroup
+	// dohServer is the HTTPS server run by ListenDoH
+	dohServer *http.Server
+	// stopDNS stops the UDP and TCP servers run by ListenDNS
+	stopDNS func()
 }
 
 // NewServer creates a new slipstream server
 func NewServer(listenAddr, domain string, handler StreamHandler) (*Server, error) {
-	tlsConfig, err := generateTLSConfig()
+	return NewServerWithConfig(listenAddr, domain, handler, DefaultConfig())
+}
+
+// NewServerWithConfig creates a new slipstream server using the given
+// transport configuration
+func NewServerWithConfig(listenAddr, domain string, handler StreamHandler, config Config) (*Server, error) {
+	config = config.withDefaults()
+	cert, err := generateCertificate(config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate TLS config: %w", err)
 	}
 
-	return &Server{
+	s := &Server{
 		listenAddr: listenAddr,
-		domain:     domain,
-		tlsConfig:  tlsConfig,
-		quicConfig: &quic.Config{
-			EnableDatagrams: true,
-		},
-		handler: handler,
-	}, nil
+		domains:    []string{domain},
+		dnsConfig:  dnspkg.DefaultConfig(),
+		quicConfig: config.quicConfig(),
+		readBuffer: config.ReadBufferSize,
+		log:        config.Logger,
+		handler:    handler,
+	}
+	s.cert.Store(&cert)
+	s.tlsConfig = serverTLSConfig(config, s.cert.Load)
+
+	return s, nil
+}
+
+// SetDomains sets the base domains the server accepts queries for,
+// replacing the domain given to NewServer. Domains may be wildcards such as
+// "*.example.com", which accept any label in place of the "*".
+func (s *Server) SetDomains(domains []string) {
+	if len(domains) > 0 {
+		s.domains = domains
+	}
+}
+
+// SetDNSConfig sets how queries are decoded and responses are encoded, such
+// as the query name encoder and response TTL. The record type always follows
+// the client's queries.
+func (s *Server) SetDNSConfig(cfg dnspkg.Config) {
+	s.dnsConfig = cfg
 }
 
 // SetTLSConfig sets custom TLS configuration (certificates)
@@ -53,162 +113,579 @@ func (s *Server) SetTLSConfig(certFile, keyFile string) error {
 		return fmt.Errorf("failed to load certificates: %w", err)
 	}
 
-	s.tlsConfig.Certificates = []tls.Certificate{cert}
+	s.SetCertificate(cert)
+	return nil
+}
+
+// SetTLSConfigPEM sets the server certificate from PEM-encoded certificate
+// and key material
+func (s *Server) SetTLSConfigPEM(certPEM, keyPEM []byte) error {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("failed to parse certificates: %w", err)
+	}
+
+	s.SetCertificate(cert)
 	return nil
 }
 
-// Listen starts the server and handles incoming connections
+// SetCertificate sets the server certificate. It may be called while the
+// server is running; new handshakes use the new certificate immediately and
+// existing connections are unaffected.
+func (s *Server) SetCertificate(cert tls.Certificate) {
+	s.cert.Store(&cert)
+}
+
+// CertificatePin returns the pin of the server's current certificate, for
+// clients to pass to SetServerCertPin
+func (s *Server) CertificatePin() (string, error) {
+	cert, err := x509.ParseCertificate(s.cert.Load().Certificate[0])
+	if err != nil {
+		return "", fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	return CertificatePin(cert), nil
+}
+
+// ReloadCert loads a new certificate and key from disk and swaps it in
+// without interrupting existing connections
+func (s *Server) ReloadCert(certFile, keyFile string) error {
+	return s.SetTLSConfig(certFile, keyFile)
+}
+
+// ConnectionStats returns a snapshot of the traffic on every live client
+// connection. Connections are dropped from the result once they close.
+func (s *Server) ConnectionStats() []ConnStats {
+	return s.connStats.snapshot()
+}
+
+// Stats returns a snapshot of the server's traffic since it was created
+func (s *Server) Stats() Stats {
+	return s.stats.snapshot()
+}
+
+// SetPacketConn makes the server receive QUIC traffic on pc instead of
+// binding the listen address. The caller keeps ownership of pc.
+func (s *Server) SetPacketConn(pc net.PacketConn) {
+	s.SetTransport(&quic.Transport{Conn: pc})
+}
+
+// SetTransport makes the server listen on tr, which clients may share to
+// dial out from the same socket. The caller keeps ownership of tr.
+func (s *Server) SetTransport(tr *quic.Transport) {
+	s.transport = tr
+}
+
+// SetAuthenticator requires every connection to pass the given
+// authenticator before any of its streams are handled
+func (s *Server) SetAuthenticator(auth Authenticator) {
+	s.auth = auth
+}
+
+// SetPSK requires clients to authenticate with a pre-shared key
+func (s *Server) SetPSK(psk []byte) {
+	s.SetAuthenticator(NewPSKAuthenticator(psk))
+}
+
+// Listen starts the server and handles incoming connections. The listen
+// address is "host:port", where host may also be a network interface name
+// to bind to that interface's address.
 func (s *Server) Listen(ctx context.Context) error {
-	listener, err := quic.ListenAddr(s.listenAddr, s.tlsConfig, s.quicConfig)
+	tr := s.transport
+	if tr == nil {
+		udpConn, err := listenUDP(s.listenAddr)
+		if err != nil {
+			return fmt.Errorf("failed to start listener: %w", err)
+		}
+		defer udpConn.Close()
+
+		tr = &quic.Transport{Conn: udpConn}
+		defer tr.Close()
+	}
+
+	listener, err := tr.Listen(s.tlsConfig, s.quicConfig)
 	if err != nil {
 		return fmt.Errorf("failed to start listener: %w", err)
 	}
 	defer listener.Close()
 
-	log.Printf("Server listening on %s", s.listenAddr)
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
+	s.log.Info("Server listening", "addr", tr.Conn.LocalAddr())
 
 	for {
 		conn, err := listener.Accept(ctx)
 		if err != nil {
+			if s.shuttingDown() {
+				// Returning closes the socket, so wait for the connections
+				// still draining on it
+				s.connWG.Wait()
+				return ErrServerClosed
+			}
 			select {
 			case <-ctx.Done():
 				return ctx.Err()
 			default:
-				log.Printf("Failed to accept connection: %v", err)
+				s.log.Warn("Failed to accept connection", "error", err)
 				continue
 			}
 		}
 
-		go s.handleConnection(ctx, conn)
+		tc, ok := s.trackConn(conn)
+		if !ok {
+			closeForShutdown(conn)
+			continue
+		}
+		if !s.connSlots.tryAcquire() {
+			s.untrackConn(tc)
+			s.rejectConnection(conn)
+			continue
+		}
+		go func() {
+			defer s.untrackConn(tc)
+			defer s.connSlots.release()
+			s.handleConnection(ctx, tc)
+		}()
 	}
 }
 
-func (s *Server) handleConnection(ctx context.Context, conn quic.Connection) {
-	defer conn.CloseWithError(0, "connection closed")
+func (s *Server) handleConnection(ctx context.Context, tc *trackedConn) {
+	conn := tc.conn
+	defer conn.CloseWithError(ErrorCodeNone, "connection closed")
 
-	log.Printf("New connection from %s", conn.RemoteAddr())
+	counters := s.connStats.add(s.nextConnID.Add(1), conn.RemoteAddr())
+	defer s.connStats.remove(counters.connID)
+	s.log.Debug("New connection", "conn", counters.connID, "remote", conn.RemoteAddr())
 
+	if s.auth != nil {
+		if err := s.authenticate(ctx, conn, counters); err != nil {
+			s.log.Warn("Authentication failed", "conn", counters.connID, "remote", conn.RemoteAddr(), "error", err)
+			conn.CloseWithError(ErrorCodeAuthFailed, "authentication failed")
+			return
+		}
+	}
+
+	streamSlots := newSemaphore(s.maxStreams)
+	limit := s.limiter.client(conn.RemoteAddr())
 	for {
 		stream, err := conn.AcceptStream(ctx)
 		if err != nil {
 			select {
 			case <-ctx.Done():
+				conn.CloseWithError(ErrorCodeShutdown, "server shutting down")
 				return
 			default:
-				log.Printf("Failed to accept stream: %v", err)
+				s.log.Debug("Connection ended", "conn", counters.connID, "error", err)
 				return
 			}
 		}
 
-		go s.handleStream(ctx, stream)
+		if !s.startStream(tc) {
+			refuseStream(stream)
+			continue
+		}
+		if !streamSlots.tryAcquire() {
+			s.endStream(tc)
+			s.rejectStream(conn, stream, "too many streams")
+			continue
+		}
+		go func() {
+			defer s.endStream(tc)
+			defer streamSlots.release()
+			if !limit.admitStream() {
+				s.rejectStream(conn, stream, "stream rate limit exceeded")
+				return
+			}
+			s.handleStream(ctx, conn, tc, counters, limit, stream)
+		}()
 	}
 }
 
-func (s *Server) handleStream(ctx context.Context, stream quic.Stream) {
+// authenticate verifies the client's credentials on the first stream of the
+// connection
+func (s *Server) authenticate(ctx context.Context, conn quic.Connection, counters *connCounters) error {
+	ctx, cancel := context.WithTimeout(ctx, authTimeout)
+	defer cancel()
+
+	stream, err := conn.AcceptStream(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to accept auth stream: %w", err)
+	}
+	stream.SetDeadline(time.Now().Add(authTimeout))
+
+	ds := s.newDNSStream(conn, counters, stream)
+	defer ds.Close()
+
+	if err := s.auth.Verify(ds); err != nil {
+		return err
+	}
+
+	if _, err := ds.Write([]byte{authOK}); err != nil {
+		return fmt.Errorf("failed to acknowledge authentication: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Server) handleStream(ctx context.Context, conn quic.Connection, tc *trackedConn, counters *connCounters, limit *clientLimit, stream quic.Stream) {
 	defer stream.Close()
 
-	dnsStream := &serverDNSStream{
-		stream: stream,
-		domain: s.domain,
+	counters.streams.Add(1)
+	counters.activeStreams.Add(1)
+	defer counters.activeStreams.Add(-1)
+	s.stats.streams.Add(1)
+	s.stats.activeStreams.Add(1)
+	defer s.stats.activeStreams.Add(-1)
+
+	dnsStream := s.newDNSStream(conn, counters, stream)
+
+	var kind [1]byte
+	if _, err := io.ReadFull(dnsStream, kind[:]); err != nil {
+		s.log.Debug("Failed to read stream kind", "conn", counters.connID, "stream", stream.StreamID(), "error", err)
+		return
+	}
+
+	switch kind[0] {
+	case streamKindData:
+	case streamKindReusable:
+		s.handleReusable(ctx, tc, counters, limit, dnsStream)
+		return
+	case streamKindPing:
+		if err := handlePing(dnsStream); err != nil {
+			s.log.Debug("Ping failed", "conn", counters.connID, "error", err)
+		}
+		return
+	case streamKindHello:
+		if err := s.handleHello(dnsStream, counters); err != nil {
+			s.log.Warn("Feature negotiation failed", "conn", counters.connID, "error", err)
+		}
+		return
+	default:
+		s.log.Warn("Unknown stream kind", "conn", counters.connID, "stream", stream.StreamID(), "kind", kind[0])
+		stream.CancelWrite(quic.StreamErrorCode(ErrorCodeInternal))
+		return
+	}
+
+	// The prologue is consumed here so handlers see only application data
+	target, err := ReadTarget(dnsStream)
+	if err != nil {
+		s.log.Warn("Invalid stream prologue", "conn", counters.connID, "stream", stream.StreamID(), "error", err)
+		return
+	}
+	if !s.startUse(counters, limit, dnsStream, target) {
+		return
+	}
+	s.runHandler(ctx, counters, dnsStream, dnsStream)
+}
+
+// startUse prepares a data stream, or a use of a reusable one, for the
+// handler once its prologue has been read. It reports false if the target
+// was rejected.
+func (s *Server) startUse(counters *connCounters, limit *clientLimit, dnsStream *serverDNSStream, target string) bool {
+	dnsStream.target = target
+	dnsStream.needStatus = true
+	dnsStream.rejected = false
+	dnsStream.limit = limit
+	if counters.compress.Load() && dnsStream.compressor == nil {
+		dnsStream.compressor = newFrameCompressor(s.compressLevel)
+		dnsStream.decompressor = &frameDecompressor{}
+	}
+
+	if err := ValidateTarget(target); err != nil {
+		s.log.Warn("Rejected stream", "conn", counters.connID, "stream", dnsStream.StreamID(), "error", err)
+		dnsStream.Reject(fmt.Errorf("%w: %w", ErrTargetDenied, err))
+		return false
+	}
+	return true
+}
+
+// runHandler passes stream, a data stream or a use of a reusable one, to
+// the handler and reports whether it succeeded
+func (s *Server) runHandler(ctx context.Context, counters *connCounters, dnsStream *serverDNSStream, stream io.ReadWriteCloser) bool {
+	err := s.handler.HandleStream(ctx, stream)
+	if err == nil {
+		return true
+	}
+	if IsClosed(err) {
+		// The client or the server went away, which the handler can't be
+		// blamed for
+		s.log.Debug("Stream closed", "conn", counters.connID, "stream", dnsStream.StreamID(), "reason", err)
+		return false
+	}
+
+	s.log.Debug("Stream handler failed", "conn", counters.connID, "stream", dnsStream.StreamID(), "error", err)
+	// Reset rather than finish the stream so the client sees why it
+	// failed, unless the handler already told it with Reject
+	if !dnsStream.rejected {
+		dnsStream.stream.CancelWrite(streamErrorCode(err))
 	}
+	return false
+}
 
-	if err := s.handler.HandleStream(ctx, dnsStream); err != nil {
-		log.Printf("Stream handler error: %v", err)
+func (s *Server) newDNSStream(conn quic.Connection, counters *connCounters, stream quic.Stream) *serverDNSStream {
+	return &serverDNSStream{
+		stream:   stream,
+		reader:   bufio.NewReaderSize(stream, s.readBuffer),
+		conn:     conn,
+		counters: counters,
+		stats:    &s.stats,
+		config:   s.dnsConfig,
+		domains:  s.domains,
+		reply:    replyParams{domain: s.domains[0]},
 	}
 }
 
 // serverDNSStream wraps a QUIC stream with DNS encoding/decoding for server side
 type serverDNSStream struct {
-	stream quic.Stream
+	stream   quic.Stream
+	reader   *bufio.Reader
+	conn     quic.Connection
+	counters *connCounters
+	stats    *trafficCounters
+	config   dnspkg.Config
+	domains  []string
+	// replyMu guards reply, which readQuery updates while the handler may
+	// be writing responses
+	replyMu sync.Mutex
+	reply   replyParams
+	// target is the address requested in the stream prologue
+	target string
+	// needStatus is set on data streams until the stream status is sent
+	needStatus bool
+	rejected   bool
+	// limit throttles the data of data streams to the client's bandwidth
+	limit *clientLimit
+	// compressor and decompressor are set on data streams of connections
+	// that negotiated compression
+	compressor   *frameCompressor
+	decompressor *frameDecompressor
+	// pending holds decoded data not yet returned by Read
+	pending []byte
+}
+
+// replyParams are taken from the last query and followed by the responses
+// to it
+type replyParams struct {
+	// domain is the base domain the query matched
 	domain string
+	// qtype is the record type of the query
+	qtype uint16
+	// maxResponse is the response size the client advertised via EDNS,
+	// within the server's own EDNS buffer size
+	maxResponse int
+}
+
+// Target returns the target address requested by the client, or "" for the
+// server's default
+func (ds *serverDNSStream) Target() string {
+	return ds.target
+}
+
+var _ StreamInfo = (*serverDNSStream)(nil)
+
+// RemoteAddr returns the address of the client that opened the stream
+func (ds *serverDNSStream) RemoteAddr() net.Addr {
+	return ds.conn.RemoteAddr()
+}
+
+// LocalAddr returns the server address the stream arrived on
+func (ds *serverDNSStream) LocalAddr() net.Addr {
+	return ds.conn.LocalAddr()
+}
+
+// StreamID returns the QUIC stream ID
+func (ds *serverDNSStream) StreamID() int64 {
+	return int64(ds.stream.StreamID())
+}
+
+// ConnID returns the server-assigned ID of the stream's connection
+func (ds *serverDNSStream) ConnID() uint64 {
+	return ds.counters.connID
+}
+
+var _ StreamRejecter = (*serverDNSStream)(nil)
+
+// Reject reports err to the client in place of the stream's data
+func (ds *serverDNSStream) Reject(err error) error {
+	if !ds.needStatus {
+		return fmt.Errorf("stream status already sent")
+	}
+	ds.needStatus = false
+	ds.rejected = true
+
+	if _, err := ds.write(rejectStatus(err)); err != nil {
+		return fmt.Errorf("failed to send stream rejection: %w", err)
+	}
+	return nil
 }
 
 func (ds *serverDNSStream) Read(p []byte) (int, error) {
-	// For the server, we read QUIC data and decode it as DNS queries
-	buf := make([]byte, 4096)
-	n, err := ds.stream.Read(buf)
+	// A query may carry more data than fits in p, so the rest is kept for
+	// the next calls
+	for len(ds.pending) == 0 {
+		data, err := ds.readQuery()
+		if err != nil {
+			return 0, err
+		}
+		if ds.decompressor != nil {
+			if data, err = ds.decompressor.decompress(data); err != nil {
+				return 0, err
+			}
+		}
+		ds.pending = data
+	}
+
+	n := copy(p, ds.pending)
+	ds.pending = ds.pending[n:]
+	ds.counters.bytesIn.Add(uint64(n))
+	ds.stats.bytesRead.Add(uint64(n))
+	ds.limit.throttleIn(n)
+	return n, nil
+}
+
+// readQuery reads the next DNS query and returns the data it carries
+func (ds *serverDNSStream) readQuery() ([]byte, error) {
+	// For the server, we read framed DNS queries from the QUIC stream
+	buf, err := readFrame(ds.reader)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
+	ds.stats.queries.Add(1)
+	ds.stats.wireIn.Add(uint64(frameLen(buf)))
 
 	// Parse DNS query
 	msg := new(dns.Msg)
-	if err := msg.Unpack(buf[:n]); err != nil {
-		return 0, fmt.Errorf("failed to parse DNS query: %w", err)
+	if err := msg.Unpack(buf); err != nil {
+		return nil, fmt.Errorf("stream %d: %w: failed to parse DNS query: %w", ds.stream.StreamID(), ErrDNSDecode, err)
 	}
 
 	// Extract data from query
-	data, err := dnspkg.ParseQueryData(msg, ds.domain)
+	data, err := ds.config.ParseQueryData(msg, ds.domains...)
 	if err != nil {
-		return 0, fmt.Errorf("failed to extract data from DNS query: %w", err)
+		return nil, fmt.Errorf("stream %d: %w", ds.stream.StreamID(), dataError("DNS query", err))
+	}
+	ds.replyMu.Lock()
+	ds.reply.qtype = msg.Question[0].Qtype
+	ds.reply.maxResponse = ds.config.ResponseSizeLimit(msg)
+	if _, base, err := dnspkg.MatchDomain(msg.Question[0].Name, ds.domains...); err == nil {
+		ds.reply.domain = base
 	}
+	ds.replyMu.Unlock()
 
-	// Copy to output buffer
-	copied := copy(p, data)
-	return copied, nil
+	return data, nil
 }
 
 func (ds *serverDNSStream) Write(p []byte) (int, error) {
-	// For the server, we encode data as DNS responses
-	// We need to create a dummy query to respond to
-	dummyQuery := new(dns.Msg)
-	dummyQuery.SetQuestion(dnspkg.CreateFQDN("", ds.domain), dns.TypeTXT)
-
-	msg := dnspkg.CreateResponse(dummyQuery, p)
-
-	// Pack DNS message
-	packed, err := msg.Pack()
-	if err != nil {
-		return 0, fmt.Errorf("failed to pack DNS response: %w", err)
+	var n int
+	var err error
+	if ds.compressor == nil {
+		n, err = ds.writeData(p)
+	} else if _, err = ds.writeData(ds.compressor.compress(p)); err == nil {
+		// A partially sent frame can't be decompressed, so a failed write
+		// consumes none of p
+		n = len(p)
 	}
+	ds.stats.bytesWritten.Add(uint64(n))
+	ds.limit.throttleOut(n)
+	return n, err
+}
 
-	// Write to QUIC stream
-	_, err = ds.stream.Write(packed)
-	if err != nil {
-		return 0, err
+// writeData sends p, preceded by the accepted status on the first write
+func (ds *serverDNSStream) writeData(p []byte) (int, error) {
+	if !ds.needStatus {
+		return ds.write(p)
 	}
 
-	return len(p), nil
+	// Send the accepted status together with the first data
+	ds.needStatus = false
+	n, err := ds.write(append([]byte{statusOK}, p...))
+	return max(0, n-1), err
 }
 
-func (ds *serverDNSStream) Close() error {
-	return ds.stream.Close()
+// lastReply returns the reply parameters of the last query
+func (ds *serverDNSStream) lastReply() replyParams {
+	ds.replyMu.Lock()
+	defer ds.replyMu.Unlock()
+
+	return ds.reply
 }
 
-// generateTLSConfig generates a self-signed TLS certificate for testing
-func generateTLSConfig() (*tls.Config, error) {
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return nil, err
-	}
+// write encodes p as DNS responses
+func (ds *serverDNSStream) write(p []byte) (int, error) {
+	// For the server, we encode data as DNS responses
+	// We need to create a dummy query to respond to
+	dummyQuery := new(dns.Msg)
+	reply := ds.lastReply()
 
-	template := x509.Certificate{
-		SerialNumber: big.NewInt(1),
-		Subject: pkix.Name{
-			CommonName: SNI,
-		},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		BasicConstraintsValid: true,
+	// Before the first query, fall back to the configured record type
+	qtype := reply.qtype
+	if qtype == 0 {
+		qtype = ds.config.RecordType
 	}
+	if qtype == 0 {
+		qtype = dns.TypeTXT
+	}
+	dummyQuery.SetQuestion(dnspkg.CreateFQDN("", reply.domain), qtype)
 
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
-	if err != nil {
-		return nil, err
+	// Split the data across as many responses as needed to keep each one
+	// within the size the client advertised
+	maxSize := reply.maxResponse
+	if maxSize == 0 {
+		maxSize = ds.config.MaxResponseSize()
 	}
 
-	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
-	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	written := 0
+	for written < len(p) {
+		msg, n := ds.config.CreateResponseN(dummyQuery, p[written:], maxSize)
+		if n == 0 {
+			return written, fmt.Errorf("DNS response has no room for data")
+		}
 
-	cert, err := tls.X509KeyPair(certPEM, keyPEM)
-	if err != nil {
-		return nil, err
+		// Pack DNS message
+		packed, err := msg.Pack()
+		if err != nil {
+			return written, fmt.Errorf("failed to pack DNS response: %w", err)
+		}
+
+		// Write to QUIC stream
+		if err := writeFrame(ds.stream, packed); err != nil {
+			return written, err
+		}
+		ds.stats.responses.Add(1)
+		ds.stats.wireOut.Add(uint64(frameLen(packed)))
+		written += n
+		ds.counters.bytesOut.Add(uint64(n))
 	}
 
-	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		NextProtos:   []string{ALPN},
-	}, nil
+	return written, nil
+}
+
+func (ds *serverDNSStream) SetDeadline(t time.Time) error {
+	return ds.stream.SetDeadline(t)
+}
+
+func (ds *serverDNSStream) SetReadDeadline(t time.Time) error {
+	return ds.stream.SetReadDeadline(t)
+}
+
+func (ds *serverDNSStream) SetWriteDeadline(t time.Time) error {
+	return ds.stream.SetWriteDeadline(t)
+}
+
+// CloseWrite closes the send side of the stream, so the client reads EOF
+// while the stream can still be read from
+func (ds *serverDNSStream) CloseWrite() error {
+	return ds.stream.Close()
+}
+
+// Close closes both directions of the stream. quic.Stream.Close only closes
+// the send side, so the receive side is cancelled to unblock pending reads.
+func (ds *serverDNSStream) Close() error {
+	ds.stream.CancelRead(quic.StreamErrorCode(ErrorCodeNone))
+	return ds.stream.Close()
 }
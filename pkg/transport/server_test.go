@@ -0,0 +1,54 @@
+package transport_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"testing"
+
+	dnspkg "github.com/getlantern/lantern/slipstream/pkg/dns"
+)
+
+// bulkReply answers the first byte of a stream with data, in a single write
+type bulkReply struct {
+	data []byte
+}
+
+func (h bulkReply) HandleStream(ctx context.Context, stream io.ReadWriteCloser) error {
+	defer stream.Close()
+	if _, err := io.ReadFull(stream, make([]byte, 1)); err != nil {
+		return err
+	}
+	_, err := stream.Write(h.data)
+	return err
+}
+
+func TestLargeWriteSplitsAcrossResponses(t *testing.T) {
+	data := make([]byte, 10<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+	h := newHarness(t, bulkReply{data})
+
+	stream, err := h.OpenStream(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if _, err := stream.Write([]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatalf("read failed after %d bytes: %v", len(got), err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("received %d bytes, differing from the %d written", len(got), len(data))
+	}
+
+	// Every response fits the EDNS buffer, so the write took several
+	responses := h.Server.Stats().Responses
+	if fewest := uint64(len(data) / dnspkg.EDNSBufferSize); responses <= fewest {
+		t.Fatalf("%d bytes took %d responses, want more than %d", len(data), responses, fewest)
+	}
+}
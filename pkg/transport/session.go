@@ -0,0 +1,454 @@
+package transport
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	dnspkg "github.com/getlantern/lantern/slipstream/pkg/dns"
+)
+
+// Without QUIC underneath, a stream is carried by a session of plain
+// request/response exchanges, as over DNS-over-HTTPS. Every query carries a
+// session header, a 4-byte session ID chosen by the client, a flag byte and
+// a sequence header, followed by stream data; every response carries a flag
+// byte and a sequence header followed by stream data. The client keeps one
+// query in flight per session and polls while it has nothing to send, and
+// the server holds a poll open briefly when it has nothing to send either.
+// A failed exchange, such as one a resolver answered with SERVFAIL, is
+// retried a few times before the session fails.
+
+const (
+	sessionIDSize = 4
+	// sessionHeaderSize and sessionRespHeaderSize are the sizes of the
+	// headers in front of the data of queries and responses
+	sessionHeaderSize     = sessionIDSize + 1 + sessionSeqSize
+	sessionRespHeaderSize = 1 + sessionSeqSize
+
+	// Query flags
+	// sessionOpen starts a new session
+	sessionOpen byte = 1 << 0
+	// sessionFin follows the client's last data, like CloseWrite
+	sessionFin byte = 1 << 1
+	// sessionClose ends the session
+	sessionClose byte = 1 << 2
+
+	// Response flags: sessionFin follows the server's last data, and
+	// sessionReset reports that the session is unknown or has failed
+	sessionReset byte = 1 << 3
+
+	// sessionQueryTimeout bounds one exchange
+	sessionQueryTimeout = 30 * time.Second
+	// sessionMinPoll and sessionMaxPoll bound the backoff between polls of
+	// an idle session
+	sessionMinPoll = 50 * time.Millisecond
+	sessionMaxPoll = time.Second
+	// sessionMaxBuffer is how much data a session buffers in each direction
+	// before writers block and polling pauses
+	sessionMaxBuffer = 256 << 10
+	// sessionMaxRetries is how many times in a row a failed exchange is
+	// retried before the session fails
+	sessionMaxRetries = 5
+)
+
+var (
+	// ErrSessionReset is returned by a session stream the server no longer
+	// knows, such as after it expired or its handler failed
+	ErrSessionReset = errors.New("session reset by server")
+)
+
+// ExchangeFunc sends a DNS query and returns the response
+type ExchangeFunc func(ctx context.Context, query *dns.Msg) (*dns.Msg, error)
+
+// SessionClient opens streams carried by sessions of individual DNS
+// exchanges, for transports without QUIC such as DNS-over-HTTPS. Sessions
+// are not authenticated or encrypted by the tunnel itself; they are only as
+// private as the exchanges carrying them.
+type SessionClient struct {
+	domain    string
+	dnsConfig dnspkg.Config
+	exchange  ExchangeFunc
+	log       *slog.Logger
+	stats     trafficCounters
+}
+
+// NewSessionClient creates a client that tunnels streams to domain through
+// the queries it sends with exchange
+func NewSessionClient(domain string, exchange ExchangeFunc) *SessionClient {
+	return &SessionClient{
+		domain:    domain,
+		dnsConfig: dnspkg.DefaultConfig(),
+		exchange:  exchange,
+		log:       slog.Default(),
+	}
+}
+
+// SetDNSConfig sets how data is encoded in DNS messages. It must be called
+// before opening streams.
+func (c *SessionClient) SetDNSConfig(cfg dnspkg.Config) {
+	c.dnsConfig = cfg
+}
+
+// SetLogger sets the logger for session events
+func (c *SessionClient) SetLogger(logger *slog.Logger) {
+	c.log = logger
+}
+
+// Stats returns a snapshot of the client's traffic since it was created
+func (c *SessionClient) Stats() Stats {
+	return c.stats.snapshot()
+}
+
+// PayloadSize returns the number of bytes of stream data carried per query
+func (c *SessionClient) PayloadSize() int {
+	return c.dnsConfig.MaxPayloadSize(len(c.domain)) - sessionHeaderSize
+}
+
+// OpenStream opens a new session for proxying a connection to the server's
+// default target
+func (c *SessionClient) OpenStream(ctx context.Context) (io.ReadWriteCloser, error) {
+	return c.OpenStreamTo(ctx, "")
+}
+
+// OpenStreamTo opens a new session and asks the server to connect it to
+// target, a host:port address. An empty target selects the server's
+// default. The session is established by its first exchange, so a server
+// that refuses it is reported by Read.
+func (c *SessionClient) OpenStreamTo(ctx context.Context, target string) (io.ReadWriteCloser, error) {
+	if err := ValidateTarget(target); err != nil {
+		return nil, err
+	}
+	if c.PayloadSize() <= 0 {
+		return nil, fmt.Errorf("domain %q leaves no room for session data", c.domain)
+	}
+
+	var id [sessionIDSize]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate session ID: %w", err)
+	}
+
+	cs := &clientSession{
+		client:     c,
+		id:         binary.BigEndian.Uint32(id[:]),
+		needStatus: true,
+		changed:    make(chan struct{}),
+	}
+	if err := WriteTarget(cs, target); err != nil {
+		return nil, err
+	}
+
+	c.stats.streams.Add(1)
+	c.stats.activeStreams.Add(1)
+	go cs.run()
+	return cs, nil
+}
+
+// clientSession is the client side of a session. Writes are buffered and
+// sent by run, which also collects the server's data for Read.
+type clientSession struct {
+	client *SessionClient
+	id     uint32
+
+	mu sync.Mutex
+	// changed is closed and replaced whenever the state below changes
+	changed chan struct{}
+	// out holds data written but not yet acknowledged by the server, from
+	// offset outSeq, and in data received but not yet read
+	out    []byte
+	outSeq uint32
+	in     []byte
+	inSeq  seqBuffer
+	// closeWrite is set by CloseWrite and finSent once the server has
+	// acknowledged all data up to it
+	closeWrite bool
+	finSent    bool
+	// remoteFin is set once the server has sent its last data
+	remoteFin bool
+	closed    bool
+	err       error
+	// needStatus is set until the stream status has been received
+	needStatus bool
+	status     []byte
+}
+
+// notify wakes everything waiting on the session. The caller holds cs.mu.
+func (cs *clientSession) notify() {
+	close(cs.changed)
+	cs.changed = make(chan struct{})
+}
+
+func (cs *clientSession) Read(p []byte) (int, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	for len(cs.in) == 0 {
+		switch {
+		case cs.closed:
+			return 0, ErrStreamClosed
+		case cs.err != nil:
+			return 0, cs.err
+		case cs.remoteFin:
+			return 0, io.EOF
+		}
+		changed := cs.changed
+		cs.mu.Unlock()
+		<-changed
+		cs.mu.Lock()
+	}
+
+	n := copy(p, cs.in)
+	cs.in = cs.in[n:]
+	// Polling pauses while the buffer is full
+	cs.notify()
+	cs.client.stats.bytesRead.Add(uint64(n))
+	return n, nil
+}
+
+func (cs *clientSession) Write(p []byte) (int, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	for len(cs.out) >= sessionMaxBuffer {
+		if err := cs.writeErr(); err != nil {
+			return 0, err
+		}
+		changed := cs.changed
+		cs.mu.Unlock()
+		<-changed
+		cs.mu.Lock()
+	}
+	if err := cs.writeErr(); err != nil {
+		return 0, err
+	}
+
+	cs.out = append(cs.out, p...)
+	cs.notify()
+	cs.client.stats.bytesWritten.Add(uint64(len(p)))
+	return len(p), nil
+}
+
+// writeErr returns why the session can't be written to, if it can't. The
+// caller holds cs.mu.
+func (cs *clientSession) writeErr() error {
+	switch {
+	case cs.closed || cs.closeWrite:
+		return ErrStreamClosed
+	case cs.err != nil:
+		return cs.err
+	}
+	return nil
+}
+
+// CloseWrite tells the server no more data follows once the buffered data
+// is sent, while the session can still be read from
+func (cs *clientSession) CloseWrite() error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.closeWrite = true
+	cs.notify()
+	return nil
+}
+
+// Close ends the session. Data not yet sent is discarded.
+func (cs *clientSession) Close() error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if !cs.closed {
+		cs.closed = true
+		cs.notify()
+	}
+	return nil
+}
+
+// run exchanges queries for the session until it is closed or fails
+func (cs *clientSession) run() {
+	defer cs.client.stats.activeStreams.Add(-1)
+
+	flags := sessionOpen
+	var delay time.Duration
+	var failures int
+	for {
+		cs.mu.Lock()
+		if cs.closed || cs.err != nil || cs.finSent && cs.remoteFin {
+			done := cs.err == nil
+			seq, ack := cs.outSeq, cs.inSeq.next
+			cs.mu.Unlock()
+			if done {
+				cs.exchange(sessionClose, seq, ack, nil)
+			}
+			return
+		}
+
+		chunk := cs.out[:min(len(cs.out), cs.client.PayloadSize())]
+		seq, ack := cs.outSeq, cs.inSeq.next
+		send := flags
+		if cs.closeWrite && !cs.finSent && len(chunk) == len(cs.out) {
+			send |= sessionFin
+		}
+		// Nothing to send, and nothing to poll for once the server is done
+		// or the read buffer is full
+		idle := len(chunk) == 0 && send == 0
+		if idle && (cs.remoteFin || len(cs.in) >= sessionMaxBuffer) {
+			changed := cs.changed
+			cs.mu.Unlock()
+			<-changed
+			continue
+		}
+		cs.mu.Unlock()
+
+		if idle && delay > 0 {
+			cs.mu.Lock()
+			changed := cs.changed
+			cs.mu.Unlock()
+			select {
+			case <-changed:
+				delay = 0
+				continue
+			case <-time.After(delay):
+			}
+		}
+
+		resp, err := cs.exchange(send, seq, ack, chunk)
+
+		cs.mu.Lock()
+		switch {
+		case err != nil && retryable(err) && failures < sessionMaxRetries:
+			// The same data is sent again, which the server ignores if the
+			// query did reach it
+			failures++
+			changed := cs.changed
+			cs.mu.Unlock()
+			select {
+			case <-changed:
+			case <-time.After(min(sessionMinPoll<<failures, sessionMaxPoll)):
+			}
+			continue
+		case err != nil:
+			cs.err = err
+		case resp.flags&sessionReset != 0:
+			cs.err = ErrSessionReset
+		default:
+			failures = 0
+			flags = 0
+			cs.acknowledged(resp.ack)
+			if send&sessionFin != 0 && len(cs.out) == 0 {
+				cs.finSent = true
+			}
+			data := cs.inSeq.add(resp.seq, resp.data, resp.flags&sessionFin != 0)
+			cs.remoteFin = cs.inSeq.done()
+			cs.err = cs.receive(data)
+		}
+		cs.notify()
+		cs.mu.Unlock()
+
+		if idle && len(resp.data) == 0 {
+			delay = min(max(2*delay, sessionMinPoll), sessionMaxPoll)
+		} else {
+			delay = 0
+		}
+	}
+}
+
+// retryable reports whether a failed exchange may succeed if sent again:
+// anything but a response saying the query itself is wrong, such as
+// NXDOMAIN from a resolver the tunnel domain isn't delegated through.
+// Timeouts and dnspkg.RetryableDNSError responses are retried.
+func retryable(err error) bool {
+	return !errors.Is(err, dnspkg.ErrNXDomain) && !errors.Is(err, dnspkg.ErrRcode)
+}
+
+// acknowledged drops the data the server has received up to offset ack.
+// The caller holds cs.mu.
+func (cs *clientSession) acknowledged(ack uint32) {
+	if !seqBefore(cs.outSeq, ack) {
+		return
+	}
+	n := min(int(ack-cs.outSeq), len(cs.out))
+	cs.out = cs.out[n:]
+	cs.outSeq += uint32(n)
+}
+
+// receive buffers data from the server, consuming the stream status first.
+// The caller holds cs.mu.
+func (cs *clientSession) receive(data []byte) error {
+	if cs.needStatus && len(data) > 0 {
+		cs.status = append(cs.status, data...)
+		rest, more, err := parseStatus(cs.status)
+		if err != nil {
+			cs.needStatus = false
+			return err
+		}
+		if more {
+			return nil
+		}
+		cs.needStatus, cs.status = false, nil
+		data = rest
+	}
+	cs.in = append(cs.in, data...)
+	return nil
+}
+
+// sessionResp is a response of a session
+type sessionResp struct {
+	flags    byte
+	seq, ack uint32
+	data     []byte
+}
+
+// exchange sends one query of the session carrying flags and data from
+// offset seq, acknowledging the server's data up to ack, and returns the
+// response
+func (cs *clientSession) exchange(flags byte, seq, ack uint32, data []byte) (sessionResp, error) {
+	c := cs.client
+	payload := make([]byte, sessionHeaderSize, sessionHeaderSize+len(data))
+	binary.BigEndian.PutUint32(payload, cs.id)
+	payload[sessionIDSize] = flags
+	putSeq(payload[sessionIDSize+1:], seq, ack)
+	payload = append(payload, data...)
+
+	query, err := c.dnsConfig.CreateQuery(payload, c.domain)
+	if err != nil {
+		return sessionResp{}, fmt.Errorf("failed to create DNS query: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sessionQueryTimeout)
+	defer cancel()
+	resp, err := c.exchange(ctx, query)
+	c.stats.queries.Add(1)
+	c.stats.wireOut.Add(uint64(query.Len()))
+	if err != nil {
+		c.log.Debug("Session exchange failed", "session", cs.id, "error", err)
+		return sessionResp{}, fmt.Errorf("session %d: failed to exchange DNS query: %w", cs.id, err)
+	}
+	c.stats.responses.Add(1)
+	c.stats.wireIn.Add(uint64(resp.Len()))
+
+	respPayload, err := c.dnsConfig.ParseResponseData(resp)
+	if err != nil {
+		return sessionResp{}, fmt.Errorf("session %d: %w", cs.id, dataError("DNS response", err))
+	}
+	if len(respPayload) < sessionRespHeaderSize {
+		return sessionResp{}, fmt.Errorf("session %d: %w: DNS response has no session header", cs.id, ErrDNSDecode)
+	}
+	sr := sessionResp{flags: respPayload[0], data: respPayload[sessionRespHeaderSize:]}
+	sr.seq, sr.ack = parseSeq(respPayload[1:])
+	return sr, nil
+}
+
+// payload returns the response as carried in a DNS response
+func (r sessionResp) payload() []byte {
+	payload := make([]byte, sessionRespHeaderSize, sessionRespHeaderSize+len(r.data))
+	payload[0] = r.flags
+	putSeq(payload[1:], r.seq, r.ack)
+	return append(payload, r.data...)
+}
@@ -0,0 +1,115 @@
+package transport_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/getlantern/lantern/slipstream/pkg/slipstreamtest"
+	"github.com/getlantern/lantern/slipstream/pkg/transport"
+)
+
+func TestServeQueryAnswersMalformedNamesWithFormErr(t *testing.T) {
+	server, err := transport.NewServer("192.0.2.1:53", slipstreamtest.Domain, transport.EchoHandler{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 5353}
+
+	for _, subdomain := range []string{"mzxw6!", "mz\\000xw6", "abc", "18mzxw6", "mzxw6..mzxw6", "_-_"} {
+		query := new(dns.Msg)
+		query.SetQuestion(subdomain+"."+slipstreamtest.Domain+".", dns.TypeTXT)
+
+		resp := server.ServeQuery(query, remote, nil)
+		if resp.Rcode != dns.RcodeFormatError {
+			t.Errorf("%q answered with %s, want FORMERR", subdomain, dns.RcodeToString[resp.Rcode])
+		}
+	}
+}
+
+// newSessionHarness starts a session harness passing streams to handler
+func newSessionHarness(t *testing.T, handler transport.StreamHandler) *slipstreamtest.SessionHarness {
+	t.Helper()
+	h, err := slipstreamtest.NewSessionHarness(handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+// streamOpener opens streams to the server's default target
+type streamOpener interface {
+	OpenStream(ctx context.Context) (io.ReadWriteCloser, error)
+}
+
+// sessionEcho sends data through an echo stream of h and checks that it
+// comes back intact
+func sessionEcho(t *testing.T, h streamOpener, data []byte) {
+	t.Helper()
+	stream, err := h.OpenStream(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	go func() {
+		stream.Write(data)
+		stream.(interface{ CloseWrite() error }).CloseWrite()
+	}()
+	got, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatalf("read failed after %d bytes: %v", len(got), err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("echoed %d bytes, differing from the %d sent", len(got), len(data))
+	}
+}
+
+func TestSessionSurvivesDroppedAndReorderedExchanges(t *testing.T) {
+	h := newSessionHarness(t, transport.EchoHandler{})
+	// Late duplicates arrive after the queries that followed them
+	h.SetFaults(slipstreamtest.Faults{
+		Duplicate: 0.3,
+		Delay:     50 * time.Millisecond,
+		Drop:      0.2,
+	})
+
+	data := make([]byte, 20<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+	sessionEcho(t, h, data)
+}
+
+func TestSessionRetriesServFail(t *testing.T) {
+	server, err := transport.NewServer("192.0.2.1:53", slipstreamtest.Domain, transport.EchoHandler{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Shutdown(context.Background()) })
+	remote := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 5353}
+
+	// Every other exchange fails, so each SERVFAIL is followed by success
+	var exchanges atomic.Int64
+	client := transport.NewSessionClient(slipstreamtest.Domain, func(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+		if exchanges.Add(1)%2 == 1 {
+			resp := new(dns.Msg)
+			resp.SetRcode(query, dns.RcodeServerFailure)
+			return resp, nil
+		}
+		return server.ServeQuery(query, remote, nil), nil
+	})
+
+	data := make([]byte, 5000)
+	rand.New(rand.NewSource(1)).Read(data)
+	sessionEcho(t, client, data)
+	if n := exchanges.Load(); n < 2 {
+		t.Fatalf("%d exchanges, none of them retried", n)
+	}
+}
@@ -0,0 +1,104 @@
+package transport
+
+import "encoding/binary"
+
+// Exchanges of a session may be duplicated, reordered or lost on their way
+// through resolvers, so session data is sequenced like TCP's: every query
+// and response carries the stream offset of its data and acknowledges the
+// data received from the other side so far. Data behind the receiver's
+// offset is dropped as a duplicate, data ahead of it held until the gap is
+// filled, and unacknowledged data sent again from the acknowledged offset.
+// QUIC streams are already reliable and don't use any of this.
+
+// sessionSeqSize is the size of the sequence header, the 4-byte offset of
+// the message's data followed by the 4-byte offset acknowledged
+const sessionSeqSize = 8
+
+// putSeq writes the sequence header to b
+func putSeq(b []byte, seq, ack uint32) {
+	binary.BigEndian.PutUint32(b, seq)
+	binary.BigEndian.PutUint32(b[4:], ack)
+}
+
+// parseSeq reads the sequence header from b
+func parseSeq(b []byte) (seq, ack uint32) {
+	return binary.BigEndian.Uint32(b), binary.BigEndian.Uint32(b[4:])
+}
+
+// seqBefore reports whether offset a comes before b, allowing for the
+// offsets wrapping around after 4GB
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// seqBuffer puts received session data back in order. The zero value
+// expects data from offset zero.
+type seqBuffer struct {
+	// next is the offset of the next byte expected
+	next uint32
+	// ahead holds data received past a gap by offset, up to sessionMaxBuffer
+	// bytes in all
+	ahead     map[uint32][]byte
+	aheadSize int
+	// finAt is the offset the stream ends at, once known
+	finAt  uint32
+	hasFin bool
+}
+
+// add takes data starting at offset seq, the last data of the stream if fin
+// is set, and returns the data now in order
+func (b *seqBuffer) add(seq uint32, data []byte, fin bool) []byte {
+	if fin {
+		b.finAt, b.hasFin = seq+uint32(len(data)), true
+	}
+
+	var in []byte
+	for {
+		if seqBefore(b.next, seq) {
+			b.hold(seq, data)
+			return in
+		}
+		if end := seq + uint32(len(data)); seqBefore(b.next, end) {
+			in = append(in, data[b.next-seq:]...)
+			b.next = end
+		}
+
+		// Held data may follow on now
+		seq, data = b.take()
+		if data == nil {
+			return in
+		}
+	}
+}
+
+// hold keeps data ahead of a gap for later, unless there is no room left;
+// the sender will send it again
+func (b *seqBuffer) hold(seq uint32, data []byte) {
+	held := b.ahead[seq]
+	if len(data) <= len(held) || b.aheadSize+len(data)-len(held) > sessionMaxBuffer {
+		return
+	}
+	if b.ahead == nil {
+		b.ahead = make(map[uint32][]byte)
+	}
+	b.ahead[seq] = append([]byte(nil), data...)
+	b.aheadSize += len(data) - len(held)
+}
+
+// take removes and returns held data that starts at or before the next
+// offset, or nil if there is none
+func (b *seqBuffer) take() (uint32, []byte) {
+	for seq, data := range b.ahead {
+		if !seqBefore(b.next, seq) {
+			delete(b.ahead, seq)
+			b.aheadSize -= len(data)
+			return seq, data
+		}
+	}
+	return 0, nil
+}
+
+// done reports whether all data up to the end of the stream was received
+func (b *seqBuffer) done() bool {
+	return b.hasFin && b.next == b.finAt
+}
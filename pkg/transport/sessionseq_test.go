@@ -0,0 +1,117 @@
+package transport
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSeqBufferAdd(t *testing.T) {
+	type step struct {
+		seq  uint32
+		data string
+		fin  bool
+		want string
+	}
+	const last = math.MaxUint32 - 1 // two bytes before the offsets wrap
+
+	for _, tc := range []struct {
+		name  string
+		start uint32
+		steps []step
+		done  bool
+	}{
+		{"in order", 0, []step{
+			{0, "abc", false, "abc"},
+			{3, "def", true, "def"},
+		}, true},
+		{"gap", 0, []step{
+			{3, "def", false, ""},
+			{6, "ghi", false, ""},
+			{0, "abc", false, "abcdefghi"},
+		}, false},
+		{"duplicate", 0, []step{
+			{0, "abc", false, "abc"},
+			{0, "abc", false, ""},
+			{3, "def", false, "def"},
+			{3, "def", false, ""},
+		}, false},
+		{"duplicate ahead", 0, []step{
+			{3, "def", false, ""},
+			{3, "def", false, ""},
+			{0, "abc", false, "abcdef"},
+		}, false},
+		{"overlap", 0, []step{
+			{0, "abc", false, "abc"},
+			{1, "bcde", false, "de"},
+			{2, "cd", false, ""},
+		}, false},
+		{"overlap ahead", 0, []step{
+			{4, "ef", false, ""},
+			{3, "defg", false, ""},
+			{0, "abc", false, "abcdefg"},
+		}, false},
+		{"fin before gap", 0, []step{
+			{3, "def", true, ""},
+			{0, "abc", false, "abcdef"},
+		}, true},
+		{"fin without data", 0, []step{
+			{0, "abc", false, "abc"},
+			{3, "", true, ""},
+		}, true},
+		{"fin with gap left", 0, []step{
+			{6, "ghi", true, ""},
+			{0, "abc", false, "abc"},
+		}, false},
+		{"wraparound", last, []step{
+			{last, "ab", false, "ab"},
+			{0, "cd", true, "cd"},
+		}, true},
+		{"gap across wraparound", last, []step{
+			{0, "cd", false, ""},
+			{last + 1, "bc", false, ""},
+			{last, "ab", false, "abcd"},
+		}, false},
+		{"duplicate across wraparound", last, []step{
+			{last, "abcd", false, "abcd"},
+			{last, "ab", false, ""},
+			{0, "cd", false, ""},
+		}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &seqBuffer{next: tc.start}
+			for i, s := range tc.steps {
+				if got := string(b.add(s.seq, []byte(s.data), s.fin)); got != s.want {
+					t.Fatalf("step %d: add(%d, %q, %v) = %q, want %q", i, s.seq, s.data, s.fin, got, s.want)
+				}
+			}
+			if b.done() != tc.done {
+				t.Fatalf("done() = %v, want %v", b.done(), tc.done)
+			}
+		})
+	}
+}
+
+func TestSeqBufferHoldsLimitedData(t *testing.T) {
+	var b seqBuffer
+	if got := b.add(1, make([]byte, sessionMaxBuffer), false); len(got) != 0 {
+		t.Fatalf("data past a gap returned %d bytes", len(got))
+	}
+	// No room is left, so this is dropped for the sender to send again
+	if got := b.add(sessionMaxBuffer+1, []byte("more"), false); len(got) != 0 {
+		t.Fatalf("data past a gap returned %d bytes", len(got))
+	}
+	if b.aheadSize != sessionMaxBuffer {
+		t.Fatalf("holding %d bytes, want %d", b.aheadSize, sessionMaxBuffer)
+	}
+
+	got := b.add(0, []byte("a"), false)
+	if len(got) != 1+sessionMaxBuffer || b.next != sessionMaxBuffer+1 {
+		t.Fatalf("filling the gap returned %d bytes up to %d", len(got), b.next)
+	}
+	if got := string(b.add(sessionMaxBuffer+1, []byte("more"), false)); got != "more" {
+		t.Fatalf("resent data returned %q", got)
+	}
+	if b.aheadSize != 0 || len(b.ahead) != 0 {
+		t.Fatalf("still holding %d bytes", b.aheadSize)
+	}
+}
@@ -0,0 +1,545 @@
+package transport
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	dnspkg "github.com/getlantern/lantern/slipstream/pkg/dns"
+)
+
+const (
+	// sessionPollWait is how long the server holds a poll open for data
+	// before answering it empty
+	sessionPollWait = 250 * time.Millisecond
+	// sessionIdleTimeout expires sessions the client stopped polling
+	sessionIdleTimeout = 2 * time.Minute
+)
+
+// sessionTable holds the server's open sessions by ID
+type sessionTable struct {
+	mu       sync.Mutex
+	sessions map[uint32]*serverSession
+	// ended holds when recently ended sessions ended, so that late
+	// duplicates of their opening queries don't open them again
+	ended     map[uint32]time.Time
+	lastSweep time.Time
+}
+
+func (t *sessionTable) get(id uint32) *serverSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.sessions[id]
+}
+
+// add registers sess unless a session with its ID exists, which is
+// returned instead
+func (t *sessionTable) add(sess *serverSession) (*serverSession, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if existing, ok := t.sessions[sess.id]; ok {
+		return existing, false
+	}
+	if t.sessions == nil {
+		t.sessions = make(map[uint32]*serverSession)
+	}
+	t.sessions[sess.id] = sess
+	return sess, true
+}
+
+func (t *sessionTable) remove(sess *serverSession) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.sessions[sess.id] != sess {
+		return
+	}
+	delete(t.sessions, sess.id)
+
+	now := time.Now()
+	if now.Sub(t.lastSweep) >= sessionIdleTimeout {
+		t.lastSweep = now
+		for id, ended := range t.ended {
+			if now.Sub(ended) >= sessionIdleTimeout {
+				delete(t.ended, id)
+			}
+		}
+	}
+	if t.ended == nil {
+		t.ended = make(map[uint32]time.Time)
+	}
+	t.ended[sess.id] = now
+}
+
+// recentlyEnded reports whether a session with ID id ended within
+// sessionIdleTimeout
+func (t *sessionTable) recentlyEnded(id uint32) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ended, ok := t.ended[id]
+	return ok && time.Since(ended) < sessionIdleTimeout
+}
+
+// closeAll ends every session
+func (t *sessionTable) closeAll() {
+	t.mu.Lock()
+	sessions := make([]*serverSession, 0, len(t.sessions))
+	for _, sess := range t.sessions {
+		sessions = append(sessions, sess)
+	}
+	t.mu.Unlock()
+
+	for _, sess := range sessions {
+		sess.end()
+	}
+}
+
+// ServeQuery answers one query of a session carried outside QUIC, as by
+// ServeHTTP or an in-memory exchange. remote and local are the addresses
+// the query arrived between, if known.
+func (s *Server) ServeQuery(query *dns.Msg, remote, local net.Addr) *dns.Msg {
+	s.stats.queries.Add(1)
+	s.stats.wireIn.Add(uint64(query.Len()))
+
+	resp := s.answerQuery(query, remote, local)
+	s.stats.responses.Add(1)
+	s.stats.wireOut.Add(uint64(resp.Len()))
+	return resp
+}
+
+func (s *Server) answerQuery(query *dns.Msg, remote, local net.Addr) *dns.Msg {
+	// Sessions have no authentication of their own, so they would bypass
+	// the one QUIC connections go through
+	if s.auth != nil {
+		return dnspkg.CreateErrorResponse(query, dns.RcodeRefused)
+	}
+
+	// Malformed queries, such as those whose names fail to decode with
+	// dnspkg.ErrInvalidSubdomain, are answered without touching any session
+	payload, err := s.dnsConfig.ParseQueryData(query, s.domains...)
+	if err != nil || len(payload) < sessionHeaderSize {
+		s.log.Debug("Invalid session query", "remote", remote, "error", err)
+		return dnspkg.CreateErrorResponse(query, dns.RcodeFormatError)
+	}
+	id := binary.BigEndian.Uint32(payload)
+	flags := payload[sessionIDSize]
+	seq, ack := parseSeq(payload[sessionIDSize+1:])
+	data := payload[sessionHeaderSize:]
+
+	sess := s.sessions.get(id)
+	if sess == nil && flags&sessionOpen != 0 && !s.sessions.recentlyEnded(id) {
+		sess = s.openSession(id, remote, local)
+	}
+	if sess == nil {
+		return s.sessionResponse(query, sessionResp{flags: sessionReset})
+	}
+	if flags&sessionClose != 0 {
+		sess.end()
+		return s.sessionResponse(query, sessionResp{})
+	}
+
+	sess.touch()
+	sess.receive(seq, data, flags&sessionFin != 0)
+	sess.acknowledged(ack)
+
+	// A poll is held open until the handler has something to send
+	wait := time.Duration(0)
+	if len(data) == 0 && flags == 0 {
+		wait = sessionPollWait
+	}
+	out, reset := sess.pending(wait)
+	if reset {
+		return s.sessionResponse(query, sessionResp{flags: sessionReset})
+	}
+
+	// Data is only dropped once acknowledged, so whatever doesn't fit, or
+	// is lost on the way, is sent again in later responses
+	limit := s.dnsConfig.ResponseSizeLimit(query)
+	out.data = out.data[:min(len(out.data), limit)]
+	resp, n := s.dnsConfig.CreateResponseN(query, out.payload(), limit)
+	if sent := max(n-sessionRespHeaderSize, 0); sent < len(out.data) {
+		// The final data isn't reached yet
+		out.data = out.data[:sent]
+		out.flags &^= sessionFin
+		resp = s.sessionResponse(query, out)
+	}
+	return resp
+}
+
+// sessionResponse creates the response to query carrying resp
+func (s *Server) sessionResponse(query *dns.Msg, resp sessionResp) *dns.Msg {
+	return s.dnsConfig.CreateResponse(query, resp.payload())
+}
+
+// openSession starts a session and its handler, unless the server is
+// shutting down or at its connection limit. Retransmitted opening queries
+// get the existing session.
+func (s *Server) openSession(id uint32, remote, local net.Addr) *serverSession {
+	if s.shuttingDown() {
+		return nil
+	}
+	limit := s.limiter.client(remote)
+	if !limit.admitStream() {
+		s.log.Warn("Rejected session: stream rate limit exceeded", "remote", remote)
+		return nil
+	}
+	if !s.connSlots.tryAcquire() {
+		s.log.Warn("Rejected session: too many connections", "remote", remote)
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sess := &serverSession{
+		id:      id,
+		connID:  s.nextConnID.Add(1),
+		remote:  remote,
+		local:   local,
+		ctx:     ctx,
+		cancel:  cancel,
+		changed: make(chan struct{}),
+		table:   &s.sessions,
+		stats:   &s.stats,
+		limit:   limit,
+	}
+	sess.timer = time.AfterFunc(sessionIdleTimeout, sess.end)
+	if existing, ok := s.sessions.add(sess); !ok {
+		sess.timer.Stop()
+		cancel()
+		s.connSlots.release()
+		return existing
+	}
+
+	go func() {
+		defer s.connSlots.release()
+		s.handleSession(sess)
+	}()
+	return sess
+}
+
+// handleSession reads the stream prologue of a session and passes the
+// stream to the handler, like handleStream does for QUIC streams
+func (s *Server) handleSession(sess *serverSession) {
+	defer sess.Close()
+
+	s.log.Debug("New session", "conn", sess.connID, "remote", sess.remote)
+	s.stats.streams.Add(1)
+	s.stats.activeStreams.Add(1)
+	defer s.stats.activeStreams.Add(-1)
+
+	target, err := ReadTarget(sess)
+	if err != nil {
+		s.log.Warn("Invalid session prologue", "conn", sess.connID, "error", err)
+		sess.abort()
+		return
+	}
+	sess.target = target
+	sess.needStatus = true
+
+	if err := ValidateTarget(target); err != nil {
+		s.log.Warn("Rejected session", "conn", sess.connID, "error", err)
+		sess.Reject(fmt.Errorf("%w: %w", ErrTargetDenied, err))
+		return
+	}
+
+	if err := s.handler.HandleStream(sess.ctx, sess); err != nil {
+		if IsClosed(err) {
+			s.log.Debug("Session closed", "conn", sess.connID, "reason", err)
+		} else {
+			s.log.Debug("Stream handler failed", "conn", sess.connID, "error", err)
+		}
+		if !sess.rejected {
+			sess.abort()
+		}
+	}
+}
+
+// serverSession is the server side of a session, the stream passed to the
+// handler
+type serverSession struct {
+	id     uint32
+	connID uint64
+	remote net.Addr
+	local  net.Addr
+	ctx    context.Context
+	cancel context.CancelFunc
+	timer  *time.Timer
+	table  *sessionTable
+	stats  *trafficCounters
+	limit  *clientLimit
+
+	// target, needStatus and rejected are only used by the handler
+	target     string
+	needStatus bool
+	rejected   bool
+
+	mu sync.Mutex
+	// changed is closed and replaced whenever the state below changes
+	changed chan struct{}
+	// in holds data received but not yet read, and out data written but not
+	// yet acknowledged by the client, from offset outSeq
+	in     []byte
+	inSeq  seqBuffer
+	out    []byte
+	outSeq uint32
+	// inFin is set once the client has sent its last data, outFin once the
+	// handler has
+	inFin  bool
+	outFin bool
+	// reset is set when the handler failed, ended when the session is gone
+	reset bool
+	ended bool
+}
+
+// notify wakes everything waiting on the session. The caller holds sess.mu.
+func (sess *serverSession) notify() {
+	close(sess.changed)
+	sess.changed = make(chan struct{})
+}
+
+// touch postpones the session's expiry after a query
+func (sess *serverSession) touch() {
+	sess.timer.Reset(sessionIdleTimeout)
+}
+
+// receive buffers data from the client starting at offset seq, the
+// client's last data if fin is set
+//
+// The buffer holds up to sessionMaxBuffer bytes the handler hasn't read.
+// Data past that is dropped without being acknowledged, so the client sends
+// it again later, and the query first waits up to sessionPollWait for the
+// handler to make room rather than have the client resend it at once.
+func (sess *serverSession) receive(seq uint32, data []byte, fin bool) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	end := seq + uint32(len(data))
+	if seqBefore(sess.inEnd(), end) && !sess.ended {
+		changed := sess.changed
+		sess.mu.Unlock()
+		select {
+		case <-changed:
+		case <-time.After(sessionPollWait):
+		}
+		sess.mu.Lock()
+	}
+	if limit := sess.inEnd(); seqBefore(limit, end) {
+		data = data[:max(int32(limit-seq), 0)]
+		fin = false
+	}
+
+	sess.in = append(sess.in, sess.inSeq.add(seq, data, fin)...)
+	sess.inFin = sess.inSeq.done()
+	sess.notify()
+}
+
+// inEnd returns the offset the read buffer has room for data up to. It
+// only moves forward, so data held past a gap still fits once the gap is
+// filled. The caller holds sess.mu.
+func (sess *serverSession) inEnd() uint32 {
+	return sess.inSeq.next + uint32(sessionMaxBuffer-len(sess.in))
+}
+
+// acknowledged drops the data the client has received up to offset ack
+func (sess *serverSession) acknowledged(ack uint32) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if !seqBefore(sess.outSeq, ack) {
+		return
+	}
+	n := min(int(ack-sess.outSeq), len(sess.out))
+	sess.out = sess.out[n:]
+	sess.outSeq += uint32(n)
+	sess.notify()
+}
+
+// pending returns the response carrying the data not yet acknowledged,
+// waiting up to wait for some if there is none. reset reports that the
+// client should be told the session failed instead.
+func (sess *serverSession) pending(wait time.Duration) (resp sessionResp, reset bool) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if len(sess.out) == 0 && !sess.outFin && !sess.reset && !sess.ended && wait > 0 {
+		changed := sess.changed
+		sess.mu.Unlock()
+		select {
+		case <-changed:
+		case <-time.After(wait):
+		}
+		sess.mu.Lock()
+	}
+
+	if sess.reset || sess.ended {
+		return sessionResp{}, true
+	}
+	resp = sessionResp{seq: sess.outSeq, ack: sess.inSeq.next, data: sess.out}
+	if sess.outFin {
+		resp.flags = sessionFin
+	}
+	return resp, false
+}
+
+// end removes the session, failing the handler's pending reads and writes
+func (sess *serverSession) end() {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if sess.ended {
+		return
+	}
+	sess.ended = true
+	sess.timer.Stop()
+	sess.table.remove(sess)
+	sess.cancel()
+	sess.notify()
+}
+
+// abort fails the session so the client gets ErrSessionReset
+func (sess *serverSession) abort() {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	sess.reset = true
+	sess.notify()
+}
+
+// Target returns the target address requested by the client, or "" for the
+// server's default
+func (sess *serverSession) Target() string {
+	return sess.target
+}
+
+var _ StreamInfo = (*serverSession)(nil)
+
+// RemoteAddr returns the address the client's queries arrive from
+func (sess *serverSession) RemoteAddr() net.Addr {
+	return sess.remote
+}
+
+// LocalAddr returns the server address the session's queries arrive on
+func (sess *serverSession) LocalAddr() net.Addr {
+	return sess.local
+}
+
+// StreamID returns the session ID
+func (sess *serverSession) StreamID() int64 {
+	return int64(sess.id)
+}
+
+// ConnID returns the server-assigned ID of the session
+func (sess *serverSession) ConnID() uint64 {
+	return sess.connID
+}
+
+var _ StreamRejecter = (*serverSession)(nil)
+
+// Reject reports err to the client in place of the session's data
+func (sess *serverSession) Reject(err error) error {
+	if !sess.needStatus {
+		return fmt.Errorf("stream status already sent")
+	}
+	sess.needStatus = false
+	sess.rejected = true
+
+	if _, err := sess.write(rejectStatus(err)); err != nil {
+		return fmt.Errorf("failed to send stream rejection: %w", err)
+	}
+	return nil
+}
+
+func (sess *serverSession) Read(p []byte) (int, error) {
+	n, err := sess.read(p)
+	sess.stats.bytesRead.Add(uint64(n))
+	sess.limit.throttleIn(n)
+	return n, err
+}
+
+// read returns buffered data from the client, blocking until there is some
+func (sess *serverSession) read(p []byte) (int, error) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	for len(sess.in) == 0 {
+		switch {
+		case sess.ended:
+			return 0, ErrStreamClosed
+		case sess.inFin:
+			return 0, io.EOF
+		}
+		changed := sess.changed
+		sess.mu.Unlock()
+		<-changed
+		sess.mu.Lock()
+	}
+
+	n := copy(p, sess.in)
+	sess.in = sess.in[n:]
+	// Queries may be waiting for room in the buffer
+	sess.notify()
+	return n, nil
+}
+
+func (sess *serverSession) Write(p []byte) (int, error) {
+	var n int
+	var err error
+	if !sess.needStatus {
+		n, err = sess.write(p)
+	} else {
+		// Send the accepted status together with the first data
+		sess.needStatus = false
+		n, err = sess.write(append([]byte{statusOK}, p...))
+		n = max(n-1, 0)
+	}
+	sess.stats.bytesWritten.Add(uint64(n))
+	sess.limit.throttleOut(n)
+	return n, err
+}
+
+// write buffers p to be sent, blocking while the buffer is full
+func (sess *serverSession) write(p []byte) (int, error) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	for {
+		switch {
+		case sess.ended || sess.outFin:
+			return 0, ErrStreamClosed
+		case len(sess.out) < sessionMaxBuffer:
+			sess.out = append(sess.out, p...)
+			sess.notify()
+			return len(p), nil
+		}
+		changed := sess.changed
+		sess.mu.Unlock()
+		<-changed
+		sess.mu.Lock()
+	}
+}
+
+// CloseWrite sends the client EOF once the buffered data is delivered,
+// while the session can still be read from
+func (sess *serverSession) CloseWrite() error {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	sess.outFin = true
+	sess.notify()
+	return nil
+}
+
+// Close finishes the handler's side of the session. Buffered data is still
+// delivered; the session is removed once the client closes it or stops
+// polling.
+func (sess *serverSession) Close() error {
+	return sess.CloseWrite()
+}
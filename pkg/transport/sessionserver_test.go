@@ -0,0 +1,40 @@
+package transport
+
+import (
+	"testing"
+	"time"
+)
+
+func TestServerSessionLimitsReadBuffer(t *testing.T) {
+	sess := &serverSession{changed: make(chan struct{})}
+	sess.receive(0, make([]byte, sessionMaxBuffer-10), false)
+
+	// Only the 10 bytes that fit are taken, after waiting for room
+	start := time.Now()
+	sess.receive(sessionMaxBuffer-10, make([]byte, 100), true)
+	if elapsed := time.Since(start); elapsed < sessionPollWait/2 {
+		t.Fatalf("query with no room answered after %v", elapsed)
+	}
+	if len(sess.in) != sessionMaxBuffer || sess.inSeq.next != sessionMaxBuffer || sess.inFin {
+		t.Fatalf("buffered %d bytes up to %d, fin %v", len(sess.in), sess.inSeq.next, sess.inFin)
+	}
+
+	// Data past the room left isn't held either
+	sess.receive(sessionMaxBuffer+50, make([]byte, 10), false)
+	if sess.inSeq.aheadSize != 0 {
+		t.Fatalf("holding %d bytes past the room left", sess.inSeq.aheadSize)
+	}
+
+	// Reading makes room for the resent data, which is taken at once
+	if n, err := sess.read(make([]byte, 90)); n != 90 || err != nil {
+		t.Fatalf("read %d bytes: %v", n, err)
+	}
+	start = time.Now()
+	sess.receive(sessionMaxBuffer, make([]byte, 90), true)
+	if elapsed := time.Since(start); elapsed >= sessionPollWait/2 {
+		t.Fatalf("query with room answered after %v", elapsed)
+	}
+	if sess.inSeq.next != sessionMaxBuffer+90 || !sess.inFin {
+		t.Fatalf("buffered data up to %d, fin %v", sess.inSeq.next, sess.inFin)
+	}
+}
@@ -0,0 +1,168 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// shutdownLinger is how long a connection whose last stream finished during
+// shutdown is kept open, so the stream's final data can still be delivered
+const shutdownLinger = time.Second
+
+// ErrServerClosed is returned by Listen once Shutdown has been called
+var ErrServerClosed = errors.New("server closed")
+
+// trackedConn is a connection the server is handling, with the number of
+// its streams in flight and how many of those are reusable streams waiting
+// for their next use, which shutdown doesn't wait for
+type trackedConn struct {
+	conn    quic.Connection
+	streams int
+	idle    int
+}
+
+// busy reports whether tc has streams in use. The caller holds s.mu.
+func (tc *trackedConn) busy() bool {
+	return tc.streams > tc.idle
+}
+
+// Shutdown gracefully stops the server: it stops accepting connections,
+// refuses new streams, closes connections as soon as they have no streams
+// in flight and waits for the rest to finish. If ctx is done first, the
+// remaining connections are closed and ctx's error is returned. Listen
+// returns ErrServerClosed once every connection is gone. Sessions, as
+// served by ListenDoH, ListenDNS and ServeQuery, are ended at once, and
+// ListenDoH and ListenDNS return.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if s.dohServer != nil {
+		s.dohServer.Close()
+	}
+	if s.stopDNS != nil {
+		s.stopDNS()
+	}
+	for tc := range s.conns {
+		if !tc.busy() {
+			closeForShutdown(tc.conn)
+		}
+	}
+	s.mu.Unlock()
+	s.sessions.closeAll()
+
+	done := make(chan struct{})
+	go func() {
+		s.connWG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for tc := range s.conns {
+			closeForShutdown(tc.conn)
+		}
+		s.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// trackConn registers a newly accepted connection, unless the server is
+// shutting down
+func (s *Server) trackConn(conn quic.Connection) (*trackedConn, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closing {
+		return nil, false
+	}
+	tc := &trackedConn{conn: conn}
+	if s.conns == nil {
+		s.conns = make(map[*trackedConn]struct{})
+	}
+	s.conns[tc] = struct{}{}
+	s.connWG.Add(1)
+	return tc, true
+}
+
+func (s *Server) untrackConn(tc *trackedConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, tc)
+	s.connWG.Done()
+}
+
+// startStream counts a stream of tc as in flight, unless the server is
+// shutting down
+func (s *Server) startStream(tc *trackedConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closing {
+		return false
+	}
+	tc.streams++
+	return true
+}
+
+// endStream counts a stream of tc as finished, closing the connection if it
+// was the last one during shutdown
+func (s *Server) endStream(tc *trackedConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tc.streams--
+	if s.closing && !tc.busy() {
+		time.AfterFunc(shutdownLinger, func() { closeForShutdown(tc.conn) })
+	}
+}
+
+// idleStream counts a reusable stream of tc as waiting for its next use,
+// closing the connection during shutdown if no other stream is in use
+func (s *Server) idleStream(tc *trackedConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tc.idle++
+	if s.closing && !tc.busy() {
+		time.AfterFunc(shutdownLinger, func() { closeForShutdown(tc.conn) })
+	}
+}
+
+// resumeStream counts an idle reusable stream of tc as in use again, and
+// reports false if the server is shutting down and it should end instead
+func (s *Server) resumeStream(tc *trackedConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tc.idle--
+	return !s.closing
+}
+
+// shuttingDown reports whether Shutdown has been called
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closing
+}
+
+func closeForShutdown(conn quic.Connection) {
+	conn.CloseWithError(ErrorCodeShutdown, "server shutting down")
+}
+
+// refuseStream resets a stream opened while the server is shutting down
+func refuseStream(stream quic.Stream) {
+	stream.CancelRead(quic.StreamErrorCode(ErrorCodeShutdown))
+	stream.CancelWrite(quic.StreamErrorCode(ErrorCodeShutdown))
+}
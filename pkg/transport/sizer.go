@@ -0,0 +1,72 @@
+package transport
+
+import (
+	"sync"
+)
+
+const (
+	// minPayloadSize is the smallest per-query payload the sizer backs off to
+	minPayloadSize = 8
+	// initialPayloadSize is the conservative per-query payload used until
+	// queries have been seen to succeed
+	initialPayloadSize = 32
+	// payloadGrowthInterval is the number of consecutive successes needed
+	// before the payload size grows
+	payloadGrowthInterval = 8
+)
+
+// payloadSizer adapts the per-query payload size to what the path to a
+// server carries. It starts conservatively, grows by a quarter after every
+// run of successes, and halves on failure. The size that last failed is
+// remembered as the working maximum so growth stops short of it.
+type payloadSizer struct {
+	mu        sync.Mutex
+	current   int
+	limit     int
+	successes int
+}
+
+func newPayloadSizer(max int) *payloadSizer {
+	if max < minPayloadSize {
+		max = minPayloadSize
+	}
+	return &payloadSizer{
+		current: min(initialPayloadSize, max),
+		limit:   max,
+	}
+}
+
+// size returns the payload size to use for the next query
+func (s *payloadSizer) size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.current
+}
+
+// success records a query that went through at the current size
+func (s *payloadSizer) success() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.successes++
+	if s.successes < payloadGrowthInterval {
+		return
+	}
+	s.successes = 0
+	s.current = min(s.limit, s.current+max(1, s.current/4))
+}
+
+// failure records a query that could not be built or whose response was
+// unusable. It returns false if the size was already at its minimum.
+func (s *payloadSizer) failure() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.successes = 0
+	if s.current <= minPayloadSize {
+		return false
+	}
+	s.limit = s.current - 1
+	s.current = max(minPayloadSize, s.current/2)
+	return true
+}
@@ -0,0 +1,163 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnStats is a snapshot of the traffic on one client connection. Byte
+// counts are tunneled application data, before DNS encoding.
+type ConnStats struct {
+	ConnID     uint64
+	RemoteAddr string
+	// Since is when the connection was accepted
+	Since time.Time
+	// BytesIn counts bytes received from the client
+	BytesIn uint64
+	// BytesOut counts bytes sent to the client
+	BytesOut uint64
+	// Streams counts streams the client has opened
+	Streams uint64
+	// ActiveStreams counts streams currently being handled
+	ActiveStreams int64
+}
+
+// Stats is a snapshot of the traffic of a client or server since it was
+// created, across all its connections and streams
+type Stats struct {
+	// BytesRead and BytesWritten count application data read from and
+	// written to streams
+	BytesRead    uint64
+	BytesWritten uint64
+	// WireBytesIn and WireBytesOut count the DNS messages carrying it, with
+	// their framing on QUIC streams
+	WireBytesIn  uint64
+	WireBytesOut uint64
+	// Queries counts DNS queries the client sent or the server received;
+	// Responses counts the DNS responses going the other way
+	Queries   uint64
+	Responses uint64
+	// Streams counts streams opened; ActiveStreams those not yet closed
+	Streams       uint64
+	ActiveStreams int64
+	// Reconnects counts connections the client re-established after losing
+	// them
+	Reconnects uint64
+}
+
+// Amplification returns the number of bytes on the wire per byte of
+// application data, the overhead of tunneling through DNS, or 0 before any
+// application data has flowed
+func (s Stats) Amplification() float64 {
+	app := s.BytesRead + s.BytesWritten
+	if app == 0 {
+		return 0
+	}
+	return float64(s.WireBytesIn+s.WireBytesOut) / float64(app)
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("%d streams (%d active), %d bytes read, %d written, %d wire bytes in, %d out, %d queries, %d responses, %.2fx amplification, %d reconnects",
+		s.Streams, s.ActiveStreams, s.BytesRead, s.BytesWritten, s.WireBytesIn, s.WireBytesOut,
+		s.Queries, s.Responses, s.Amplification(), s.Reconnects)
+}
+
+// trafficCounters accumulates the traffic of a client or server
+type trafficCounters struct {
+	bytesRead     atomic.Uint64
+	bytesWritten  atomic.Uint64
+	wireIn        atomic.Uint64
+	wireOut       atomic.Uint64
+	queries       atomic.Uint64
+	responses     atomic.Uint64
+	streams       atomic.Uint64
+	activeStreams atomic.Int64
+	reconnects    atomic.Uint64
+}
+
+func (c *trafficCounters) snapshot() Stats {
+	return Stats{
+		BytesRead:     c.bytesRead.Load(),
+		BytesWritten:  c.bytesWritten.Load(),
+		WireBytesIn:   c.wireIn.Load(),
+		WireBytesOut:  c.wireOut.Load(),
+		Queries:       c.queries.Load(),
+		Responses:     c.responses.Load(),
+		Streams:       c.streams.Load(),
+		ActiveStreams: c.activeStreams.Load(),
+		Reconnects:    c.reconnects.Load(),
+	}
+}
+
+// connCounters accumulates the traffic of a live connection
+type connCounters struct {
+	connID        uint64
+	remoteAddr    net.Addr
+	since         time.Time
+	bytesIn       atomic.Uint64
+	bytesOut      atomic.Uint64
+	streams       atomic.Uint64
+	activeStreams atomic.Int64
+	// compress is set once the client negotiates compressed data streams
+	compress atomic.Bool
+}
+
+func (c *connCounters) snapshot() ConnStats {
+	return ConnStats{
+		ConnID:        c.connID,
+		RemoteAddr:    c.remoteAddr.String(),
+		Since:         c.since,
+		BytesIn:       c.bytesIn.Load(),
+		BytesOut:      c.bytesOut.Load(),
+		Streams:       c.streams.Load(),
+		ActiveStreams: c.activeStreams.Load(),
+	}
+}
+
+// connStatsTable tracks counters for the server's live connections. Entries
+// are removed when their connection closes.
+type connStatsTable struct {
+	mu    sync.Mutex
+	conns map[uint64]*connCounters
+}
+
+func (t *connStatsTable) add(connID uint64, remoteAddr net.Addr) *connCounters {
+	c := &connCounters{
+		connID:     connID,
+		remoteAddr: remoteAddr,
+		since:      time.Now(),
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns == nil {
+		t.conns = make(map[uint64]*connCounters)
+	}
+	t.conns[connID] = c
+	return c
+}
+
+func (t *connStatsTable) remove(connID uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, connID)
+}
+
+// snapshot returns the stats of every live connection, ordered by ID
+func (t *connStatsTable) snapshot() []ConnStats {
+	t.mu.Lock()
+	stats := make([]ConnStats, 0, len(t.conns))
+	for _, c := range t.conns {
+		stats = append(stats, c.snapshot())
+	}
+	t.mu.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].ConnID < stats[j].ConnID
+	})
+	return stats
+}
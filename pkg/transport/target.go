@@ -0,0 +1,158 @@
+package transport
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// MaxTargetLength is the longest target address a stream prologue can carry
+	MaxTargetLength = 255
+
+	// statusOK is the stream status the server sends ahead of its first data
+	// on a data stream it accepted. A rejected stream's status is instead an
+	// application error code followed by a one-byte length and a message.
+	statusOK byte = 0
+	// maxStatusMessage is the longest rejection message a status carries
+	maxStatusMessage = 255
+)
+
+// TargetStream is implemented by server-side streams to expose the target
+// the client requested in the stream prologue
+type TargetStream interface {
+	// Target returns the requested address, or "" for the server's default
+	Target() string
+}
+
+// StreamRejecter is implemented by server-side data streams. A handler that
+// can't serve a stream calls Reject before writing any data, so the client
+// gets the reason instead of a bare stream reset.
+type StreamRejecter interface {
+	Reject(err error) error
+}
+
+// RejectError is returned by reads on a client stream the server rejected
+type RejectError struct {
+	Code    quic.ApplicationErrorCode
+	Message string
+}
+
+func (e *RejectError) Error() string {
+	return fmt.Sprintf("stream rejected by server (code %d): %s", e.Code, e.Message)
+}
+
+// Is reports whether the rejection code corresponds to target, so that
+// errors.Is(err, ErrTargetUnreachable) works on the client
+func (e *RejectError) Is(target error) bool {
+	switch target {
+	case ErrTargetDenied:
+		return e.Code == ErrorCodeTargetDenied
+	case ErrTargetUnreachable:
+		return e.Code == ErrorCodeTargetUnreachable
+	default:
+		return false
+	}
+}
+
+// rejectStatus encodes the stream status reporting err
+func rejectStatus(err error) []byte {
+	msg := err.Error()
+	if len(msg) > maxStatusMessage {
+		msg = msg[:maxStatusMessage]
+	}
+
+	status := make([]byte, 0, 2+len(msg))
+	status = append(status, byte(streamErrorCode(err)), byte(len(msg)))
+	return append(status, msg...)
+}
+
+// parseStatus consumes the stream status at the start of data and returns
+// the data after it. more is true if data ends before the status does.
+func parseStatus(data []byte) (rest []byte, more bool, err error) {
+	if len(data) == 0 {
+		return nil, true, nil
+	}
+	if data[0] == statusOK {
+		return data[1:], false, nil
+	}
+
+	if len(data) < 2 || len(data) < 2+int(data[1]) {
+		return nil, true, nil
+	}
+	return nil, false, &RejectError{
+		Code:    quic.ApplicationErrorCode(data[0]),
+		Message: string(data[2 : 2+int(data[1])]),
+	}
+}
+
+// ValidateTarget checks that target is a host:port address a stream prologue
+// can carry, optionally prefixed with "tcp://" or "udp://". The empty target,
+// selecting the server's default, is valid.
+func ValidateTarget(target string) error {
+	if target == "" {
+		return nil
+	}
+	if len(target) > MaxTargetLength {
+		return fmt.Errorf("target address longer than %d bytes", MaxTargetLength)
+	}
+
+	addr := target
+	if scheme, rest, ok := strings.Cut(target, "://"); ok {
+		if scheme != "tcp" && scheme != "udp" {
+			return fmt.Errorf("invalid target %q: unsupported scheme", target)
+		}
+		addr = rest
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid target %q: %w", target, err)
+	}
+	if host == "" || strings.ContainsFunc(host, func(r rune) bool {
+		return r <= ' ' || r == 0x7f || r == '/'
+	}) {
+		return fmt.Errorf("invalid target %q: bad host", target)
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		return fmt.Errorf("invalid target %q: bad port", target)
+	}
+	return nil
+}
+
+// WriteTarget writes the stream prologue naming the target the server should
+// connect the stream to: a one-byte length followed by the address. An empty
+// target selects the server's default.
+func WriteTarget(w io.Writer, target string) error {
+	if err := ValidateTarget(target); err != nil {
+		return err
+	}
+
+	prologue := make([]byte, 0, 1+len(target))
+	prologue = append(prologue, byte(len(target)))
+	prologue = append(prologue, target...)
+
+	if _, err := w.Write(prologue); err != nil {
+		return fmt.Errorf("failed to send target prologue: %w", err)
+	}
+	return nil
+}
+
+// ReadTarget reads the stream prologue written by WriteTarget
+func ReadTarget(r io.Reader) (string, error) {
+	var length [1]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return "", fmt.Errorf("failed to read target prologue: %w", err)
+	}
+
+	target := make([]byte, length[0])
+	if _, err := io.ReadFull(r, target); err != nil {
+		return "", fmt.Errorf("failed to read target prologue: %w", err)
+	}
+
+	return string(target), nil
+}
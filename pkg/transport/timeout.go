@@ -0,0 +1,47 @@
+package transport
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// DefaultConnectTimeout bounds one connection attempt, from the QUIC
+	// handshake through authentication and feature negotiation, when the
+	// caller's context has no deadline
+	DefaultConnectTimeout = 30 * time.Second
+	// DefaultOpenStreamTimeout bounds opening a stream and sending its
+	// prologue when the caller's context has no deadline
+	DefaultOpenStreamTimeout = 30 * time.Second
+)
+
+// SetConnectTimeout sets how long a connection attempt may take when the
+// context passed to Connect has no deadline, so a server that drops every
+// packet doesn't block it forever. It also bounds each reconnection attempt
+// and the dial of every additional path. Zero disables the default, leaving
+// only the QUIC handshake idle timeout; see Config.HandshakeIdleTimeout. It
+// must be called before Connect.
+func (c *Client) SetConnectTimeout(d time.Duration) {
+	c.connectTimeout = d
+}
+
+// SetOpenStreamTimeout sets how long opening a stream may take when the
+// caller's context has no deadline, such as while the server's stream
+// limit is exhausted or a lost connection is being re-established; the
+// reconnection itself carries on within its SetReconnect timeout. Zero
+// disables the default.
+func (c *Client) SetOpenStreamTimeout(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.openTimeout = d
+}
+
+// withDefaultTimeout derives a context from ctx that expires after d,
+// unless ctx already has a deadline or d is zero
+func withDefaultTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || d <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, d)
+}
@@ -0,0 +1,122 @@
+package transport_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/getlantern/lantern/slipstream/pkg/slipstreamtest"
+	"github.com/getlantern/lantern/slipstream/pkg/transport"
+)
+
+// unreachableClient returns a client of a server that drops every packet
+func unreachableClient(t *testing.T, config transport.Config) *transport.Client {
+	t.Helper()
+	// Nothing reads the server's end, so the client's packets go nowhere
+	serverConn, clientConn := slipstreamtest.PacketPipe()
+	t.Cleanup(func() {
+		serverConn.Close()
+		clientConn.Close()
+	})
+
+	client := transport.NewClientWithConfig(serverConn.LocalAddr().String(), slipstreamtest.Domain, config)
+	client.SetPacketConn(clientConn)
+	client.SetInsecureSkipVerify(true)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// connectWithin checks that Connect fails in about timeout and returns its
+// error
+func connectWithin(t *testing.T, ctx context.Context, client *transport.Client, timeout time.Duration) error {
+	t.Helper()
+	start := time.Now()
+	err := client.Connect(ctx)
+	elapsed := time.Since(start)
+
+	if err == nil {
+		t.Fatal("connected to an unreachable server")
+	}
+	if elapsed < timeout || elapsed > timeout+2*time.Second {
+		t.Fatalf("Connect returned after %v, want about %v", elapsed, timeout)
+	}
+	return err
+}
+
+func TestConnectTimeout(t *testing.T) {
+	const timeout = 300 * time.Millisecond
+	client := unreachableClient(t, transport.DefaultConfig())
+	client.SetConnectTimeout(timeout)
+
+	err := connectWithin(t, context.Background(), client, timeout)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestConnectDeadlineOverridesTimeout(t *testing.T) {
+	const deadline = 300 * time.Millisecond
+	client := unreachableClient(t, transport.DefaultConfig())
+	client.SetConnectTimeout(time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	defer cancel()
+	err := connectWithin(t, ctx, client, deadline)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestHandshakeIdleTimeout(t *testing.T) {
+	const timeout = 500 * time.Millisecond
+	config := transport.DefaultConfig()
+	config.HandshakeIdleTimeout = timeout
+	client := unreachableClient(t, config)
+	client.SetConnectTimeout(0)
+
+	connectWithin(t, context.Background(), client, timeout)
+}
+
+// quicStreamLimit is how many streams quic-go lets a peer have open at once
+// by default
+const quicStreamLimit = 100
+
+func TestOpenStreamDeadlineWhileStreamsExhausted(t *testing.T) {
+	// Echo streams stay open until the client closes them
+	h := newHarness(t, transport.EchoHandler{})
+	for i := 0; i < quicStreamLimit; i++ {
+		stream, err := h.Client.OpenStream(testContext(t))
+		if err != nil {
+			t.Fatalf("stream %d: %v", i, err)
+		}
+		defer stream.Close()
+	}
+
+	for _, tc := range []struct {
+		name     string
+		deadline time.Duration
+	}{
+		{"short deadline", 300 * time.Millisecond},
+		{"expired deadline", -time.Second},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), tc.deadline)
+			defer cancel()
+
+			start := time.Now()
+			stream, err := h.Client.OpenStream(ctx)
+			elapsed := time.Since(start)
+			if err == nil {
+				stream.Close()
+				t.Fatal("opened a stream over the server's limit")
+			}
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("got %v, want context.DeadlineExceeded", err)
+			}
+			if wait := max(tc.deadline, 0); elapsed < wait || elapsed > wait+2*time.Second {
+				t.Fatalf("OpenStream returned after %v, want about %v", elapsed, wait)
+			}
+		})
+	}
+}
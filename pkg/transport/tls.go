@@ -0,0 +1,236 @@
+package transport
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+)
+
+// DefaultCertValidity is the validity period of generated certificates
+const DefaultCertValidity = 365 * 24 * time.Hour
+
+// ErrCertPinMismatch is returned when the server's certificate doesn't match
+// the client's pin
+var ErrCertPinMismatch = errors.New("server certificate does not match pin")
+
+// KeyType selects the algorithm of the generated certificate key
+type KeyType int
+
+const (
+	// KeyTypeRSA generates a 2048-bit RSA key
+	KeyTypeRSA KeyType = iota
+	// KeyTypeECDSAP256 generates an ECDSA key on the P-256 curve
+	KeyTypeECDSAP256
+	// KeyTypeEd25519 generates an Ed25519 key, which is the fastest to
+	// generate and gives the smallest handshakes
+	KeyTypeEd25519
+)
+
+// ParseKeyType parses a key type name: "rsa", "ecdsa" or "ed25519"
+func ParseKeyType(name string) (KeyType, error) {
+	switch strings.ToLower(name) {
+	case "rsa":
+		return KeyTypeRSA, nil
+	case "ecdsa", "ecdsa-p256", "p256":
+		return KeyTypeECDSAP256, nil
+	case "ed25519":
+		return KeyTypeEd25519, nil
+	default:
+		return 0, fmt.Errorf("unknown key type %q", name)
+	}
+}
+
+func (k KeyType) String() string {
+	switch k {
+	case KeyTypeRSA:
+		return "rsa"
+	case KeyTypeECDSAP256:
+		return "ecdsa"
+	case KeyTypeEd25519:
+		return "ed25519"
+	default:
+		return fmt.Sprintf("KeyType(%d)", int(k))
+	}
+}
+
+// CertConfig controls the self-signed certificate generated by the server
+// when no certificate is loaded
+type CertConfig struct {
+	// CommonName is the certificate subject; defaults to the SNI
+	CommonName string
+	// DNSNames are additional DNS subject alternative names. The SNI is
+	// always included.
+	DNSNames []string
+	// IPAddresses are IP subject alternative names
+	IPAddresses []net.IP
+	// Validity is how long the certificate is valid for; defaults to
+	// DefaultCertValidity
+	Validity time.Duration
+	// KeyType is the key algorithm; defaults to RSA for compatibility
+	KeyType KeyType
+}
+
+// generateCertificate generates a self-signed TLS certificate for testing
+func generateCertificate(config Config) (tls.Certificate, error) {
+	cc := config.Cert
+	key, keyUsage, err := generateKey(cc.KeyType)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	commonName := cc.CommonName
+	if commonName == "" {
+		commonName = config.SNI
+	}
+	validity := cc.Validity
+	if validity == 0 {
+		validity = DefaultCertValidity
+	}
+
+	// Always include the SNI so clients that verify the server name succeed
+	dnsNames := append([]string{config.SNI}, cc.DNSNames...)
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			CommonName: commonName,
+		},
+		DNSNames:              dedupeStrings(dnsNames),
+		IPAddresses:           cc.IPAddresses,
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(validity),
+		KeyUsage:              keyUsage,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// serverTLSConfig creates the server's TLS configuration. Certificates are
+// looked up on every handshake so they can be replaced at runtime, and
+// handshakes from clients that send a different SNI are rejected.
+func serverTLSConfig(config Config, getCertificate func() *tls.Certificate) *tls.Config {
+	return &tls.Config{
+		NextProtos: []string{config.ALPN},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return getCertificate(), nil
+		},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if hello.ServerName != config.SNI {
+				return nil, fmt.Errorf("unexpected server name %q", hello.ServerName)
+			}
+			return nil, nil
+		},
+	}
+}
+
+// CertificatePin returns the pin identifying cert's key: the hex-encoded
+// SHA-256 digest of its SubjectPublicKeyInfo
+func CertificatePin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// parsePin decodes a pin produced by CertificatePin. Colons between bytes
+// are accepted, as printed by openssl.
+func parsePin(pin string) ([]byte, error) {
+	digest, err := hex.DecodeString(strings.ReplaceAll(pin, ":", ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate pin: %w", err)
+	}
+	if len(digest) != sha256.Size {
+		return nil, fmt.Errorf("invalid certificate pin: want %d bytes, got %d", sha256.Size, len(digest))
+	}
+	return digest, nil
+}
+
+// verifyPin returns a TLS connection check that the server's leaf
+// certificate matches pin
+func verifyPin(pin []byte) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return ErrCertPinMismatch
+		}
+		sum := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+		if subtle.ConstantTimeCompare(sum[:], pin) != 1 {
+			return ErrCertPinMismatch
+		}
+		return nil
+	}
+}
+
+// verifiedTLSConfig returns a copy of base that verifies the server by pin,
+// if one is given, or skips verification if insecure
+func verifiedTLSConfig(base *tls.Config, pin []byte, insecure bool) *tls.Config {
+	cfg := base.Clone()
+	cfg.InsecureSkipVerify = insecure
+	if pin != nil {
+		// The pin identifies the server by itself, so the chain is only
+		// verified if roots were given explicitly
+		if cfg.RootCAs == nil {
+			cfg.InsecureSkipVerify = true
+		}
+		cfg.VerifyConnection = verifyPin(pin)
+	}
+	return cfg
+}
+
+// generateKey creates a private key of the given type and returns the key
+// usage appropriate for it. Only RSA keys are used for key encipherment.
+func generateKey(keyType KeyType) (crypto.Signer, x509.KeyUsage, error) {
+	switch keyType {
+	case KeyTypeRSA:
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		return key, x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature, err
+	case KeyTypeECDSAP256:
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		return key, x509.KeyUsageDigitalSignature, err
+	case KeyTypeEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, x509.KeyUsageDigitalSignature, err
+	default:
+		return nil, 0, fmt.Errorf("unsupported key type %v", keyType)
+	}
+}
+
+func dedupeStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	result := values[:0]
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			result = append(result, v)
+		}
+	}
+	return result
+}
@@ -3,12 +3,13 @@ package transport
 import (
 	"context"
 	"io"
+	"net"
 )
 
 const (
-	// ALPN is the application layer protocol negotiation string
+	// ALPN is the default application layer protocol negotiation string
 	ALPN = "picoquic_sample"
-	// SNI is the server name indication
+	// SNI is the default server name indication
 	SNI = "test.example.com"
 )
 
@@ -17,6 +18,21 @@ type StreamHandler interface {
 	HandleStream(ctx context.Context, stream io.ReadWriteCloser) error
 }
 
+// StreamInfo describes the connection a stream arrived on. Streams passed to
+// a StreamHandler by Server implement it, so handlers can log and make
+// decisions per client.
+type StreamInfo interface {
+	// RemoteAddr returns the client's UDP address
+	RemoteAddr() net.Addr
+	// LocalAddr returns the server's UDP address
+	LocalAddr() net.Addr
+	// StreamID returns the QUIC stream ID
+	StreamID() int64
+	// ConnID returns an ID the server assigns to each connection, unique for
+	// the lifetime of the server
+	ConnID() uint64
+}
+
 // StreamHandlerFunc is a function adapter for StreamHandler
 type StreamHandlerFunc func(ctx context.Context, stream io.ReadWriteCloser) error
 
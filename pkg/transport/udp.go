@@ -0,0 +1,72 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+)
+
+// resolveLocalAddr resolves a local UDP bind address of the form
+// "host[:port]". The host may be an IP address, a hostname, or the name of a
+// network interface, which binds to the interface's first IPv4 address (or
+// its first address if it has no IPv4 one). A missing port selects any port.
+func resolveLocalAddr(addr string) (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, "0"
+	}
+
+	if iface, err := net.InterfaceByName(host); err == nil {
+		ip, err := interfaceIP(iface)
+		if err != nil {
+			return nil, err
+		}
+		host = ip.String()
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, fmt.Errorf("invalid local address %q: %w", addr, err)
+	}
+	return udpAddr, nil
+}
+
+// interfaceIP returns the address to bind to on iface
+func interfaceIP(iface *net.Interface) (net.IP, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get addresses of interface %s: %w", iface.Name, err)
+	}
+
+	var first net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ip4 := ipNet.IP.To4(); ip4 != nil {
+			return ip4, nil
+		}
+		if first == nil {
+			first = ipNet.IP
+		}
+	}
+
+	if first == nil {
+		return nil, fmt.Errorf("interface %s has no addresses", iface.Name)
+	}
+	return first, nil
+}
+
+// listenUDP opens a UDP socket bound to addr (see resolveLocalAddr)
+func listenUDP(addr string) (*net.UDPConn, error) {
+	udpAddr, err := resolveLocalAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind %s: %w", udpAddr, err)
+	}
+	return conn, nil
+}